@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"mydocker/builder"
+	"mydocker/capabilities"
+	"mydocker/cgroups"
+	"mydocker/container"
+	"mydocker/image"
+	"mydocker/path"
+)
+
+/*
+buildImage 按Dockerfile构建镜像，RUN指令在前台运行的容器中执行，容器退出后提交可写层并删除容器
+RUN的容器默认只有loopback，没有外部网络，需要下载等操作时用networkName指定网络
+*/
+func buildImage(contextDir string, dockerfile string, tags []string, noCache bool, cgroupParent string, networkName string) error {
+	fi, err := os.Stat(contextDir)
+	if err != nil {
+		return fmt.Errorf("os.Stat err: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("build context %s is not a directory", contextDir)
+	}
+	if dockerfile == "" {
+		dockerfile = filepath.Join(contextDir, "Dockerfile")
+	}
+	options := &builder.Options{
+		ContextDir: contextDir,
+		Dockerfile: dockerfile,
+		NoCache:    noCache,
+		Out:        os.Stdout,
+	}
+	for _, tag := range tags {
+		ref, err := image.ParseTag(tag)
+		if err != nil {
+			return err
+		}
+		options.Tags = append(options.Tags, ref)
+	}
+	_, err = builder.Build(options, func(parent image.Digest, command []string, createdBy string, lease *image.Lease) (image.Digest, error) {
+		return runBuildStep(parent, command, createdBy, lease, cgroupParent, networkName)
+	})
+	return err
+}
+
+/*
+runBuildStep 在父镜像的容器中执行RUN指令，命令成功时把容器的可写层提交为中间镜像
+*/
+func runBuildStep(parent image.Digest, command []string, createdBy string, lease *image.Lease, cgroupParent string, networkName string) (image.Digest, error) {
+	caps, err := capabilities.NewSet(nil, nil, false)
+	if err != nil {
+		return "", err
+	}
+	initConfig := &container.InitConfig{
+		Command:  command,
+		Security: container.SecurityConfig{Capabilities: caps},
+	}
+	if err = container.ParseSecurityOpts(nil, &initConfig.Security); err != nil {
+		return "", err
+	}
+	// 不使用镜像的Entrypoint和Cmd，只执行RUN的命令
+	c, err := startContainer(true, &cgroups.ResourceConfig{}, cgroupParent, "", &container.EtcConfig{}, "", nil, networkName, nil, "", parent.String(), []string{}, initConfig)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf(" ---> Running in %s\n", c.info.Id)
+	if err = c.wait(); err != nil {
+		_ = c.clear()
+		return "", fmt.Errorf("command %q returned error: %v", createdBy, err)
+	}
+	id, err := image.Commit(parent, path.UpperPath(c.info.Name), &image.CommitOptions{
+		CreatedBy:    createdBy,
+		Intermediate: true,
+		Lease:        lease,
+		UidMaps:      c.info.UidMappings,
+		GidMaps:      c.info.GidMappings,
+	})
+	if err != nil {
+		_ = c.clear()
+		return "", fmt.Errorf("image.Commit err: %v", err)
+	}
+	if err = c.clear(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,255 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"mydocker/image"
+	"mydocker/path"
+)
+
+/*
+Options 构建参数
+*/
+type Options struct {
+	ContextDir string             // 构建上下文目录，COPY、ADD的源路径相对于该目录
+	Dockerfile string             // Dockerfile路径
+	Tags       []*image.Reference // 构建完成后添加的标签
+	NoCache    bool               // 不使用缓存
+	Out        io.Writer          // 输出构建过程
+}
+
+/*
+RunFunc 在父镜像的容器中执行RUN指令的命令，把容器的修改提交为新的镜像，返回新镜像的id
+新的层需要加入lease，构建结束之前不被GC删除
+*/
+type RunFunc func(parent image.Digest, command []string, createdBy string, lease *image.Lease) (image.Digest, error)
+
+type builder struct {
+	options *Options
+	run     RunFunc
+	lease   *image.Lease // 中间镜像不在镜像列表中，构建期间用租约保留它们的层
+}
+
+/*
+Build 按Dockerfile构建镜像，每条指令产生一个中间镜像，返回最终镜像的id
+每一步的缓存键由父镜像id、指令和COPY、ADD的文件内容决定，命中缓存时直接使用之前的中间镜像
+*/
+func Build(options *Options, run RunFunc) (image.Digest, error) {
+	f, err := os.Open(options.Dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("os.Open err: %v", err)
+	}
+	instructions, err := Parse(f)
+	_ = f.Close()
+	if err != nil {
+		return "", fmt.Errorf("Parse err: %v", err)
+	}
+	lease, err := image.NewLease()
+	if err != nil {
+		return "", err
+	}
+	defer lease.Release()
+	b := &builder{options: options, run: run, lease: lease}
+	var id image.Digest
+	for i, inst := range instructions {
+		_, _ = fmt.Fprintf(options.Out, "Step %d/%d : %s\n", i+1, len(instructions), inst.Original)
+		if id, err = b.step(id, inst); err != nil {
+			return "", fmt.Errorf("line %d: %s err: %v", inst.Line, inst.Command, err)
+		}
+		_, _ = fmt.Fprintf(options.Out, " ---> %s\n", id.Short())
+	}
+	// 只有最终镜像加入镜像列表
+	if err = image.Register(id); err != nil {
+		return "", err
+	}
+	_, _ = fmt.Fprintf(options.Out, "Successfully built %s\n", id.Short())
+	for _, ref := range options.Tags {
+		if err = image.Tag(ref, id); err != nil {
+			return "", fmt.Errorf("image.Tag err: %v", err)
+		}
+		_, _ = fmt.Fprintf(options.Out, "Successfully tagged %s\n", ref)
+	}
+	return id, nil
+}
+
+/*
+step 执行一条指令，返回这一步产生的镜像id
+*/
+func (b *builder) step(parent image.Digest, inst *Instruction) (image.Digest, error) {
+	if inst.Command == "FROM" {
+		if inst.Args == "scratch" {
+			return image.CreateIntermediate(image.Scratch())
+		}
+		id, _, err := image.Resolve(inst.Args)
+		if err != nil {
+			return "", fmt.Errorf("image.Resolve err: %v", err)
+		}
+		return id, b.pin(id)
+	}
+	img, err := image.Get(parent)
+	if err != nil {
+		return "", err
+	}
+	switch inst.Command {
+	case "RUN":
+		key := cacheKey(parent, inst.Original, "")
+		if id, ok := b.cached(key); ok {
+			return id, nil
+		}
+		command := image.ParseCommand(inst.Args)
+		id, err := b.run(parent, command, strings.Join(command, " "), b.lease)
+		if err != nil {
+			return "", err
+		}
+		return id, image.CacheSet(key, id)
+	case "COPY", "ADD":
+		return b.copy(parent, img, inst)
+	}
+	key := cacheKey(parent, inst.Original, "")
+	if id, ok := b.cached(key); ok {
+		return id, nil
+	}
+	// CMD和ENTRYPOINT在容器运行时由shell展开变量，其他指令在构建时用镜像的环境变量展开
+	args := inst.Args
+	if inst.Command != "CMD" && inst.Command != "ENTRYPOINT" {
+		args = expand(args, img.Config.Env)
+	}
+	change := inst.Command + " " + args
+	if img, err = img.Clone(); err != nil {
+		return "", err
+	}
+	if err = image.ApplyChange(&img.Config, change); err != nil {
+		return "", fmt.Errorf("image.ApplyChange err: %v", err)
+	}
+	id, err := create(img, "/bin/sh -c #(nop)  "+change, "")
+	if err != nil {
+		return "", err
+	}
+	return id, image.CacheSet(key, id)
+}
+
+/*
+copy 执行COPY、ADD，上下文中的文件先写成临时的层tar包，计算出内容摘要后再查找缓存
+*/
+func (b *builder) copy(parent image.Digest, img *image.Image, inst *Instruction) (image.Digest, error) {
+	sources, dest, err := copyArgs(inst.Args)
+	if err != nil {
+		return "", err
+	}
+	dest = expand(dest, img.Config.Env)
+	for i := range sources {
+		sources[i] = expand(sources[i], img.Config.Env)
+	}
+	if err = os.MkdirAll(path.ImageTmpPath(), 0755); err != nil {
+		return "", fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	tmp, err := os.CreateTemp(path.ImageTmpPath(), "build-")
+	if err != nil {
+		return "", fmt.Errorf("os.CreateTemp err: %v", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	c := newCopier(img, tmp)
+	if err = c.copy(b.options.ContextDir, sources, dest, img.Config.WorkingDir, inst.Command == "ADD"); err != nil {
+		return "", err
+	}
+	sum, err := c.close()
+	if err != nil {
+		return "", err
+	}
+	key := cacheKey(parent, inst.Original, sum)
+	if id, ok := b.cached(key); ok {
+		return id, nil
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("tmp.Seek err: %v", err)
+	}
+	layer, err := image.ImportLayer(tmp, b.lease)
+	if err != nil {
+		return "", fmt.Errorf("image.ImportLayer err: %v", err)
+	}
+	if img, err = img.Clone(); err != nil {
+		return "", err
+	}
+	createdBy := fmt.Sprintf("/bin/sh -c #(nop) %s %s in %s", inst.Command, sum, dest)
+	id, err := create(img, createdBy, layer.DiffID)
+	if err != nil {
+		return "", err
+	}
+	return id, image.CacheSet(key, id)
+}
+
+/*
+cached 查找缓存，--no-cache时不使用缓存，但仍然记录新的结果
+*/
+func (b *builder) cached(key image.Digest) (image.Digest, bool) {
+	if b.options.NoCache {
+		return "", false
+	}
+	id, ok := image.CacheGet(key)
+	if !ok || b.pin(id) != nil {
+		return "", false
+	}
+	_, _ = fmt.Fprintln(b.options.Out, " ---> Using cache")
+	return id, true
+}
+
+/*
+pin 把镜像的层加入租约，加入之后再检查层是否存在，避免检查之后被并发的GC删除
+*/
+func (b *builder) pin(id image.Digest) error {
+	img, err := image.Get(id)
+	if err != nil {
+		return err
+	}
+	if err = b.lease.Add(img.RootFS.DiffIDs...); err != nil {
+		return err
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !image.LayerExist(diffID) {
+			return fmt.Errorf("layer %s of image %s has been removed", diffID, id.Short())
+		}
+	}
+	return nil
+}
+
+/*
+create 保存中间镜像，diffID为空表示这一步没有产生新的层
+*/
+func create(img *image.Image, createdBy string, diffID image.Digest) (image.Digest, error) {
+	created := time.Now().UTC()
+	img.Created = &created
+	if diffID != "" {
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, diffID)
+	}
+	img.History = append(img.History, image.History{
+		Created:    &created,
+		CreatedBy:  createdBy,
+		EmptyLayer: diffID == "",
+	})
+	return image.CreateIntermediate(img)
+}
+
+func cacheKey(parent image.Digest, instruction string, content image.Digest) image.Digest {
+	return image.FromBytes([]byte(parent.String() + "\n" + instruction + "\n" + content.String()))
+}
+
+/*
+expand 用镜像的环境变量展开$VAR和${VAR}
+*/
+func expand(s string, envs []string) string {
+	return os.Expand(s, func(key string) string {
+		for i := len(envs) - 1; i >= 0; i-- {
+			if k, v, _ := strings.Cut(envs[i], "="); k == key {
+				return v
+			}
+		}
+		return ""
+	})
+}
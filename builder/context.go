@@ -0,0 +1,277 @@
+package builder
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"mydocker/image"
+)
+
+/*
+copier 把构建上下文中的文件写成COPY、ADD这一步的层tar包
+同时计算内容的摘要作为缓存的键，摘要不包含修改时间，只修改时间的文件不会使缓存失效
+*/
+type copier struct {
+	img     *image.Image // 父镜像，新建的上级目录沿用父镜像中的属性
+	tw      *tar.Writer
+	sum     hash.Hash
+	written map[string]bool // 已经写入tar包的路径
+}
+
+func newCopier(img *image.Image, w io.Writer) *copier {
+	return &copier{
+		img:     img,
+		tw:      tar.NewWriter(w),
+		sum:     sha256.New(),
+		written: make(map[string]bool),
+	}
+}
+
+/*
+copy 把上下文中的源文件复制到镜像中的dest，dest为相对路径时相对于工作目录
+源路径支持通配符，源为目录时复制目录下的内容；有多个源、dest以/结尾或者为.时dest为目录
+add为true时本地的tar包(可以是压缩的)解压到dest
+*/
+func (c *copier) copy(contextDir string, sources []string, dest string, workdir string, add bool) error {
+	var matches []string
+	for _, source := range sources {
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			return fmt.Errorf("remote source %s is not supported", source)
+		}
+		// 清理之后的路径限制在上下文目录之内
+		files, err := filepath.Glob(filepath.Join(contextDir, filepath.Clean("/"+source)))
+		if err != nil {
+			return fmt.Errorf("filepath.Glob err: %v", err)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("file not found in build context: %s", source)
+		}
+		matches = append(matches, files...)
+	}
+	destIsDir := strings.HasSuffix(dest, "/") || dest == "." || dest == ".." || len(matches) > 1
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join("/", workdir, dest)
+	}
+	dest, err := image.ResolvePath(c.img, dest)
+	if err != nil {
+		return err
+	}
+	if fi, err := image.Lstat(c.img, dest); err == nil && fi.IsDir() {
+		destIsDir = true
+	}
+	for _, file := range matches {
+		fi, err := os.Lstat(file)
+		if err != nil {
+			return fmt.Errorf("os.Lstat err: %v", err)
+		}
+		if fi.IsDir() {
+			if err = c.copyDir(file, dest); err != nil {
+				return err
+			}
+			continue
+		}
+		if add && fi.Mode().IsRegular() {
+			ok, err := c.extractArchive(file, dest)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+		target := dest
+		if destIsDir {
+			target = filepath.Join(dest, filepath.Base(file))
+		}
+		if err = c.copyFile(file, fi, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+copyDir 把目录下的内容复制到dest目录，不跟随符号链接
+*/
+func (c *copier) copyDir(dir string, dest string) error {
+	if err := c.addDir(dest); err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return fmt.Errorf("filepath.Rel err: %v", err)
+		}
+		return c.copyFile(file, fi, filepath.Join(dest, rel))
+	})
+}
+
+/*
+copyFile 把一个文件写入tar包，属主为root，硬链接作为普通文件复制
+*/
+func (c *copier) copyFile(file string, fi os.FileInfo, target string) error {
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return fmt.Errorf("os.Readlink err: %v", err)
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("tar.FileInfoHeader err: %v", err)
+	}
+	if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeSymlink {
+		// 设备、管道、socket不复制
+		return nil
+	}
+	hdr.Name = target
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err = c.addDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return c.writeEntry(hdr, nil)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("os.Open err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return c.writeEntry(hdr, f)
+}
+
+/*
+extractArchive 源文件是tar包时把其中的文件写到dest目录下，保留tar包中的属主，返回源文件是否为tar包
+*/
+func (c *copier) extractArchive(file string, dest string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, fmt.Errorf("os.Open err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	reader, err := image.Decompress(f)
+	if err != nil {
+		return false, nil
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	tr := tar.NewReader(reader)
+	hdr, err := tr.Next()
+	if err != nil {
+		// 不是tar包，作为普通文件复制
+		return false, nil
+	}
+	if err = c.addDir(dest); err != nil {
+		return true, err
+	}
+	for ; err == nil; hdr, err = tr.Next() {
+		name := filepath.Join(dest, filepath.Clean("/"+hdr.Name))
+		if name == dest {
+			continue
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = filepath.Join(dest, filepath.Clean("/"+hdr.Linkname))
+		}
+		if err = c.addDir(filepath.Dir(name)); err != nil {
+			return true, err
+		}
+		if err = c.writeEntry(hdr, tr); err != nil {
+			return true, err
+		}
+	}
+	if err != io.EOF {
+		return true, fmt.Errorf("tr.Next err: %v", err)
+	}
+	return true, nil
+}
+
+/*
+addDir 写入目录及其上级目录，镜像中已经存在的目录沿用原来的权限和属主，否则为root所有的0755目录
+否则新的层中的目录会改变下层同名目录的属性，例如/tmp的1777
+*/
+func (c *copier) addDir(dir string) error {
+	dir = filepath.Clean(dir)
+	if dir == "/" || c.written[dir] {
+		return nil
+	}
+	if err := c.addDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	}
+	if fi, err := image.Lstat(c.img, dir); err == nil && fi.IsDir() {
+		hdr.Mode = int64(fi.Mode().Perm())
+		if fi.Mode()&os.ModeSticky != 0 {
+			hdr.Mode |= 01000
+		}
+		if fi.Mode()&os.ModeSetgid != 0 {
+			hdr.Mode |= 02000
+		}
+		hdr.ModTime = fi.ModTime()
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			hdr.Uid, hdr.Gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+	return c.writeEntry(hdr, nil)
+}
+
+/*
+writeEntry 写入tar包并计入摘要，同一路径后写入的覆盖之前的
+*/
+func (c *copier) writeEntry(hdr *tar.Header, r io.Reader) error {
+	name := strings.TrimPrefix(filepath.Clean(hdr.Name), "/")
+	if hdr.Typeflag == tar.TypeDir {
+		name += "/"
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = strings.TrimPrefix(hdr.Linkname, "/")
+	}
+	c.written["/"+strings.TrimSuffix(name, "/")] = true
+	_, _ = fmt.Fprintf(c.sum, "%s\x00%c\x00%o\x00%d\x00%d\x00%s\x00%d\x00", hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Linkname, hdr.Size)
+	if err := c.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tw.WriteHeader err: %v", err)
+	}
+	if r == nil || hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	if _, err := io.CopyN(io.MultiWriter(c.tw, c.sum), r, hdr.Size); err != nil {
+		return fmt.Errorf("io.CopyN err: %v", err)
+	}
+	return nil
+}
+
+/*
+close 结束tar包，返回内容的摘要
+*/
+func (c *copier) close() (image.Digest, error) {
+	if err := c.tw.Close(); err != nil {
+		return "", fmt.Errorf("tw.Close err: %v", err)
+	}
+	return image.Digest(fmt.Sprintf("sha256:%x", c.sum.Sum(nil))), nil
+}
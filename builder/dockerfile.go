@@ -0,0 +1,125 @@
+package builder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+Instruction Dockerfile中的一条指令
+*/
+type Instruction struct {
+	Line     int    // 指令所在的行号
+	Command  string // 大写的指令名称，如RUN
+	Args     string // 指令的参数
+	Original string // 合并续行后的原始指令
+}
+
+// 支持的指令
+var instructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true, "WORKDIR": true,
+	"CMD": true, "ENTRYPOINT": true, "USER": true, "EXPOSE": true, "LABEL": true,
+}
+
+/*
+Parse 解析Dockerfile，以#开头的行为注释，行尾的\表示指令在下一行继续
+只支持一个FROM，且必须是第一条指令
+*/
+func Parse(r io.Reader) ([]*Instruction, error) {
+	var (
+		result  []*Instruction
+		current string
+		start   int
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if current == "" {
+			start = line
+		}
+		if strings.HasSuffix(text, "\\") {
+			current += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		inst, err := parseInstruction(start, current+text)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, inst)
+		current = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %v", err)
+	}
+	if current != "" {
+		inst, err := parseInstruction(start, current)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, inst)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("the Dockerfile cannot be empty")
+	}
+	for i, inst := range result {
+		if i == 0 && inst.Command != "FROM" {
+			return nil, fmt.Errorf("line %d: the first instruction must be FROM", inst.Line)
+		}
+		if i > 0 && inst.Command == "FROM" {
+			return nil, fmt.Errorf("line %d: multi-stage builds are not supported", inst.Line)
+		}
+	}
+	return result, nil
+}
+
+func parseInstruction(line int, text string) (*Instruction, error) {
+	text = strings.TrimSpace(text)
+	command, args, _ := strings.Cut(text, " ")
+	command = strings.ToUpper(command)
+	args = strings.TrimSpace(args)
+	if !instructions[command] {
+		return nil, fmt.Errorf("line %d: unsupported instruction: %s", line, command)
+	}
+	if args == "" {
+		return nil, fmt.Errorf("line %d: %s requires at least one argument", line, command)
+	}
+	switch command {
+	case "FROM":
+		if len(strings.Fields(args)) != 1 {
+			return nil, fmt.Errorf("line %d: FROM requires exactly one argument", line)
+		}
+	case "COPY", "ADD":
+		if strings.HasPrefix(args, "--") {
+			return nil, fmt.Errorf("line %d: %s flags are not supported", line, command)
+		}
+		if _, _, err := copyArgs(args); err != nil {
+			return nil, fmt.Errorf("line %d: %s %v", line, command, err)
+		}
+	}
+	return &Instruction{Line: line, Command: command, Args: args, Original: command + " " + args}, nil
+}
+
+/*
+copyArgs 解析COPY、ADD的参数，最后一个为目标路径，其余为源路径，支持JSON数组格式
+*/
+func copyArgs(args string) ([]string, string, error) {
+	var words []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &words); err != nil {
+			return nil, "", fmt.Errorf("json.Unmarshal err: %v", err)
+		}
+	} else {
+		words = strings.Fields(args)
+	}
+	if len(words) < 2 {
+		return nil, "", fmt.Errorf("requires at least two arguments")
+	}
+	return words[:len(words)-1], words[len(words)-1], nil
+}
@@ -0,0 +1,218 @@
+package capabilities
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 内核支持的capability，见linux/capability.h
+var capabilityList = map[string]int{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// 与docker默认一致的capability
+var defaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+/*
+Set 进程的五个capability集合
+*/
+type Set struct {
+	Bounding    []string `json:"bounding"`    // 进程及其子进程能够获得的capability上限
+	Effective   []string `json:"effective"`   // 内核做权限检查时使用的capability
+	Permitted   []string `json:"permitted"`   // 进程可以加入effective的capability
+	Inheritable []string `json:"inheritable"` // execve时可以被继承的capability
+	Ambient     []string `json:"ambient"`     // 非root用户execve时保留的capability
+}
+
+/*
+NewSet 在docker默认capability的基础上增加、删除capability，privileged拥有全部capability
+与docker一致，默认的inheritable和ambient为空
+*/
+func NewSet(add []string, drop []string, privileged bool) (*Set, error) {
+	caps := make(map[string]bool)
+	if privileged {
+		for name := range capabilityList {
+			caps[name] = true
+		}
+	} else {
+		for _, name := range defaultCapabilities {
+			caps[name] = true
+		}
+	}
+	for _, name := range drop {
+		if strings.EqualFold(name, "ALL") {
+			caps = make(map[string]bool)
+			continue
+		}
+		capName, err := normalize(name)
+		if err != nil {
+			return nil, err
+		}
+		delete(caps, capName)
+	}
+	for _, name := range add {
+		if strings.EqualFold(name, "ALL") {
+			for capName := range capabilityList {
+				caps[capName] = true
+			}
+			continue
+		}
+		capName, err := normalize(name)
+		if err != nil {
+			return nil, err
+		}
+		caps[capName] = true
+	}
+	list := make([]string, 0, len(caps))
+	for name := range caps {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	set := &Set{Bounding: list, Effective: list, Permitted: list}
+	if privileged {
+		set.Inheritable = list
+	}
+	return set, nil
+}
+
+/*
+normalize 统一capability名称，支持省略CAP_前缀和小写
+*/
+func normalize(name string) (string, error) {
+	capName := strings.ToUpper(name)
+	if !strings.HasPrefix(capName, "CAP_") {
+		capName = "CAP_" + capName
+	}
+	if _, ok := capabilityList[capName]; !ok {
+		return "", fmt.Errorf("unknown capability: %s", name)
+	}
+	return capName, nil
+}
+
+/*
+Apply 设置当前线程的capability，调用者需要锁定线程并在同一线程上execve
+先删除bounding中不需要的capability，再通过capset设置effective、permitted、inheritable，最后设置ambient
+*/
+func Apply(set *Set) error {
+	last, err := lastCap()
+	if err != nil {
+		return fmt.Errorf("lastCap err: %v", err)
+	}
+	// 忽略内核不支持的capability
+	mask := uint64(1)<<uint(last+1) - 1
+	bounding := toBits(set.Bounding) & mask
+	for c := 0; c <= last; c++ {
+		if bounding&(1<<uint(c)) != 0 {
+			continue
+		}
+		if err = unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("prctl PR_CAPBSET_DROP %d err: %v", c, err)
+		}
+	}
+	effective, permitted, inheritable := toBits(set.Effective)&mask, toBits(set.Permitted)&mask, toBits(set.Inheritable)&mask
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{
+		{Effective: uint32(effective), Permitted: uint32(permitted), Inheritable: uint32(inheritable)},
+		{Effective: uint32(effective >> 32), Permitted: uint32(permitted >> 32), Inheritable: uint32(inheritable >> 32)},
+	}
+	if err = unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("unix.Capset err: %v", err)
+	}
+	if err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl PR_CAP_AMBIENT_CLEAR_ALL err: %v", err)
+	}
+	for _, name := range set.Ambient {
+		c, ok := capabilityList[name]
+		if !ok || c > last {
+			continue
+		}
+		if err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("prctl PR_CAP_AMBIENT_RAISE %s err: %v", name, err)
+		}
+	}
+	return nil
+}
+
+/*
+把capability名称列表转换为位图
+*/
+func toBits(names []string) uint64 {
+	var bits uint64
+	for _, name := range names {
+		if c, ok := capabilityList[name]; ok {
+			bits |= 1 << uint(c)
+		}
+	}
+	return bits
+}
+
+/*
+内核支持的最大capability编号
+*/
+func lastCap() (int, error) {
+	content, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
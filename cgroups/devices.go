@@ -0,0 +1,73 @@
+package cgroups
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 设备类型
+	DeviceTypeAll   = 'a'
+	DeviceTypeChar  = 'c'
+	DeviceTypeBlock = 'b'
+	// Wildcard 主次设备号为任意值
+	Wildcard = -1
+)
+
+/*
+DeviceRule 设备白名单规则，Permissions由r(读)、w(写)、m(mknod)组成
+*/
+type DeviceRule struct {
+	Type        rune
+	Major       int64
+	Minor       int64
+	Permissions string
+}
+
+// DefaultDeviceRules 与docker一致的默认白名单: 允许创建任意设备节点，允许读写容器默认的设备
+var DefaultDeviceRules = []DeviceRule{
+	{Type: DeviceTypeChar, Major: Wildcard, Minor: Wildcard, Permissions: "m"},
+	{Type: DeviceTypeBlock, Major: Wildcard, Minor: Wildcard, Permissions: "m"},
+	{Type: DeviceTypeChar, Major: 1, Minor: 3, Permissions: "rwm"},          // /dev/null
+	{Type: DeviceTypeChar, Major: 1, Minor: 5, Permissions: "rwm"},          // /dev/zero
+	{Type: DeviceTypeChar, Major: 1, Minor: 7, Permissions: "rwm"},          // /dev/full
+	{Type: DeviceTypeChar, Major: 1, Minor: 8, Permissions: "rwm"},          // /dev/random
+	{Type: DeviceTypeChar, Major: 1, Minor: 9, Permissions: "rwm"},          // /dev/urandom
+	{Type: DeviceTypeChar, Major: 5, Minor: 0, Permissions: "rwm"},          // /dev/tty
+	{Type: DeviceTypeChar, Major: 5, Minor: 1, Permissions: "rwm"},          // /dev/console
+	{Type: DeviceTypeChar, Major: 5, Minor: 2, Permissions: "rwm"},          // /dev/pts/ptmx
+	{Type: DeviceTypeChar, Major: 136, Minor: Wildcard, Permissions: "rwm"}, // /dev/pts/*
+	{Type: DeviceTypeChar, Major: 10, Minor: 200, Permissions: "rwm"},       // /dev/net/tun
+}
+
+/*
+String cgroup v1 devices.allow的格式，例如c 1:3 rwm
+*/
+func (r DeviceRule) String() string {
+	format := func(n int64) string {
+		if n == Wildcard {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	if r.Type == DeviceTypeAll {
+		return "a"
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, format(r.Major), format(r.Minor), r.Permissions)
+}
+
+/*
+ValidatePermissions 校验设备权限字符串
+*/
+func ValidatePermissions(permissions string) error {
+	if permissions == "" {
+		return fmt.Errorf("empty device permissions")
+	}
+	for _, c := range permissions {
+		if !strings.ContainsRune("rwm", c) {
+			return fmt.Errorf("invalid device permissions: %s", permissions)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package cgroups
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// eBPF指令
+	bpfLdxMemW  = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	bpfAndImm   = unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K
+	bpfRshImm   = unix.BPF_ALU64 | unix.BPF_RSH | unix.BPF_K
+	bpfMovImm   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	bpfMovReg   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+	bpfJneImm   = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	bpfJneReg   = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X
+	bpfExit     = unix.BPF_JMP | unix.BPF_EXIT
+	bpfLicense  = "GPL"
+	bpfInsnSize = 8
+)
+
+/*
+bpfInsn 一条eBPF指令
+*/
+type bpfInsn struct {
+	code uint8
+	dst  uint8
+	src  uint8
+	off  int16
+	imm  int32
+}
+
+/*
+bpfProgLoadAttr bpf(BPF_PROG_LOAD)的参数，对应union bpf_attr的前几个字段
+*/
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+/*
+bpfProgAttachAttr bpf(BPF_PROG_ATTACH)的参数
+*/
+type bpfProgAttachAttr struct {
+	targetFd     uint32
+	attachBpfFd  uint32
+	attachType   uint32
+	attachFlags  uint32
+	replaceBpfFd uint32
+}
+
+/*
+deviceFilter 把设备白名单编译为BPF_PROG_TYPE_CGROUP_DEVICE程序，匹配任意规则返回1(允许)，否则返回0(拒绝)
+上下文为struct bpf_cgroup_dev_ctx { u32 access_type; u32 major; u32 minor; }，access_type低16位为设备类型，高16位为访问类型
+寄存器: r2设备类型，r3访问类型，r4主设备号，r5次设备号
+*/
+func deviceFilter(rules []DeviceRule) ([]bpfInsn, error) {
+	program := []bpfInsn{
+		{code: bpfLdxMemW, dst: 2, src: 1, off: 0},
+		{code: bpfAndImm, dst: 2, imm: 0xffff},
+		{code: bpfLdxMemW, dst: 3, src: 1, off: 0},
+		{code: bpfRshImm, dst: 3, imm: 16},
+		{code: bpfLdxMemW, dst: 4, src: 1, off: 4},
+		{code: bpfLdxMemW, dst: 5, src: 1, off: 8},
+	}
+	for _, rule := range rules {
+		block, err := deviceRuleBlock(rule)
+		if err != nil {
+			return nil, err
+		}
+		program = append(program, block...)
+	}
+	program = append(program,
+		bpfInsn{code: bpfMovImm, dst: 0, imm: 0},
+		bpfInsn{code: bpfExit},
+	)
+	return program, nil
+}
+
+/*
+deviceRuleBlock 一条规则对应的指令，任一条件不满足时跳到下一条规则
+*/
+func deviceRuleBlock(rule DeviceRule) ([]bpfInsn, error) {
+	var block []bpfInsn
+	switch rule.Type {
+	case DeviceTypeAll:
+	case DeviceTypeChar:
+		block = append(block, bpfInsn{code: bpfJneImm, dst: 2, imm: unix.BPF_DEVCG_DEV_CHAR})
+	case DeviceTypeBlock:
+		block = append(block, bpfInsn{code: bpfJneImm, dst: 2, imm: unix.BPF_DEVCG_DEV_BLOCK})
+	default:
+		return nil, fmt.Errorf("invalid device type: %c", rule.Type)
+	}
+	var access int32
+	for _, c := range rule.Permissions {
+		switch c {
+		case 'r':
+			access |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			access |= unix.BPF_DEVCG_ACC_WRITE
+		case 'm':
+			access |= unix.BPF_DEVCG_ACC_MKNOD
+		default:
+			return nil, fmt.Errorf("invalid device permissions: %s", rule.Permissions)
+		}
+	}
+	// 请求的访问类型必须是允许的访问类型的子集: (r3 & access) == r3
+	if access != unix.BPF_DEVCG_ACC_READ|unix.BPF_DEVCG_ACC_WRITE|unix.BPF_DEVCG_ACC_MKNOD {
+		block = append(block,
+			bpfInsn{code: bpfMovReg, dst: 1, src: 3},
+			bpfInsn{code: bpfAndImm, dst: 1, imm: access},
+			bpfInsn{code: bpfJneReg, dst: 1, src: 3},
+		)
+	}
+	if rule.Type != DeviceTypeAll {
+		if rule.Major != Wildcard {
+			if rule.Major < 0 || rule.Major > math.MaxUint32 {
+				return nil, fmt.Errorf("invalid device major: %d", rule.Major)
+			}
+			block = append(block, bpfInsn{code: bpfJneImm, dst: 4, imm: int32(uint32(rule.Major))})
+		}
+		if rule.Minor != Wildcard {
+			if rule.Minor < 0 || rule.Minor > math.MaxUint32 {
+				return nil, fmt.Errorf("invalid device minor: %d", rule.Minor)
+			}
+			block = append(block, bpfInsn{code: bpfJneImm, dst: 5, imm: int32(uint32(rule.Minor))})
+		}
+	}
+	block = append(block,
+		bpfInsn{code: bpfMovImm, dst: 0, imm: 1},
+		bpfInsn{code: bpfExit},
+	)
+	// 条件跳转的目标为本规则之后的第一条指令
+	for i := range block {
+		if block[i].code == bpfJneImm || block[i].code == bpfJneReg {
+			block[i].off = int16(len(block) - i - 1)
+		}
+	}
+	return block, nil
+}
+
+/*
+encodeInsns 按内核struct bpf_insn的布局编码，寄存器各占4位(小端序下dst在低位)
+*/
+func encodeInsns(insns []bpfInsn) []byte {
+	buf := make([]byte, len(insns)*bpfInsnSize)
+	for i, insn := range insns {
+		b := buf[i*bpfInsnSize:]
+		b[0] = insn.code
+		b[1] = insn.dst&0x0f | insn.src<<4
+		binary.LittleEndian.PutUint16(b[2:], uint16(insn.off))
+		binary.LittleEndian.PutUint32(b[4:], uint32(insn.imm))
+	}
+	return buf
+}
+
+/*
+attachDeviceFilter 加载设备过滤程序并挂到cgroup目录上，程序的生命周期由cgroup维持
+*/
+func attachDeviceFilter(cgroupDir string, rules []DeviceRule) error {
+	insns, err := deviceFilter(rules)
+	if err != nil {
+		return fmt.Errorf("deviceFilter err: %v", err)
+	}
+	code := encodeInsns(insns)
+	license := []byte(bpfLicense + "\x00")
+	logBuf := make([]byte, 64*1024)
+	loadAttr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	progFd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&loadAttr)), unsafe.Sizeof(loadAttr))
+	if errno != 0 {
+		verifierLog := strings.TrimRight(string(logBuf), "\x00")
+		return fmt.Errorf("bpf BPF_PROG_LOAD err: %v, verifier log: %s", errno, verifierLog)
+	}
+	defer func() {
+		_ = unix.Close(int(progFd))
+	}()
+	dirFd, err := unix.Open(cgroupDir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unix.Open err: %v", err)
+	}
+	defer func() {
+		_ = unix.Close(dirFd)
+	}()
+	attachAttr := bpfProgAttachAttr{
+		targetFd:    uint32(dirFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, errno = unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attachAttr)), unsafe.Sizeof(attachAttr)); errno != 0 {
+		return fmt.Errorf("bpf BPF_PROG_ATTACH err: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package cgroups
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+runDeviceFilter 解释执行设备过滤程序，只支持deviceFilter生成的指令，返回r0
+*/
+func runDeviceFilter(t *testing.T, program []bpfInsn, devType uint32, access uint32, major uint32, minor uint32) uint64 {
+	ctx := [3]uint32{devType | access<<16, major, minor}
+	var regs [11]uint64
+	for pc := 0; pc < len(program); pc++ {
+		insn := program[pc]
+		switch insn.code {
+		case bpfLdxMemW:
+			if insn.src != 1 || insn.off%4 != 0 || insn.off < 0 || insn.off > 8 {
+				t.Fatalf("invalid context access at %d", pc)
+			}
+			regs[insn.dst] = uint64(ctx[insn.off/4])
+		case bpfAndImm:
+			regs[insn.dst] &= uint64(int64(insn.imm))
+		case bpfRshImm:
+			regs[insn.dst] >>= uint64(insn.imm)
+		case bpfMovImm:
+			regs[insn.dst] = uint64(int64(insn.imm))
+		case bpfMovReg:
+			regs[insn.dst] = regs[insn.src]
+		case bpfJneImm:
+			if regs[insn.dst] != uint64(int64(insn.imm)) {
+				pc += int(insn.off)
+			}
+		case bpfJneReg:
+			if regs[insn.dst] != regs[insn.src] {
+				pc += int(insn.off)
+			}
+		case bpfExit:
+			return regs[0]
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", insn.code, pc)
+		}
+	}
+	t.Fatalf("program fell off the end")
+	return 0
+}
+
+func TestDeviceFilter(t *testing.T) {
+	const (
+		char  = unix.BPF_DEVCG_DEV_CHAR
+		block = unix.BPF_DEVCG_DEV_BLOCK
+		r     = unix.BPF_DEVCG_ACC_READ
+		w     = unix.BPF_DEVCG_ACC_WRITE
+		m     = unix.BPF_DEVCG_ACC_MKNOD
+	)
+	program, err := deviceFilter(DefaultDeviceRules)
+	if err != nil {
+		t.Fatalf("deviceFilter err: %v", err)
+	}
+	tests := []struct {
+		name         string
+		devType      uint32
+		access       uint32
+		major, minor uint32
+		allow        bool
+	}{
+		{"read /dev/null", char, r, 1, 3, true},
+		{"write /dev/null", char, r | w, 1, 3, true},
+		{"read /dev/pts/5", char, r | w, 136, 5, true},
+		{"mknod any char", char, m, 4, 64, true},
+		{"mknod any block", block, m, 8, 0, true},
+		{"read /dev/sda", block, r, 8, 0, false},
+		{"read /dev/mem", char, r, 1, 1, false},
+		{"read and mknod /dev/tty0", char, r | m, 4, 0, false},
+		{"read block 1:3", block, r, 1, 3, false},
+	}
+	for _, tt := range tests {
+		got := runDeviceFilter(t, program, tt.devType, tt.access, tt.major, tt.minor) == 1
+		if got != tt.allow {
+			t.Errorf("%s: allow = %v, want %v", tt.name, got, tt.allow)
+		}
+	}
+
+	program, err = deviceFilter([]DeviceRule{{Type: DeviceTypeAll, Permissions: "rwm"}})
+	if err != nil {
+		t.Fatalf("deviceFilter err: %v", err)
+	}
+	if runDeviceFilter(t, program, block, r|w|m, 8, 0) != 1 {
+		t.Errorf("allow all rule denied block 8:0")
+	}
+
+	program, err = deviceFilter([]DeviceRule{{Type: DeviceTypeChar, Major: 1, Minor: Wildcard, Permissions: "r"}})
+	if err != nil {
+		t.Fatalf("deviceFilter err: %v", err)
+	}
+	if runDeviceFilter(t, program, char, r, 1, 9) != 1 {
+		t.Errorf("read-only rule denied read")
+	}
+	if runDeviceFilter(t, program, char, w, 1, 9) != 0 {
+		t.Errorf("read-only rule allowed write")
+	}
+}
+
+func TestDeviceFilterInvalid(t *testing.T) {
+	rules := []DeviceRule{
+		{Type: 'x', Permissions: "r"},
+		{Type: DeviceTypeChar, Major: 1, Minor: 3, Permissions: "rx"},
+		{Type: DeviceTypeChar, Major: -2, Minor: 3, Permissions: "r"},
+	}
+	for _, rule := range rules {
+		if _, err := deviceFilter([]DeviceRule{rule}); err == nil {
+			t.Errorf("rule %+v accepted", rule)
+		}
+	}
+}
+
+func TestEncodeInsns(t *testing.T) {
+	buf := encodeInsns([]bpfInsn{{code: bpfLdxMemW, dst: 2, src: 1, off: -4, imm: -1}})
+	want := []byte{bpfLdxMemW, 0x12, 0xfc, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if string(buf) != string(want) {
+		t.Errorf("encodeInsns = % x, want % x", buf, want)
+	}
+}
@@ -1,83 +1,117 @@
 package cgroups
 
 import (
-	"os"
-	"path"
-	"strconv"
-	"syscall"
+	"fmt"
+	"strings"
 )
 
 /*
-ResourceConfig 用于传递资源限制配置的结构体，包含内存限制，CPU时间片权重，CPU核心数
+ResourceConfig 用于传递资源限制配置的结构体，包含内存限制，CPU时间片权重，CPU核心数，设备白名单
+v1与v2语义一致: MemoryLimit支持k/m/g后缀及max，CpuShare为cgroup v2的cpu.weight取值(1-10000)
+Devices为空时不限制设备访问，否则只允许白名单中的设备
 */
 type ResourceConfig struct {
 	MemoryLimit string
 	CpuShare    string
 	CpuSet      string
+	Devices     []DeviceRule
 }
 
+/*
+IsEmpty 是否没有任何资源限制
+*/
+func (r *ResourceConfig) IsEmpty() bool {
+	return r.MemoryLimit == "" && r.CpuShare == "" && r.CpuSet == "" && len(r.Devices) == 0
+}
+
+/*
+Stats cgroup资源使用统计
+*/
+type Stats struct {
+	MemoryUsage uint64 `json:"memoryUsage"` // 内存使用量(bytes)
+	MemoryLimit uint64 `json:"memoryLimit"` // 内存限制(bytes)，0表示不限制
+	CpuUsage    uint64 `json:"cpuUsage"`    // cpu累计使用时间(微秒)
+	Pids        uint64 `json:"pids"`        // 当前进程数
+}
+
+/*
+MemoryEvents 内存事件计数与PSI内存压力
+*/
+type MemoryEvents struct {
+	Oom          uint64  `json:"oom"`          // 达到内存上限触发oom的次数，cgroup v1没有这个计数
+	OomKill      uint64  `json:"oomKill"`      // 因oom被杀死的进程数
+	PressureSome float64 `json:"pressureSome"` // 最近10秒内至少一个进程因内存阻塞的时间占比(%)
+	PressureFull float64 `json:"pressureFull"` // 最近10秒内所有进程因内存阻塞的时间占比(%)
+}
+
+/*
+FreezerState cgroup冻结状态
+*/
+type FreezerState string
+
 const (
-	// 资源配置文件
-	memoryLimitFile = "memory.max"
-	cpuShareFile    = "cpu.weight"
-	cpuSetFile      = "cpuset.cpus"
-	// 进程pid配置文件
-	cgroupProcsFile = "cgroup.procs"
+	Frozen FreezerState = "FROZEN"
+	Thawed FreezerState = "THAWED"
 )
 
 /*
-Create 创建cgroup 这里将cgroup抽象成了path，原因是cgroup在hierarchy的路径，便是虚拟文件系统中的虚拟路径
+Manager cgroup管理器，屏蔽cgroup v1与v2在文件布局上的差异
 */
-func Create(pid int) (string, error) {
-	cgroups2MountPath, err := findCgroups2MountPath()
-	if err != nil {
-		return "", err
-	}
-	cgroup2Path := getCgroupPath(cgroups2MountPath, pid)
-	return cgroup2Path, os.Mkdir(cgroup2Path, 0755)
+type Manager interface {
+	// Path cgroup相对于hierarchy根目录的路径
+	Path() string
+	// Create 创建cgroup
+	Create() error
+	// Set 设置cgroup对于资源的限制
+	Set(res *ResourceConfig) error
+	// Apply 将进程加入到cgroup中
+	Apply(pid int) error
+	// Stats 获取cgroup资源使用统计
+	Stats() (*Stats, error)
+	// MemoryEvents 获取oom事件计数和内存压力
+	MemoryEvents() (*MemoryEvents, error)
+	// NotifyMemoryEvents 发生oom等内存事件时向返回的channel发送通知，done关闭后停止监听并关闭channel
+	NotifyMemoryEvents(done <-chan struct{}) (<-chan struct{}, error)
+	// Freeze 冻结或解冻cgroup中的所有进程
+	Freeze(state FreezerState) error
+	// Destroy 删除cgroup
+	Destroy() error
 }
 
 /*
-Set 设置cgroup对于资源的限制
+NewManager 根据/proc/self/mountinfo自动选择cgroup v1或v2的管理器
+cgroupPath 为cgroup相对于hierarchy根目录的路径
 */
-func Set(cgroup2Path string, res *ResourceConfig) error {
-	if res.MemoryLimit != "" {
-		// 对此cgroup设置内存限制
-		configFile := path.Join(cgroup2Path, memoryLimitFile)
-		content := []byte(res.MemoryLimit)
-		if err := writeResourceConfigFile(configFile, content); err != nil {
-			return err
-		}
+func NewManager(cgroupPath string) (Manager, error) {
+	mounts, err := parseMountInfo()
+	if err != nil {
+		return nil, fmt.Errorf("parseMountInfo err: %v", err)
 	}
-	if res.CpuShare != "" {
-		// 对此cgroup设置cpu时间片权重
-		configFile := path.Join(cgroup2Path, cpuShareFile)
-		content := []byte(res.CpuShare)
-		if err := writeResourceConfigFile(configFile, content); err != nil {
-			return err
-		}
+	// 混合模式下cgroup v2的hierarchy不挂载任何控制器，资源限制仍然走v1
+	if subsystems := findCgroupV1Mounts(mounts); len(subsystems) > 0 {
+		return newV1Manager(subsystems, cgroupPath), nil
 	}
-	if res.CpuSet != "" {
-		// 对此cgroup设置cpu核心数
-		configFile := path.Join(cgroup2Path, cpuSetFile)
-		content := []byte(res.CpuSet)
-		if err := writeResourceConfigFile(configFile, content); err != nil {
-			return err
+	if mountPath, ok := findCgroupV2Mount(mounts); ok {
+		// 之前的容器信息中保存的是挂载路径下的绝对路径
+		if strings.HasPrefix(cgroupPath, mountPath+"/") {
+			cgroupPath = strings.TrimPrefix(cgroupPath, mountPath+"/")
 		}
+		return newV2Manager(mountPath, cgroupPath), nil
 	}
-	return nil
+	return nil, fmt.Errorf("no cgroup mount found")
 }
 
 /*
-Clear 删除cgroup便是删除对应的cgroupPath目录
+IsUnified 宿主机是否为纯cgroup v2(unified)模式
 */
-func Clear(cgroup2Path string) error {
-	return syscall.Rmdir(cgroup2Path)
-}
-
-/*
-Apply 将进程加入到cgroupPath对应的cgroup中
-*/
-func Apply(cgroup2Path string, pid int) error {
-	return os.WriteFile(path.Join(cgroup2Path, cgroupProcsFile), []byte(strconv.Itoa(pid)), 0644)
+func IsUnified() (bool, error) {
+	mounts, err := parseMountInfo()
+	if err != nil {
+		return false, fmt.Errorf("parseMountInfo err: %v", err)
+	}
+	if len(findCgroupV1Mounts(mounts)) > 0 {
+		return false, nil
+	}
+	_, ok := findCgroupV2Mount(mounts)
+	return ok, nil
 }
@@ -2,16 +2,38 @@ package cgroups
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 	"strings"
-	"time"
 
 	"mydocker/app"
 )
 
+const (
+	cgroupV1FsType = "cgroup"
+	cgroupV2FsType = "cgroup2"
+	// DefaultCgroupParent 默认的cgroup parent，避免与systemd管理的system.slice冲突
+	DefaultCgroupParent = app.Name
+)
+
+/*
+mountInfo /proc/self/mountinfo中的一行
+*/
+type mountInfo struct {
+	Mountpoint   string
+	FsType       string
+	SuperOptions string
+}
+
+/*
+errControllerUnsupported 设置了资源限制但cgroup中没有对应的控制器
+*/
+func errControllerUnsupported(controller string, cgroupPath string) error {
+	return fmt.Errorf("%s controller is not available in cgroup %s", controller, cgroupPath)
+}
+
 /*
 将资源配置写入文件
 */
@@ -20,31 +42,205 @@ func writeResourceConfigFile(configFile string, content []byte) error {
 }
 
 /*
-查找Cgroup2挂载路径
+读取只有一个无符号整数的cgroup文件，max表示不限制返回0
+*/
+func readUintFile(file string) (uint64, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(content))
+	if s == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+/*
+读取key value格式的cgroup文件，如cpu.stat、memory.events
+*/
+func readKeyValueFile(file string) (map[string]uint64, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kv := make(map[string]uint64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		kv[fields[0]] = v
+	}
+	return kv, nil
+}
+
+/*
+读取PSI文件中some、full两行的avg10
+格式: some avg10=0.00 avg60=0.00 avg300=0.00 total=0
 */
-func findCgroups2MountPath() (string, error) {
+func readPressureFile(file string) (map[string]float64, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pressure := make(map[string]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if v, found := strings.CutPrefix(field, "avg10="); found {
+				if avg, err := strconv.ParseFloat(v, 64); err == nil {
+					pressure[fields[0]] = avg
+				}
+			}
+		}
+	}
+	return pressure, nil
+}
+
+/*
+解析/proc/self/mountinfo
+格式: id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+*/
+func parseMountInfo() ([]mountInfo, error) {
 	file, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer func() {
 		_ = file.Close()
 	}()
+	mounts := make([]mountInfo, 0)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), " ")
-		for _, field := range fields {
-			if field == "cgroup2" {
-				return path.Join(fields[4], "system.slice"), nil
+		pre, post, found := strings.Cut(scanner.Text(), " - ")
+		if !found {
+			continue
+		}
+		preFields := strings.Fields(pre)
+		postFields := strings.Fields(post)
+		if len(preFields) < 5 || len(postFields) < 3 {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			Mountpoint:   preFields[4],
+			FsType:       postFields[0],
+			SuperOptions: postFields[2],
+		})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+/*
+查找cgroup v1各个子系统的挂载路径，key为子系统名称
+*/
+func findCgroupV1Mounts(mounts []mountInfo) map[string]string {
+	subsystems := make(map[string]string)
+	for _, m := range mounts {
+		if m.FsType != cgroupV1FsType {
+			continue
+		}
+		for _, opt := range strings.Split(m.SuperOptions, ",") {
+			for _, subsystem := range v1Subsystems {
+				if opt == subsystem {
+					subsystems[subsystem] = m.Mountpoint
+				}
+			}
+		}
+	}
+	return subsystems
+}
+
+/*
+查找Cgroup2挂载路径
+*/
+func findCgroupV2Mount(mounts []mountInfo) (string, bool) {
+	for _, m := range mounts {
+		if m.FsType == cgroupV2FsType {
+			return m.Mountpoint, true
+		}
+	}
+	return "", false
+}
+
+/*
+NewCgroupPath 获取目标cgroupPath(相对于hierarchy根目录)，即<cgroupParent>/<容器id>
+cgroupParent为空时使用DefaultCgroupParent，同一个parent下的容器共享parent的资源限制
+*/
+func NewCgroupPath(cgroupParent string, containerId string) (string, error) {
+	if cgroupParent == "" {
+		cgroupParent = DefaultCgroupParent
+	}
+	for _, elem := range strings.Split(cgroupParent, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid cgroup parent: %s", cgroupParent)
+		}
+	}
+	return strings.TrimPrefix(path.Join("/", cgroupParent, containerId), "/"), nil
+}
+
+/*
+RootlessCgroupParent 非root用户只能使用systemd委派给用户的cgroup(user@<uid>.service)
+从/proc/self/cgroup中找到当前进程所属的委派cgroup，找不到返回空字符串
+*/
+func RootlessCgroupParent() string {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	delegated := fmt.Sprintf("user@%d.service", os.Geteuid())
+	for _, line := range strings.Split(string(content), "\n") {
+		// cgroup v2的格式为 0::/user.slice/user-1000.slice/user@1000.service/...
+		cgroupPath, found := strings.CutPrefix(line, "0::")
+		if !found {
+			continue
+		}
+		elems := strings.Split(strings.Trim(cgroupPath, "/"), "/")
+		for i, elem := range elems {
+			if elem == delegated {
+				return path.Join(path.Join(elems[:i+1]...), app.Name)
 			}
 		}
 	}
-	return "", errors.New("no cgroup2 mount found")
+	return ""
 }
 
 /*
-获取目标cgroupPath
+watchFd 每次f可读时向返回的channel发送通知，done关闭后关闭f和extra(需要与f一起保持打开的文件)
+f必须是非阻塞的，这样关闭时可以中断阻塞的读取
 */
-func getCgroupPath(cgroupMountPath string, pid int) string {
-	return path.Join(cgroupMountPath, fmt.Sprintf("%s-%s-%d", app.Name, time.Now().Format("20060102150405"), pid))
+func watchFd(f *os.File, extra *os.File, done <-chan struct{}) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		<-done
+		_ = f.Close()
+		if extra != nil {
+			_ = extra.Close()
+		}
+	}()
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 4096)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			// 还没有处理的通知只保留一个
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
 }
@@ -0,0 +1,325 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cgroup v1 子系统
+	memorySubsystem  = "memory"
+	cpuSubsystem     = "cpu"
+	cpuacctSubsystem = "cpuacct"
+	cpusetSubsystem  = "cpuset"
+	freezerSubsystem = "freezer"
+	pidsSubsystem    = "pids"
+	devicesSubsystem = "devices"
+	// 资源配置文件
+	v1MemoryLimitFile = "memory.limit_in_bytes"
+	v1CpuShareFile    = "cpu.shares"
+	v1CpuSetFile      = "cpuset.cpus"
+	v1CpuSetMemsFile  = "cpuset.mems"
+	v1DevicesDeny     = "devices.deny"
+	v1DevicesAllow    = "devices.allow"
+	// 统计文件
+	v1MemoryUsageFile = "memory.usage_in_bytes"
+	v1CpuacctUsage    = "cpuacct.usage"
+	v1FreezerState    = "freezer.state"
+	v1MemoryOomFile   = "memory.oom_control"
+	// 注册eventfd通知
+	v1EventControlFile = "cgroup.event_control"
+	// 超过该值认为没有内存限制(内核用PAGE_COUNTER_MAX表示无限制)
+	v1MemoryUnlimited = 1 << 62
+)
+
+var v1Subsystems = []string{memorySubsystem, cpuSubsystem, cpuacctSubsystem, cpusetSubsystem, freezerSubsystem, pidsSubsystem, devicesSubsystem}
+
+/*
+v1Manager cgroup v1管理器，每个子系统是一棵独立的hierarchy
+*/
+type v1Manager struct {
+	subsystems map[string]string // 子系统 -> 挂载路径
+	cgroupPath string            // 相对路径
+}
+
+func newV1Manager(subsystems map[string]string, cgroupPath string) *v1Manager {
+	return &v1Manager{subsystems: subsystems, cgroupPath: cgroupPath}
+}
+
+/*
+子系统下的cgroup目录，子系统未挂载返回空字符串
+*/
+func (m *v1Manager) dir(subsystem string) string {
+	mountPath, ok := m.subsystems[subsystem]
+	if !ok {
+		return ""
+	}
+	return path.Join(mountPath, m.cgroupPath)
+}
+
+/*
+所有已挂载子系统的cgroup目录，cpu,cpuacct共同挂载时只返回一次
+*/
+func (m *v1Manager) dirs() []string {
+	seen := make(map[string]bool)
+	dirs := make([]string, 0, len(m.subsystems))
+	for _, subsystem := range v1Subsystems {
+		dir := m.dir(subsystem)
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func (m *v1Manager) Path() string {
+	return m.cgroupPath
+}
+
+/*
+Create 在每个子系统的hierarchy中创建cgroup
+*/
+func (m *v1Manager) Create() error {
+	for _, dir := range m.dirs() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+	}
+	// 新建的cpuset cgroup中cpus和mems为空，不能加入进程，需要从上级继承
+	if dir := m.dir(cpusetSubsystem); dir != "" {
+		if err := initCpuset(m.subsystems[cpusetSubsystem], dir); err != nil {
+			return fmt.Errorf("initCpuset err: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Set 设置cgroup对于资源的限制，CpuShare按cpu.weight语义换算为cpu.shares，设备白名单写入devices子系统
+*/
+func (m *v1Manager) Set(res *ResourceConfig) error {
+	// 设置了限制但子系统没有挂载时报错，与v2中控制器没有委派时一致
+	for _, c := range []struct {
+		subsystem string
+		set       bool
+	}{{memorySubsystem, res.MemoryLimit != ""}, {cpuSubsystem, res.CpuShare != ""}, {cpusetSubsystem, res.CpuSet != ""}, {devicesSubsystem, len(res.Devices) > 0}} {
+		if c.set && m.dir(c.subsystem) == "" {
+			return errControllerUnsupported(c.subsystem, m.cgroupPath)
+		}
+	}
+	if res.MemoryLimit != "" {
+		limit := res.MemoryLimit
+		if limit == "max" {
+			limit = "-1"
+		}
+		if err := writeResourceConfigFile(path.Join(m.dir(memorySubsystem), v1MemoryLimitFile), []byte(limit)); err != nil {
+			return err
+		}
+	}
+	if res.CpuShare != "" {
+		weight, err := strconv.ParseUint(res.CpuShare, 10, 64)
+		if err != nil {
+			return fmt.Errorf("strconv.ParseUint err: %v", err)
+		}
+		shares := weightToShares(weight)
+		if err = writeResourceConfigFile(path.Join(m.dir(cpuSubsystem), v1CpuShareFile), []byte(strconv.FormatUint(shares, 10))); err != nil {
+			return err
+		}
+	}
+	if res.CpuSet != "" {
+		if err := writeResourceConfigFile(path.Join(m.dir(cpusetSubsystem), v1CpuSetFile), []byte(res.CpuSet)); err != nil {
+			return err
+		}
+	}
+	if len(res.Devices) > 0 {
+		dir := m.dir(devicesSubsystem)
+		// 先拒绝所有设备，再逐条加入白名单
+		if err := writeResourceConfigFile(path.Join(dir, v1DevicesDeny), []byte("a")); err != nil {
+			return err
+		}
+		for _, rule := range res.Devices {
+			if err := writeResourceConfigFile(path.Join(dir, v1DevicesAllow), []byte(rule.String())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Apply 将进程加入到每个子系统的cgroup中
+*/
+func (m *v1Manager) Apply(pid int) error {
+	for _, dir := range m.dirs() {
+		if err := os.WriteFile(path.Join(dir, cgroupProcsFile), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Stats 读取memory、cpuacct、pids子系统的统计
+*/
+func (m *v1Manager) Stats() (*Stats, error) {
+	stats := &Stats{}
+	var err error
+	if dir := m.dir(memorySubsystem); dir != "" {
+		if stats.MemoryUsage, err = readUintFile(path.Join(dir, v1MemoryUsageFile)); err != nil {
+			return nil, fmt.Errorf("readUintFile err: %v", err)
+		}
+		if stats.MemoryLimit, err = readUintFile(path.Join(dir, v1MemoryLimitFile)); err != nil {
+			return nil, fmt.Errorf("readUintFile err: %v", err)
+		}
+		if stats.MemoryLimit >= v1MemoryUnlimited {
+			stats.MemoryLimit = 0
+		}
+	}
+	if dir := m.dir(cpuacctSubsystem); dir != "" {
+		usage, err := readUintFile(path.Join(dir, v1CpuacctUsage))
+		if err != nil {
+			return nil, fmt.Errorf("readUintFile err: %v", err)
+		}
+		stats.CpuUsage = usage / 1000 // 纳秒转微秒
+	}
+	if dir := m.dir(pidsSubsystem); dir != "" {
+		if stats.Pids, err = readUintFile(path.Join(dir, pidsCurrentFile)); err != nil {
+			return nil, fmt.Errorf("readUintFile err: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+/*
+MemoryEvents 读取memory.oom_control中的oom_kill计数
+v1没有oom计数(under_oom只表示当前是否处于oom状态)，也没有cgroup级别的PSI
+*/
+func (m *v1Manager) MemoryEvents() (*MemoryEvents, error) {
+	dir := m.dir(memorySubsystem)
+	if dir == "" {
+		return nil, fmt.Errorf("memory subsystem not mounted")
+	}
+	kv, err := readKeyValueFile(path.Join(dir, v1MemoryOomFile))
+	if err != nil {
+		return nil, fmt.Errorf("readKeyValueFile err: %v", err)
+	}
+	return &MemoryEvents{OomKill: kv["oom_kill"]}, nil
+}
+
+/*
+NotifyMemoryEvents 通过cgroup.event_control注册memory.oom_control的eventfd通知，
+cgroup中发生oom或者cgroup被删除时eventfd可读
+*/
+func (m *v1Manager) NotifyMemoryEvents(done <-chan struct{}) (<-chan struct{}, error) {
+	dir := m.dir(memorySubsystem)
+	if dir == "" {
+		return nil, fmt.Errorf("memory subsystem not mounted")
+	}
+	oomControl, err := os.Open(path.Join(dir, v1MemoryOomFile))
+	if err != nil {
+		return nil, fmt.Errorf("os.Open err: %v", err)
+	}
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = oomControl.Close()
+		return nil, fmt.Errorf("unix.Eventfd err: %v", err)
+	}
+	// 格式为"<eventfd> <memory.oom_control的fd>"
+	content := fmt.Sprintf("%d %d", efd, oomControl.Fd())
+	if err = os.WriteFile(path.Join(dir, v1EventControlFile), []byte(content), 0200); err != nil {
+		_ = unix.Close(efd)
+		_ = oomControl.Close()
+		return nil, fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	return watchFd(os.NewFile(uintptr(efd), "eventfd"), oomControl, done), nil
+}
+
+/*
+Freeze 写freezer.state，并等待状态生效(FREEZING -> FROZEN)
+*/
+func (m *v1Manager) Freeze(state FreezerState) error {
+	dir := m.dir(freezerSubsystem)
+	if dir == "" {
+		return fmt.Errorf("freezer subsystem not mounted")
+	}
+	file := path.Join(dir, v1FreezerState)
+	for i := 0; i < 100; i++ {
+		if err := os.WriteFile(file, []byte(state), 0644); err != nil {
+			return fmt.Errorf("os.WriteFile err: %v", err)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile err: %v", err)
+		}
+		if strings.TrimSpace(string(content)) == string(state) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("wait cgroup %s timeout", state)
+}
+
+/*
+Destroy 删除每个子系统下的cgroup目录
+*/
+func (m *v1Manager) Destroy() error {
+	for _, dir := range m.dirs() {
+		if err := syscall.Rmdir(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+从hierarchy根目录开始逐级把空的cpuset.cpus、cpuset.mems设置为上级的值
+*/
+func initCpuset(mountPath string, dir string) error {
+	rel := strings.TrimPrefix(dir, mountPath)
+	current := mountPath
+	for _, elem := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		parent := current
+		current = path.Join(current, elem)
+		for _, file := range []string{v1CpuSetFile, v1CpuSetMemsFile} {
+			content, err := os.ReadFile(path.Join(current, file))
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(string(content)) != "" {
+				continue
+			}
+			if content, err = os.ReadFile(path.Join(parent, file)); err != nil {
+				return err
+			}
+			if err = os.WriteFile(path.Join(current, file), content, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+cpu.weight(1-10000)换算为cpu.shares(2-262144)，与runc的换算方式互逆
+*/
+func weightToShares(weight uint64) uint64 {
+	if weight < 1 {
+		weight = 1
+	}
+	if weight > 10000 {
+		weight = 10000
+	}
+	return 2 + ((weight-1)*262142)/9999
+}
@@ -0,0 +1,263 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 资源配置文件
+	memoryLimitFile = "memory.max"
+	cpuShareFile    = "cpu.weight"
+	cpuSetFile      = "cpuset.cpus"
+	// 统计文件
+	memoryCurrentFile = "memory.current"
+	cpuStatFile       = "cpu.stat"
+	pidsCurrentFile   = "pids.current"
+	// 内存事件
+	memoryEventsFile   = "memory.events"
+	memoryPressureFile = "memory.pressure"
+	// 冻结
+	cgroupFreezeFile = "cgroup.freeze"
+	cgroupEventsFile = "cgroup.events"
+	// 控制器委派
+	cgroupControllersFile    = "cgroup.controllers"
+	cgroupSubtreeControlFile = "cgroup.subtree_control"
+	// 进程pid配置文件
+	cgroupProcsFile = "cgroup.procs"
+)
+
+// 需要委派给容器cgroup的控制器
+var v2Controllers = []string{"cpu", "cpuset", "memory", "io", "pids"}
+
+/*
+v2Manager cgroup v2(unified hierarchy)管理器，所有控制器都在同一个目录下
+*/
+type v2Manager struct {
+	mountPath  string // cgroup2挂载路径
+	cgroupPath string // 相对路径
+}
+
+func newV2Manager(mountPath string, cgroupPath string) *v2Manager {
+	return &v2Manager{mountPath: mountPath, cgroupPath: cgroupPath}
+}
+
+func (m *v2Manager) dir() string {
+	return path.Join(m.mountPath, m.cgroupPath)
+}
+
+func (m *v2Manager) Path() string {
+	return m.cgroupPath
+}
+
+/*
+Create 创建cgroup 这里将cgroup抽象成了path，原因是cgroup在hierarchy的路径，便是虚拟文件系统中的虚拟路径
+从hierarchy根目录开始逐级创建中间目录，并在可写的每一级的cgroup.subtree_control中开启控制器委派
+不可写的上级由系统(如systemd)管理，rootless时只有委派给用户的子树可写，上级没有委派的控制器视为不支持
+*/
+func (m *v2Manager) Create() error {
+	current := m.mountPath
+	for _, elem := range strings.Split(m.cgroupPath, "/") {
+		if elem == "" {
+			continue
+		}
+		if unix.Access(path.Join(current, cgroupSubtreeControlFile), unix.W_OK) == nil {
+			if err := delegateControllers(current); err != nil {
+				return fmt.Errorf("delegateControllers err: %v", err)
+			}
+		}
+		current = path.Join(current, elem)
+		if err := os.Mkdir(current, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("os.Mkdir err: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Set 设置cgroup对于资源的限制
+*/
+func (m *v2Manager) Set(res *ResourceConfig) error {
+	content, err := os.ReadFile(path.Join(m.dir(), cgroupControllersFile))
+	if err != nil {
+		return fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	// 没有委派给容器cgroup的控制器没有对应的配置文件
+	controllers := strings.Fields(string(content))
+	for _, c := range []struct {
+		controller string
+		value      string
+	}{{"memory", res.MemoryLimit}, {"cpu", res.CpuShare}, {"cpuset", res.CpuSet}} {
+		if c.value != "" && !containsString(controllers, c.controller) {
+			return errControllerUnsupported(c.controller, m.cgroupPath)
+		}
+	}
+	if res.MemoryLimit != "" {
+		// 对此cgroup设置内存限制
+		configFile := path.Join(m.dir(), memoryLimitFile)
+		if err := writeResourceConfigFile(configFile, []byte(res.MemoryLimit)); err != nil {
+			return err
+		}
+	}
+	if res.CpuShare != "" {
+		// 对此cgroup设置cpu时间片权重
+		configFile := path.Join(m.dir(), cpuShareFile)
+		if err := writeResourceConfigFile(configFile, []byte(res.CpuShare)); err != nil {
+			return err
+		}
+	}
+	if res.CpuSet != "" {
+		// 对此cgroup设置cpu核心数
+		configFile := path.Join(m.dir(), cpuSetFile)
+		if err := writeResourceConfigFile(configFile, []byte(res.CpuSet)); err != nil {
+			return err
+		}
+	}
+	if len(res.Devices) > 0 {
+		// cgroup v2没有devices控制器，通过挂载eBPF程序限制设备访问
+		if err := attachDeviceFilter(m.dir(), res.Devices); err != nil {
+			return fmt.Errorf("attachDeviceFilter err: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Apply 将进程加入到cgroupPath对应的cgroup中
+*/
+func (m *v2Manager) Apply(pid int) error {
+	return os.WriteFile(path.Join(m.dir(), cgroupProcsFile), []byte(strconv.Itoa(pid)), 0644)
+}
+
+/*
+Stats 读取memory.current、memory.max、cpu.stat、pids.current
+*/
+func (m *v2Manager) Stats() (*Stats, error) {
+	stats := &Stats{}
+	var err error
+	if stats.MemoryUsage, err = readUintFile(path.Join(m.dir(), memoryCurrentFile)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("readUintFile err: %v", err)
+	}
+	if stats.MemoryLimit, err = readUintFile(path.Join(m.dir(), memoryLimitFile)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("readUintFile err: %v", err)
+	}
+	if stats.Pids, err = readUintFile(path.Join(m.dir(), pidsCurrentFile)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("readUintFile err: %v", err)
+	}
+	cpuStat, err := readKeyValueFile(path.Join(m.dir(), cpuStatFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("readKeyValueFile err: %v", err)
+	}
+	stats.CpuUsage = cpuStat["usage_usec"]
+	return stats, nil
+}
+
+/*
+MemoryEvents 读取memory.events中的oom、oom_kill计数和memory.pressure中的avg10
+*/
+func (m *v2Manager) MemoryEvents() (*MemoryEvents, error) {
+	kv, err := readKeyValueFile(path.Join(m.dir(), memoryEventsFile))
+	if err != nil {
+		return nil, fmt.Errorf("readKeyValueFile err: %v", err)
+	}
+	events := &MemoryEvents{Oom: kv["oom"], OomKill: kv["oom_kill"]}
+	// 内核未开启PSI时没有memory.pressure文件
+	pressure, err := readPressureFile(path.Join(m.dir(), memoryPressureFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("readPressureFile err: %v", err)
+	}
+	events.PressureSome = pressure["some"]
+	events.PressureFull = pressure["full"]
+	return events, nil
+}
+
+/*
+NotifyMemoryEvents 用inotify监听memory.events，计数变化时内核会发出修改通知
+*/
+func (m *v2Manager) NotifyMemoryEvents(done <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("unix.InotifyInit1 err: %v", err)
+	}
+	if _, err = unix.InotifyAddWatch(fd, path.Join(m.dir(), memoryEventsFile), unix.IN_MODIFY); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("unix.InotifyAddWatch err: %v", err)
+	}
+	return watchFd(os.NewFile(uintptr(fd), "inotify"), nil, done), nil
+}
+
+/*
+Freeze 写cgroup.freeze，并等待cgroup.events中frozen状态生效
+*/
+func (m *v2Manager) Freeze(state FreezerState) error {
+	value, want := "0", "frozen 0"
+	if state == Frozen {
+		value, want = "1", "frozen 1"
+	}
+	if err := os.WriteFile(path.Join(m.dir(), cgroupFreezeFile), []byte(value), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		content, err := os.ReadFile(path.Join(m.dir(), cgroupEventsFile))
+		if err != nil {
+			return fmt.Errorf("os.ReadFile err: %v", err)
+		}
+		if strings.Contains(string(content), want) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("wait cgroup %s timeout", state)
+}
+
+/*
+Destroy 删除cgroup便是删除对应的cgroupPath目录
+*/
+func (m *v2Manager) Destroy() error {
+	if err := syscall.Rmdir(m.dir()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+在cgroup的subtree_control中开启该cgroup可用且需要的控制器，使子cgroup能够使用
+*/
+func delegateControllers(dir string) error {
+	content, err := os.ReadFile(path.Join(dir, cgroupControllersFile))
+	if err != nil {
+		return err
+	}
+	enabled, err := os.ReadFile(path.Join(dir, cgroupSubtreeControlFile))
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(string(content))
+	already := strings.Fields(string(enabled))
+	var controls []string
+	for _, controller := range v2Controllers {
+		if containsString(available, controller) && !containsString(already, controller) {
+			controls = append(controls, "+"+controller)
+		}
+	}
+	if len(controls) == 0 {
+		return nil
+	}
+	return os.WriteFile(path.Join(dir, cgroupSubtreeControlFile), []byte(strings.Join(controls, " ")), 0644)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
+	"mydocker/capabilities"
 	"mydocker/cgroups"
 	"mydocker/container"
+	"mydocker/image"
 )
 
 var (
@@ -35,6 +38,14 @@ var (
 				Name:  "name",
 				Usage: "container name",
 			},
+			cli.StringFlag{
+				Name:  "entrypoint",
+				Usage: "overwrite the default entrypoint of the image",
+			},
+			cli.StringFlag{
+				Name:  "workdir, w",
+				Usage: "working directory inside the container",
+			},
 			cli.StringFlag{
 				Name:  "net",
 				Usage: "net name",
@@ -55,6 +66,91 @@ var (
 				Name:  "cpuset",
 				Usage: "cpuset limit",
 			},
+			cli.StringFlag{
+				Name:  "cgroup-parent",
+				Usage: "parent cgroup for the container",
+			},
+			cli.StringFlag{
+				Name:  "userns-remap",
+				Usage: "map container root to the subordinate id range of user[:group]",
+			},
+			cli.StringSliceFlag{
+				Name:  "cap-add",
+				Usage: "add linux capabilities",
+			},
+			cli.StringSliceFlag{
+				Name:  "cap-drop",
+				Usage: "drop linux capabilities",
+			},
+			cli.BoolFlag{
+				Name:  "privileged",
+				Usage: "give extended privileges to this container",
+			},
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "username or uid (format: <name|uid>[:<group|gid>])",
+			},
+			cli.StringSliceFlag{
+				Name:  "group-add",
+				Usage: "add additional groups to join",
+			},
+			cli.StringSliceFlag{
+				Name:  "security-opt",
+				Usage: "security options, e.g. seccomp=profile.json, seccomp=unconfined or no-new-privileges=false",
+			},
+			cli.StringSliceFlag{
+				Name:  "device",
+				Usage: "add a host device to the container (format: <host>[:<container>][:<rwm>])",
+			},
+			cli.StringFlag{
+				Name:  "hostname",
+				Usage: "container host name",
+			},
+			cli.StringFlag{
+				Name:  "domainname",
+				Usage: "container NIS domain name",
+			},
+			cli.StringSliceFlag{
+				Name:  "add-host",
+				Usage: "add a custom host-to-IP mapping (format: <host>:<ip>)",
+			},
+			cli.StringSliceFlag{
+				Name:  "dns",
+				Usage: "set custom DNS servers",
+			},
+			cli.StringSliceFlag{
+				Name:  "dns-search",
+				Usage: "set custom DNS search domains",
+			},
+			cli.StringSliceFlag{
+				Name:  "dns-option",
+				Usage: "set DNS options",
+			},
+			cli.StringSliceFlag{
+				Name:  "tmpfs",
+				Usage: "mount a tmpfs directory (format: <path>[:<options>])",
+			},
+			cli.BoolFlag{
+				Name:  "read-only",
+				Usage: "mount the container's root filesystem as read only",
+			},
+			cli.StringSliceFlag{
+				Name:  "ulimit",
+				Usage: "ulimit options (format: <type>=<soft>[:<hard>])",
+			},
+			cli.StringSliceFlag{
+				Name:  "sysctl",
+				Usage: "namespaced kernel parameters (format: <key>=<value>)",
+			},
+			cli.StringFlag{
+				Name:  "shm-size",
+				Usage: "size of /dev/shm, e.g. 64m",
+			},
+			cli.StringFlag{
+				Name:  "cgroupns",
+				Value: container.CgroupNsPrivate,
+				Usage: "cgroup namespace mode: private or host",
+			},
 		},
 		/*
 			这里是run命令真正执行的函数
@@ -75,9 +171,6 @@ var (
 				}
 				comArray = append(comArray, arg)
 			}
-			if len(comArray) < 1 {
-				comArray = append(comArray, "sh") // 默认启动命令
-			}
 			it := ctx.Bool("it")
 			d := ctx.Bool("d")
 			if it && d {
@@ -94,7 +187,109 @@ var (
 				CpuShare:    ctx.String("cpushare"),
 				CpuSet:      ctx.String("cpuset"),
 			}
-			if err := Run(it, resourceConfig, volume, envs, networkName, portMappings, containerName, imageName, comArray); err != nil {
+			cgroupParent := ctx.String("cgroup-parent")
+			if cgroupParent == "" {
+				cgroupParent = ctx.GlobalString("cgroup-parent")
+			}
+			initConfig := &container.InitConfig{
+				Command:        comArray,
+				CgroupNs:       ctx.String("cgroupns"),
+				ReadonlyRootfs: ctx.Bool("read-only"),
+				WorkingDir:     ctx.String("workdir"),
+			}
+			// 指定--entrypoint时覆盖镜像的Entrypoint，值为空表示清除
+			var entrypoint []string
+			if ctx.IsSet("entrypoint") {
+				entrypoint = make([]string, 0, 1)
+				if e := ctx.String("entrypoint"); e != "" {
+					entrypoint = append(entrypoint, e)
+				}
+			}
+			if shmSize := ctx.String("shm-size"); shmSize != "" {
+				size, err := container.ParseSize(shmSize)
+				if err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+				initConfig.ShmSize = size
+			}
+			for _, spec := range ctx.StringSlice("device") {
+				device, err := container.ParseDevice(spec)
+				if err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+				initConfig.Devices = append(initConfig.Devices, device)
+			}
+			for _, spec := range ctx.StringSlice("tmpfs") {
+				tmpfs, err := container.ParseTmpfs(spec)
+				if err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+				initConfig.Tmpfs = append(initConfig.Tmpfs, tmpfs)
+			}
+			for _, spec := range ctx.StringSlice("ulimit") {
+				rlimit, err := container.ParseUlimit(spec)
+				if err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+				initConfig.Rlimits = append(initConfig.Rlimits, rlimit)
+			}
+			for _, spec := range ctx.StringSlice("sysctl") {
+				key, value, found := strings.Cut(spec, "=")
+				if !found {
+					log.Errorf("docker run err: invalid sysctl: %s", spec)
+					return
+				}
+				if err := container.ValidateSysctl(key); err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+				if initConfig.Sysctls == nil {
+					initConfig.Sysctls = make(map[string]string)
+				}
+				initConfig.Sysctls[key] = value
+			}
+			privileged := ctx.Bool("privileged")
+			caps, err := capabilities.NewSet(ctx.StringSlice("cap-add"), ctx.StringSlice("cap-drop"), privileged)
+			if err != nil {
+				log.Errorf("docker run err: %v", err)
+				return
+			}
+			initConfig.Security = container.SecurityConfig{
+				Privileged:   privileged,
+				Capabilities: caps,
+				User:         ctx.String("user"),
+				GroupAdd:     ctx.StringSlice("group-add"),
+			}
+			if err := container.ParseSecurityOpts(ctx.StringSlice("security-opt"), &initConfig.Security); err != nil {
+				log.Errorf("docker run err: %v", err)
+				return
+			}
+			etcConfig := &container.EtcConfig{
+				Hostname:   ctx.String("hostname"),
+				Domainname: ctx.String("domainname"),
+				ExtraHosts: ctx.StringSlice("add-host"),
+				DNS:        ctx.StringSlice("dns"),
+				DNSSearch:  ctx.StringSlice("dns-search"),
+				DNSOptions: ctx.StringSlice("dns-option"),
+			}
+			for _, extraHost := range etcConfig.ExtraHosts {
+				if err := container.ValidateExtraHost(extraHost); err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+			}
+			for _, dns := range etcConfig.DNS {
+				if err := container.ValidateDNS(dns); err != nil {
+					log.Errorf("docker run err: %v", err)
+					return
+				}
+			}
+			usernsRemap := ctx.String("userns-remap")
+			if err := Run(it, resourceConfig, cgroupParent, usernsRemap, etcConfig, volume, envs, networkName, portMappings, containerName, imageName, entrypoint, initConfig); err != nil {
 				log.Error("docker run err:", err)
 			}
 		},
@@ -112,9 +307,39 @@ var (
 			}
 		},
 	}
+	monitorCommand = cli.Command{
+		Name:  "monitor",
+		Usage: "monitor memory events of a detached container. Do not call it outside",
+		/*
+			run -d启动的后台监控进程
+		*/
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) != 1 {
+				log.Errorf("missing container name")
+				return
+			}
+			if err := monitorContainer(ctx.Args().Get(0)); err != nil {
+				log.Errorf("docker monitor err: %v", err)
+			}
+		},
+	}
 	commitCommand = cli.Command{
 		Name:  "commit",
 		Usage: "commit a container into image",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "author, a",
+				Usage: "author of the image",
+			},
+			cli.StringFlag{
+				Name:  "message, m",
+				Usage: "commit message",
+			},
+			cli.StringSliceFlag{
+				Name:  "change, c",
+				Usage: "apply Dockerfile instruction to the image config, e.g. 'CMD [\"sh\"]'",
+			},
+		},
 		Action: func(ctx *cli.Context) {
 			if len(ctx.Args()) < 2 {
 				log.Errorf("missing container name or image name")
@@ -122,7 +347,7 @@ var (
 			}
 			containerName := ctx.Args().Get(0)
 			imageName := ctx.Args().Get(1)
-			if err := commitContainer(containerName, imageName); err != nil {
+			if err := commitContainer(containerName, imageName, ctx.String("author"), ctx.String("message"), ctx.StringSlice("change")); err != nil {
 				log.Errorf("docker commit err: %v", err)
 			}
 		},
@@ -136,6 +361,29 @@ var (
 			}
 		},
 	}
+	inspectCommand = cli.Command{
+		Name:  "inspect",
+		Usage: "display detailed information of a container",
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) < 1 {
+				log.Errorf("missing container name")
+				return
+			}
+			containerName := ctx.Args().Get(0)
+			if err := inspectContainer(containerName); err != nil {
+				log.Errorf("docker inspect err: %v", err)
+			}
+		},
+	}
+	eventsCommand = cli.Command{
+		Name:  "events",
+		Usage: "list container events",
+		Action: func(ctx *cli.Context) {
+			if err := listEvents(); err != nil {
+				log.Errorf("docker events err: %v", err)
+			}
+		},
+	}
 	imagesCommand = cli.Command{
 		Name:  "images",
 		Usage: "list all the images",
@@ -145,6 +393,268 @@ var (
 			}
 		},
 	}
+	rmiCommand = cli.Command{
+		Name:  "rmi",
+		Usage: "remove one or more images",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "f",
+				Usage: "force removal of the image",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) < 1 {
+				log.Errorf("missing image name")
+				return
+			}
+			if err := removeImages(ctx.Bool("f"), ctx.Args()); err != nil {
+				log.Errorf("docker rmi err: %v", err)
+			}
+		},
+	}
+	imageCommand = cli.Command{
+		Name:  "image",
+		Usage: "manage images",
+		Subcommands: []cli.Command{
+			{
+				Name:  "inspect",
+				Usage: "display detailed information of one or more images",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "format, f",
+						Usage: "format the output using the given go template",
+					},
+				},
+				Action: func(ctx *cli.Context) {
+					if len(ctx.Args()) < 1 {
+						log.Errorf("missing image name")
+						return
+					}
+					if err := inspectImages(ctx.String("format"), ctx.Args()); err != nil {
+						log.Errorf("docker image inspect err: %v", err)
+					}
+				},
+			}, {
+				Name:  "prune",
+				Usage: "remove unused images",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "a",
+						Usage: "remove all images not used by containers, not just dangling ones",
+					},
+				},
+				Action: func(ctx *cli.Context) {
+					if err := pruneImages(ctx.Bool("a")); err != nil {
+						log.Errorf("docker image prune err: %v", err)
+					}
+				},
+			},
+		},
+	}
+	historyCommand = cli.Command{
+		Name:  "history",
+		Usage: "show the history of an image",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "no-trunc",
+				Usage: "do not truncate output",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Usage: "format the output using the given go template",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) < 1 {
+				log.Errorf("missing image name")
+				return
+			}
+			if err := imageHistory(ctx.Args().Get(0), ctx.Bool("no-trunc"), ctx.String("format")); err != nil {
+				log.Errorf("docker history err: %v", err)
+			}
+		},
+	}
+	tagCommand = cli.Command{
+		Name:  "tag",
+		Usage: "create a tag TARGET_IMAGE that refers to SOURCE_IMAGE",
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) < 2 {
+				log.Errorf("missing source image or target image")
+				return
+			}
+			if err := tagImage(ctx.Args().Get(0), ctx.Args().Get(1)); err != nil {
+				log.Errorf("docker tag err: %v", err)
+			}
+		},
+	}
+	saveCommand = cli.Command{
+		Name:  "save",
+		Usage: "save images to an oci image layout archive",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "write to a file instead of stdout",
+			},
+			cli.StringFlag{
+				Name:  "compression",
+				Value: image.CompressionGzip,
+				Usage: "layer compression: gzip, zstd or none",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) < 1 {
+				log.Errorf("missing image name")
+				return
+			}
+			output := ctx.String("output")
+			// 归档写到标准输出时日志改为输出到标准错误
+			if output == "" {
+				log.SetOutput(os.Stderr)
+			}
+			if err := saveImages(output, ctx.String("compression"), ctx.Args()); err != nil {
+				log.Errorf("docker save err: %v", err)
+			}
+		},
+	}
+	loadCommand = cli.Command{
+		Name:  "load",
+		Usage: "load images from an oci image layout archive",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "input, i",
+				Usage: "read from a file instead of stdin",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if err := loadImages(ctx.String("input")); err != nil {
+				log.Errorf("docker load err: %v", err)
+			}
+		},
+	}
+	pullCommand = cli.Command{
+		Name:  "pull",
+		Usage: "pull an image from a registry\nmydocker pull [registry/]name[:tag|@digest]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "registry credentials in the username:password format",
+			},
+			cli.BoolFlag{
+				Name:  "insecure",
+				Usage: "use plain http to access the registry",
+			},
+			cli.StringFlag{
+				Name:  "unix",
+				Usage: "connect to the registry through a unix socket, e.g. one served by mydocker registry serve --unix",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) != 1 {
+				log.Errorf("pull requires exactly one argument")
+				return
+			}
+			if err := pullImage(ctx.Args().Get(0), ctx.String("user"), ctx.Bool("insecure"), ctx.String("unix")); err != nil {
+				log.Errorf("docker pull err: %v", err)
+			}
+		},
+	}
+	pushCommand = cli.Command{
+		Name:  "push",
+		Usage: "push an image to a registry\nmydocker push [registry/]name[:tag]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "user, u",
+				Usage: "registry credentials in the username:password format",
+			},
+			cli.BoolFlag{
+				Name:  "insecure",
+				Usage: "use plain http to access the registry",
+			},
+			cli.StringFlag{
+				Name:  "unix",
+				Usage: "connect to the registry through a unix socket, e.g. one served by mydocker registry serve --unix",
+			},
+			cli.StringFlag{
+				Name:  "compression",
+				Value: image.CompressionGzip,
+				Usage: "layer compression: gzip, zstd or none",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) != 1 {
+				log.Errorf("push requires exactly one argument")
+				return
+			}
+			if err := pushImage(ctx.Args().Get(0), ctx.String("compression"), ctx.String("user"), ctx.Bool("insecure"), ctx.String("unix")); err != nil {
+				log.Errorf("docker push err: %v", err)
+			}
+		},
+	}
+	registryCommand = cli.Command{
+		Name:  "registry",
+		Usage: "image registry commands",
+		Subcommands: []cli.Command{
+			{
+				Name:  "serve",
+				Usage: "serve the image store as a read/write registry v2 endpoint without authentication",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "addr",
+						Value: "127.0.0.1:5000",
+						Usage: "tcp address to listen on, the endpoint has no authentication so use :5000 only to expose it on all interfaces explicitly",
+					},
+					cli.StringFlag{
+						Name:  "unix",
+						Usage: "unix socket to listen on instead of a tcp address",
+					},
+				},
+				Action: func(ctx *cli.Context) {
+					if err := serveRegistry(ctx.String("addr"), ctx.String("unix")); err != nil {
+						log.Errorf("docker registry serve err: %v", err)
+					}
+				},
+			},
+		},
+	}
+	buildCommand = cli.Command{
+		Name:  "build",
+		Usage: "build an image from a Dockerfile\nmydocker build [-t name:tag] CONTEXT",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "tag, t",
+				Usage: "name and optionally a tag in the name:tag format",
+			},
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "name of the Dockerfile (default CONTEXT/Dockerfile)",
+			},
+			cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "do not use cache when building the image",
+			},
+			cli.StringFlag{
+				Name:  "net",
+				Usage: "network for the RUN instructions, without it RUN only has a loopback interface and no external network",
+			},
+			cli.StringFlag{
+				Name:  "cgroup-parent",
+				Usage: "parent cgroup for the RUN instructions",
+			},
+		},
+		Action: func(ctx *cli.Context) {
+			if len(ctx.Args()) != 1 {
+				log.Errorf("build requires exactly one argument: CONTEXT")
+				return
+			}
+			cgroupParent := ctx.String("cgroup-parent")
+			if cgroupParent == "" {
+				cgroupParent = ctx.GlobalString("cgroup-parent")
+			}
+			if err := buildImage(ctx.Args().Get(0), ctx.String("file"), ctx.StringSlice("tag"), ctx.Bool("no-cache"), cgroupParent, ctx.String("net")); err != nil {
+				log.Errorf("docker build err: %v", err)
+			}
+		},
+	}
 	logCommand = cli.Command{
 		Name:  "logs",
 		Usage: "print logs of a container",
@@ -166,6 +676,10 @@ var (
 			// this is a callback
 			if os.Getenv(EnvExecPid) != "" {
 				log.Infof("pid callback gid %v", os.Getgid())
+				if err := execCallback(); err != nil {
+					log.Errorf("docker exec err: %v", err)
+					os.Exit(1)
+				}
 				return
 			}
 			if len(ctx.Args()) < 2 {
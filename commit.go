@@ -3,22 +3,55 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	path2 "path"
 
+	"mydocker/image"
 	"mydocker/path"
-
-	log "github.com/sirupsen/logrus"
 )
 
-func commitContainer(containerName string, imageName string) error {
-	imageTar := path2.Join("/root", imageName+".tar")
-	cmd := exec.Command("tar", "-czf", imageTar, "-C", path.MntPath(containerName), ".")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("cmd.Run() err: %v", err)
+/*
+commitContainer 把容器的可写层提交为父镜像之上的新一层，保存到镜像存储并设置名称
+*/
+func commitContainer(containerName string, imageName string, author string, message string, changes []string) error {
+	ref, err := image.ParseTag(imageName)
+	if err != nil {
+		return err
+	}
+	info, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("getContainerInfoByName err: %v", err)
+	}
+	parent := image.Digest(info.ImageID)
+	// 镜像存储之前创建的容器没有记录镜像id
+	if parent == "" {
+		if parent, _, err = image.Resolve(info.ImageName); err != nil {
+			return fmt.Errorf("image.Resolve err: %v", err)
+		}
+	}
+	upperPath := path.UpperPath(containerName)
+	if _, err = os.Stat(upperPath); err != nil {
+		return fmt.Errorf("container %s has no writable layer: %v", containerName, err)
+	}
+	// 新的层在打标签之前由租约保留，避免并发的GC删除
+	lease, err := image.NewLease()
+	if err != nil {
+		return fmt.Errorf("image.NewLease err: %v", err)
+	}
+	defer lease.Release()
+	id, err := image.Commit(parent, upperPath, &image.CommitOptions{
+		Author:    author,
+		Comment:   message,
+		CreatedBy: info.Command,
+		Changes:   changes,
+		Lease:     lease,
+		UidMaps:   info.UidMappings,
+		GidMaps:   info.GidMappings,
+	})
+	if err != nil {
+		return fmt.Errorf("image.Commit err: %v", err)
+	}
+	if err = image.Tag(ref, id); err != nil {
+		return fmt.Errorf("image.Tag err: %v", err)
 	}
-	log.Info(imageTar)
+	fmt.Println(id)
 	return nil
 }
@@ -0,0 +1,89 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cgroup namespace模式
+	CgroupNsPrivate = "private" // 容器拥有独立的cgroup namespace，根为容器自己的cgroup
+	CgroupNsHost    = "host"    // 与宿主机共享cgroup namespace
+)
+
+/*
+InitConfig 父进程通过管道传递给容器init进程的配置
+*/
+type InitConfig struct {
+	Command        []string          `json:"command"`          // 用户命令
+	CgroupNs       string            `json:"cgroupNs"`         // cgroup namespace模式
+	Rootfs         *RootfsConfig     `json:"rootfs,omitempty"` // 需要在容器内挂载的文件系统(rootless)
+	Security       SecurityConfig    `json:"security"`         // 安全配置
+	ShmSize        int64             `json:"shmSize"`          // /dev/shm大小(字节)
+	Devices        []*Device         `json:"devices"`          // --device指定的设备
+	Tmpfs          []*TmpfsMount     `json:"tmpfs"`            // --tmpfs指定的挂载
+	ReadonlyRootfs bool              `json:"readonlyRootfs"`   // 根目录只读
+	Hostname       string            `json:"hostname"`         // 主机名
+	Domainname     string            `json:"domainname"`       // 域名
+	EtcFiles       []*BindFile       `json:"etcFiles"`         // 生成的hosts、resolv.conf、hostname
+	Rlimits        []*Rlimit         `json:"rlimits"`          // 资源限制
+	Sysctls        map[string]string `json:"sysctls"`          // 容器namespace中的内核参数
+	WorkingDir     string            `json:"workingDir"`       // 用户命令的工作目录
+}
+
+/*
+RootfsConfig 容器文件系统的挂载信息
+rootless模式下宿主机上的普通用户不能挂载overlay，交给拥有独立user namespace的容器init进程挂载
+*/
+type RootfsConfig struct {
+	Dir         string   `json:"dir"`      // 容器目录，LowerDir是相对该目录的路径
+	LowerDir    string   `json:"lowerDir"` // 冒号连接的只读层目录
+	UpperDir    string   `json:"upperDir"`
+	WorkDir     string   `json:"workDir"`
+	MntPath     string   `json:"mntPath"`
+	VolumePaths []string `json:"volumePaths"`
+}
+
+/*
+Validate 校验init配置
+*/
+func (c *InitConfig) Validate() error {
+	if len(c.Command) == 0 {
+		return fmt.Errorf("no command specified")
+	}
+	if c.WorkingDir != "" && !filepath.IsAbs(c.WorkingDir) {
+		return fmt.Errorf("working directory must be absolute: %s", c.WorkingDir)
+	}
+	switch c.CgroupNs {
+	case "":
+		c.CgroupNs = CgroupNsPrivate
+	case CgroupNsPrivate, CgroupNsHost:
+	default:
+		return fmt.Errorf("invalid cgroupns mode: %s", c.CgroupNs)
+	}
+	return nil
+}
+
+/*
+ParseSize 解析带单位的大小，例如64m、1g，单位为b、k、m、g(不区分大小写，可带b后缀)，没有单位时为字节
+*/
+func ParseSize(size string) (int64, error) {
+	units := map[string]int64{"": 1, "b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+	value := strings.ToLower(strings.TrimSpace(size))
+	num := strings.TrimRight(value, "bkmg")
+	unit := strings.TrimSuffix(value[len(num):], "b")
+	if value[len(num):] == "b" {
+		unit = ""
+	}
+	multiplier, ok := units[unit]
+	if !ok || num == "" {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return n * multiplier, nil
+}
@@ -6,3 +6,8 @@ const (
 	STOP    = "stop"
 	Exit    = "exited"
 )
+
+const (
+	// 容器内cgroup挂载路径
+	cgroupMountPath = "/sys/fs/cgroup"
+)
@@ -0,0 +1,248 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"mydocker/cgroups"
+)
+
+const (
+	// DefaultShmSize /dev/shm默认大小，与docker一致为64M
+	DefaultShmSize = 64 * 1024 * 1024
+	// devpts中tty组的gid
+	ttyGid = 5
+)
+
+/*
+Device 容器内的设备节点
+*/
+type Device struct {
+	Path        string `json:"path"`        // 容器内路径
+	HostPath    string `json:"hostPath"`    // 宿主机上的路径，不能mknod时绑定挂载
+	Type        uint32 `json:"type"`        // syscall.S_IFCHR或syscall.S_IFBLK
+	Major       uint32 `json:"major"`       // 主设备号
+	Minor       uint32 `json:"minor"`       // 次设备号
+	Mode        uint32 `json:"mode"`        // 权限位
+	Uid         uint32 `json:"uid"`         // 属主
+	Gid         uint32 `json:"gid"`         // 属组
+	Permissions string `json:"permissions"` // cgroup设备权限 r、w、m的组合
+}
+
+// 每个容器都有的字符设备，与docker一致
+var defaultDevices = []*Device{
+	{Path: "/dev/null", HostPath: "/dev/null", Type: syscall.S_IFCHR, Major: 1, Minor: 3, Mode: 0666},
+	{Path: "/dev/zero", HostPath: "/dev/zero", Type: syscall.S_IFCHR, Major: 1, Minor: 5, Mode: 0666},
+	{Path: "/dev/full", HostPath: "/dev/full", Type: syscall.S_IFCHR, Major: 1, Minor: 7, Mode: 0666},
+	{Path: "/dev/random", HostPath: "/dev/random", Type: syscall.S_IFCHR, Major: 1, Minor: 8, Mode: 0666},
+	{Path: "/dev/urandom", HostPath: "/dev/urandom", Type: syscall.S_IFCHR, Major: 1, Minor: 9, Mode: 0666},
+	{Path: "/dev/tty", HostPath: "/dev/tty", Type: syscall.S_IFCHR, Major: 5, Minor: 0, Mode: 0666},
+}
+
+// /dev下的符号链接
+var defaultDevSymlinks = [][2]string{
+	{"/proc/self/fd", "/dev/fd"},
+	{"/proc/self/fd/0", "/dev/stdin"},
+	{"/proc/self/fd/1", "/dev/stdout"},
+	{"/proc/self/fd/2", "/dev/stderr"},
+	{"pts/ptmx", "/dev/ptmx"},
+}
+
+/*
+setUpDev 在rootfs的/dev(已挂载tmpfs)下创建默认设备节点、--device指定的设备、符号链接，挂载devpts、shm和mqueue
+需要在pivot_root之前调用，user namespace中不能mknod时绑定宿主机的设备
+所有路径都在rootfs中解析，镜像中/dev或--device路径上的符号链接不会指向宿主机
+*/
+func setUpDev(rootfs string, devices []*Device, shmSize int64) error {
+	for _, dev := range append(defaultDevices, devices...) {
+		if err := createDevice(rootfs, dev); err != nil {
+			return fmt.Errorf("createDevice %s err: %v", dev.Path, err)
+		}
+	}
+	for _, link := range defaultDevSymlinks {
+		target, err := secureJoinParent(rootfs, link[1])
+		if err != nil {
+			return fmt.Errorf("secureJoinParent err: %v", err)
+		}
+		if err = os.Symlink(link[0], target); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("os.Symlink err: %v", err)
+		}
+	}
+	if err := mountDevPts(rootfs); err != nil {
+		return fmt.Errorf("mountDevPts err: %v", err)
+	}
+	if shmSize <= 0 {
+		shmSize = DefaultShmSize
+	}
+	shmPath, err := secureJoin(rootfs, "/dev/shm")
+	if err != nil {
+		return fmt.Errorf("secureJoin err: %v", err)
+	}
+	if err := os.MkdirAll(shmPath, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("shm", shmPath, "tmpfs", flags, fmt.Sprintf("mode=1777,size=%d", shmSize)); err != nil {
+		return fmt.Errorf("mount shm err: %v", err)
+	}
+	mqueuePath, err := secureJoin(rootfs, "/dev/mqueue")
+	if err != nil {
+		return fmt.Errorf("secureJoin err: %v", err)
+	}
+	if err := os.MkdirAll(mqueuePath, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err := syscall.Mount("mqueue", mqueuePath, "mqueue", flags, ""); err != nil {
+		// 某些内核不允许user namespace中挂载mqueue，不影响容器运行
+		if err != syscall.EPERM {
+			return fmt.Errorf("mount mqueue err: %v", err)
+		}
+		log.Warnf("mount mqueue err: %v, /dev/mqueue is unavailable", err)
+	}
+	return nil
+}
+
+/*
+createDevice 创建设备节点，没有权限时(user namespace)创建空文件并绑定宿主机上同名的设备
+*/
+func createDevice(rootfs string, dev *Device) error {
+	target, err := secureJoinParent(rootfs, dev.Path)
+	if err != nil {
+		return fmt.Errorf("secureJoinParent err: %v", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	// 目标已存在(例如多次指定同一设备)时先删除
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.Remove err: %v", err)
+	}
+	err = syscall.Mknod(target, dev.Type|dev.Mode, int(unix.Mkdev(dev.Major, dev.Minor)))
+	if err == syscall.EPERM {
+		return bindDevice(dev.HostPath, target)
+	}
+	if err != nil {
+		return fmt.Errorf("syscall.Mknod err: %v", err)
+	}
+	// mknod受umask影响，重新设置权限
+	if err = os.Chmod(target, os.FileMode(dev.Mode)); err != nil {
+		return fmt.Errorf("os.Chmod err: %v", err)
+	}
+	if err = os.Lchown(target, int(dev.Uid), int(dev.Gid)); err != nil {
+		return fmt.Errorf("os.Lchown err: %v", err)
+	}
+	return nil
+}
+
+/*
+bindDevice 把宿主机上的设备绑定挂载到容器内
+*/
+func bindDevice(source string, target string) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY|syscall.O_NOFOLLOW, 0000)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile err: %v", err)
+	}
+	err = bindMountFd(source, f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("bind %s err: %v", source, err)
+	}
+	return nil
+}
+
+/*
+mountDevPts 挂载独立的devpts实例，容器内的伪终端与宿主机隔离
+rootless只映射了当前用户时tty组不存在，去掉gid选项重试
+*/
+func mountDevPts(rootfs string) error {
+	ptsPath, err := secureJoin(rootfs, "/dev/pts")
+	if err != nil {
+		return fmt.Errorf("secureJoin err: %v", err)
+	}
+	if err = os.MkdirAll(ptsPath, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC)
+	options := "newinstance,ptmxmode=0666,mode=0620"
+	err = syscall.Mount("devpts", ptsPath, "devpts", flags, fmt.Sprintf("%s,gid=%d", options, ttyGid))
+	if err == syscall.EINVAL {
+		err = syscall.Mount("devpts", ptsPath, "devpts", flags, options)
+	}
+	if err != nil {
+		return fmt.Errorf("syscall.Mount err: %v", err)
+	}
+	return nil
+}
+
+/*
+ParseDevice 解析--device host[:container][:permissions]，权限默认为rwm，容器内路径默认与宿主机相同
+*/
+func ParseDevice(spec string) (*Device, error) {
+	parts := strings.Split(spec, ":")
+	hostPath, containerPath, permissions := parts[0], parts[0], "rwm"
+	switch len(parts) {
+	case 1:
+	case 2:
+		// 第二段不是路径时视为权限
+		if cgroups.ValidatePermissions(parts[1]) == nil {
+			permissions = parts[1]
+		} else {
+			containerPath = parts[1]
+		}
+	case 3:
+		containerPath, permissions = parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid device specification: %s", spec)
+	}
+	if err := cgroups.ValidatePermissions(permissions); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(hostPath) || !filepath.IsAbs(containerPath) {
+		return nil, fmt.Errorf("device paths must be absolute: %s", spec)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(hostPath, &st); err != nil {
+		return nil, fmt.Errorf("syscall.Stat %s err: %v", hostPath, err)
+	}
+	fileType := st.Mode & syscall.S_IFMT
+	if fileType != syscall.S_IFCHR && fileType != syscall.S_IFBLK {
+		return nil, fmt.Errorf("%s is not a device node", hostPath)
+	}
+	return &Device{
+		Path:        filepath.Clean(containerPath),
+		HostPath:    hostPath,
+		Type:        fileType,
+		Major:       unix.Major(st.Rdev),
+		Minor:       unix.Minor(st.Rdev),
+		Mode:        st.Mode &^ syscall.S_IFMT,
+		Uid:         st.Uid,
+		Gid:         st.Gid,
+		Permissions: permissions,
+	}, nil
+}
+
+/*
+DeviceRules 容器的设备白名单: 默认规则加上--device指定的设备
+*/
+func DeviceRules(devices []*Device) []cgroups.DeviceRule {
+	rules := append([]cgroups.DeviceRule{}, cgroups.DefaultDeviceRules...)
+	for _, dev := range devices {
+		deviceType := cgroups.DeviceTypeChar
+		if dev.Type == syscall.S_IFBLK {
+			deviceType = cgroups.DeviceTypeBlock
+		}
+		rules = append(rules, cgroups.DeviceRule{
+			Type:        deviceType,
+			Major:       int64(dev.Major),
+			Minor:       int64(dev.Minor),
+			Permissions: dev.Permissions,
+		})
+	}
+	return rules
+}
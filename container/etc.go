@@ -0,0 +1,237 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"mydocker/path"
+	"mydocker/userns"
+)
+
+const (
+	// 宿主机的resolv.conf
+	hostResolvConf = "/etc/resolv.conf"
+)
+
+// 宿主机只配置了本地dns(例如systemd-resolved)时容器内无法访问，改用公共dns，与docker一致
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+/*
+EtcConfig 生成容器/etc/hosts、/etc/resolv.conf、/etc/hostname的配置
+*/
+type EtcConfig struct {
+	Hostname   string
+	Domainname string
+	ExtraHosts []string // name:ip
+	DNS        []string
+	DNSSearch  []string
+	DNSOptions []string
+}
+
+/*
+BindFile 绑定挂载到容器内的文件
+*/
+type BindFile struct {
+	Source      string `json:"source"`      // 宿主机路径
+	Destination string `json:"destination"` // 容器内路径
+}
+
+/*
+ValidateExtraHost 校验--add-host name:ip，ip可以是ipv6
+*/
+func ValidateExtraHost(extraHost string) error {
+	name, ip, found := strings.Cut(extraHost, ":")
+	if !found || name == "" || net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid extra host: %s", extraHost)
+	}
+	return nil
+}
+
+/*
+ValidateDNS 校验--dns
+*/
+func ValidateDNS(dns string) error {
+	if net.ParseIP(dns) == nil {
+		return fmt.Errorf("invalid dns server: %s", dns)
+	}
+	return nil
+}
+
+/*
+WriteEtcFiles 在容器状态目录中生成hosts、resolv.conf、hostname，返回需要绑定挂载的文件
+ip为容器在网络中的地址，没有连接网络时为空
+userns-remap时文件属于容器root，容器内的root才能修改
+*/
+func WriteEtcFiles(containerName string, config *EtcConfig, ip string, uidMaps []userns.IDMap, gidMaps []userns.IDMap) ([]*BindFile, error) {
+	if err := os.MkdirAll(path.ContainerInfoPath(containerName), 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	files := []*BindFile{
+		{Source: path.HostsPath(containerName), Destination: "/etc/hosts"},
+		{Source: path.ResolvConfPath(containerName), Destination: "/etc/resolv.conf"},
+		{Source: path.HostnamePath(containerName), Destination: "/etc/hostname"},
+	}
+	resolvConf, err := buildResolvConf(config)
+	if err != nil {
+		return nil, fmt.Errorf("buildResolvConf err: %v", err)
+	}
+	contents := [][]byte{buildHosts(config, ip), resolvConf, []byte(config.Hostname + "\n")}
+	for i, file := range files {
+		if err = os.WriteFile(file.Source, contents[i], 0644); err != nil {
+			return nil, fmt.Errorf("os.WriteFile err: %v", err)
+		}
+		if len(uidMaps) > 0 && !path.Rootless() {
+			if err = chownToContainerRoot(uidMaps, gidMaps, file.Source); err != nil {
+				return nil, fmt.Errorf("chownToContainerRoot err: %v", err)
+			}
+		}
+	}
+	return files, nil
+}
+
+func buildHosts(config *EtcConfig, ip string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("127.0.0.1\tlocalhost\n")
+	buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	buf.WriteString("fe00::0\tip6-localnet\n")
+	buf.WriteString("ff00::0\tip6-mcastprefix\n")
+	buf.WriteString("ff02::1\tip6-allnodes\n")
+	buf.WriteString("ff02::2\tip6-allrouters\n")
+	for _, extraHost := range config.ExtraHosts {
+		name, hostIp, _ := strings.Cut(extraHost, ":")
+		buf.WriteString(fmt.Sprintf("%s\t%s\n", hostIp, name))
+	}
+	if ip != "" {
+		names := config.Hostname
+		if config.Domainname != "" {
+			names = config.Hostname + "." + config.Domainname + " " + config.Hostname
+		}
+		buf.WriteString(fmt.Sprintf("%s\t%s\n", ip, names))
+	}
+	return buf.Bytes()
+}
+
+/*
+buildResolvConf 没有指定的项使用宿主机resolv.conf中的配置，去掉容器内不可达的本地dns
+*/
+func buildResolvConf(config *EtcConfig) ([]byte, error) {
+	nameservers, search, options := config.DNS, config.DNSSearch, config.DNSOptions
+	hostNameservers, hostSearch, hostOptions, err := parseResolvConf(hostResolvConf)
+	if err != nil {
+		return nil, fmt.Errorf("parseResolvConf err: %v", err)
+	}
+	if len(nameservers) == 0 {
+		for _, ns := range hostNameservers {
+			if nsIp := net.ParseIP(ns); nsIp != nil && !nsIp.IsLoopback() {
+				nameservers = append(nameservers, ns)
+			}
+		}
+		if len(nameservers) == 0 {
+			nameservers = defaultNameservers
+		}
+	}
+	if len(search) == 0 {
+		search = hostSearch
+	}
+	if len(options) == 0 {
+		options = hostOptions
+	}
+	var buf bytes.Buffer
+	for _, ns := range nameservers {
+		buf.WriteString("nameserver " + ns + "\n")
+	}
+	if len(search) > 0 {
+		buf.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	if len(options) > 0 {
+		buf.WriteString("options " + strings.Join(options, " ") + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+func parseResolvConf(file string) ([]string, []string, []string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil, nil
+		}
+		return nil, nil, nil, fmt.Errorf("os.Open err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var nameservers, search, options []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			nameservers = append(nameservers, fields[1])
+		case "search", "domain": // 后出现的覆盖前面的
+			search = fields[1:]
+		case "options":
+			options = append(options, fields[1:]...)
+		}
+	}
+	return nameservers, search, options, scanner.Err()
+}
+
+/*
+setHostname 设置容器uts namespace中的主机名和域名
+*/
+func setHostname(hostname string, domainname string) error {
+	if hostname != "" {
+		if err := syscall.Sethostname([]byte(hostname)); err != nil {
+			return fmt.Errorf("syscall.Sethostname err: %v", err)
+		}
+	}
+	if domainname != "" {
+		if err := unix.Setdomainname([]byte(domainname)); err != nil {
+			return fmt.Errorf("unix.Setdomainname err: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+bindFiles 把文件绑定挂载到rootfs中，目标文件不存在时创建，需要在pivot_root之前调用
+上级目录在rootfs中解析，打开目标时不跟随符号链接，通过打开的文件挂载，避免镜像中的符号链接指向宿主机
+*/
+func bindFiles(rootfs string, files []*BindFile) error {
+	for _, file := range files {
+		target, err := secureJoinParent(rootfs, file.Destination)
+		if err != nil {
+			return fmt.Errorf("secureJoinParent err: %v", err)
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+		// 镜像中的/etc/resolv.conf可能是指向宿主机不存在路径的符号链接
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err = os.Remove(target); err != nil {
+				return fmt.Errorf("os.Remove err: %v", err)
+			}
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY|syscall.O_NOFOLLOW, 0644)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile err: %v", err)
+		}
+		err = bindMountFd(file.Source, f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("bind %s err: %v", file.Destination, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+/*
+RunContainerExecProcess
+nsenter已经在进程启动前进入了容器的namespace，这里应用容器的安全配置后用sh执行用户命令
+*/
+func RunContainerExecProcess(command string, security *SecurityConfig) error {
+	runtime.LockOSThread()
+	shPath, err := exec.LookPath("sh")
+	if err != nil {
+		return fmt.Errorf("exec.LookPath err: %v", err)
+	}
+	if security != nil {
+		if err = applySecurity(security); err != nil {
+			return fmt.Errorf("applySecurity err: %v", err)
+		}
+	}
+	if err = syscall.Exec(shPath, []string{"sh", "-c", command}, os.Environ()); err != nil {
+		return fmt.Errorf("syscall.Exec err: %v", err)
+	}
+	return nil
+}
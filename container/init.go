@@ -4,13 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
+
+	"mydocker/cgroups"
 )
 
 /*
@@ -19,23 +23,54 @@ RunContainerInitProcess
 替换容器当前进程 syscall.Exec成为当前pid为1的进程
 */
 func RunContainerInitProcess() error {
-	// 从管道中获取用户命令
-	userCommand, err := readUserCommand()
+	// namespace相关的系统调用只对当前线程生效，锁定线程保证最后exec的线程就是做初始化的线程
+	runtime.LockOSThread()
+	// 从管道中获取init配置
+	config, err := readInitConfig()
 	if err != nil {
-		return fmt.Errorf("readUserCommand err: %v", err)
+		return fmt.Errorf("readInitConfig err: %v", err)
 	}
-	if len(userCommand) == 0 {
+	if len(config.Command) == 0 {
 		return errors.New("len(userCommand) = 0")
 	}
+	// 父进程已经把当前进程加入容器的cgroup，此时创建cgroup namespace，其根即为容器的cgroup
+	if config.CgroupNs == CgroupNsPrivate {
+		if err = syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil {
+			return fmt.Errorf("syscall.Unshare err: %v", err)
+		}
+	}
+	// rootless模式下挂载容器文件系统
+	if config.Rootfs != nil {
+		if err = mountRootfs(config.Rootfs); err != nil {
+			return fmt.Errorf("mountRootfs err: %v", err)
+		}
+	}
+	if err = setHostname(config.Hostname, config.Domainname); err != nil {
+		return fmt.Errorf("setHostname err: %v", err)
+	}
 	// 给容器做一些挂载
-	if err = setUpMount(); err != nil {
+	if err = setUpMount(config); err != nil {
 		return fmt.Errorf("setUpMount err: %v", err)
 	}
+	if config.WorkingDir != "" {
+		if err = syscall.Chdir(config.WorkingDir); err != nil {
+			return fmt.Errorf("syscall.Chdir err: %v", err)
+		}
+	}
 	// 执行用户命令
+	userCommand := config.Command
 	cmdPath, err := exec.LookPath(userCommand[0]) // 调用exec.LookPath，可以在系统的PATH里面寻找命令的绝对路径
 	if err != nil {
 		return fmt.Errorf("exec.LookPath err: %v", err)
 	}
+	// 资源限制需要在删除CAP_SYS_RESOURCE之前设置
+	if err = setRlimits(config.Rlimits); err != nil {
+		return fmt.Errorf("setRlimits err: %v", err)
+	}
+	// 应用安全配置
+	if err = applySecurity(&config.Security); err != nil {
+		return fmt.Errorf("applySecurity err: %v", err)
+	}
 	if err = syscall.Exec(cmdPath, userCommand, os.Environ()); err != nil {
 		return fmt.Errorf("syscall.Exec err: %v", err)
 	}
@@ -44,40 +79,155 @@ func RunContainerInitProcess() error {
 
 /*
 容器初始化 挂载点
+proc、dev、sys、tmpfs和路径屏蔽在pivot_root之前相对rootfs挂载，这样可以绑定宿主机的/dev/null
 */
-func setUpMount() error {
+func setUpMount(config *InitConfig) error {
 	// 获取当前路径
 	pwd, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("os.Getwd err: %v", err)
 	}
 	log.Infof("current location is %s", pwd)
-	if err = pivotRoot(pwd); err != nil {
-		return fmt.Errorf("pivotRoot err: %v", err)
+	// pivot_root之后看不到宿主机的挂载信息，需要提前判断
+	unified, err := cgroups.IsUnified()
+	if err != nil {
+		return fmt.Errorf("cgroups.IsUnified err: %v", err)
+	}
+	/*
+		systemd 加入linux之后, mount namespace 就变成 shared by default, 所以你必须显示
+		声明你要这个新的mount namespace独立，否则下面的挂载会传播到宿主机。
+	*/
+	if err = syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("syscall.Mount err: %v", err)
 	}
 	// mount proc
-	if err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+	procPath, err := secureJoin(pwd, "/proc")
+	if err != nil {
+		return fmt.Errorf("secureJoin err: %v", err)
+	}
+	if err = os.MkdirAll(procPath, 0555); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err = syscall.Mount("proc", procPath, "proc", syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
 		return fmt.Errorf("syscall.Mount err: %v", err)
 	}
 	// mount tmpfs
-	if err = syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
+	devPath, err := secureJoin(pwd, "/dev")
+	if err != nil {
+		return fmt.Errorf("secureJoin err: %v", err)
+	}
+	if err = os.MkdirAll(devPath, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err = syscall.Mount("tmpfs", devPath, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
 		return fmt.Errorf("syscall.Mount err: %v", err)
 	}
+	if err = setUpDev(pwd, config.Devices, config.ShmSize); err != nil {
+		return fmt.Errorf("setUpDev err: %v", err)
+	}
+	// mount sysfs，特权容器可写
+	if err = mountSysfs(pwd, !config.Security.Privileged); err != nil {
+		return fmt.Errorf("mountSysfs err: %v", err)
+	}
+	if err = mountTmpfs(pwd, config.Tmpfs); err != nil {
+		return fmt.Errorf("mountTmpfs err: %v", err)
+	}
+	if err = bindFiles(pwd, config.EtcFiles); err != nil {
+		return fmt.Errorf("bindFiles err: %v", err)
+	}
+	// 只读挂载/proc/sys之前写入内核参数
+	if err = writeSysctls(pwd, config.Sysctls); err != nil {
+		return fmt.Errorf("writeSysctls err: %v", err)
+	}
+	// 屏蔽敏感路径
+	if err = maskPaths(pwd, config.Security.MaskedPaths); err != nil {
+		return fmt.Errorf("maskPaths err: %v", err)
+	}
+	if err = readonlyPaths(pwd, config.Security.ReadonlyPaths); err != nil {
+		return fmt.Errorf("readonlyPaths err: %v", err)
+	}
+	if err = pivotRoot(pwd); err != nil {
+		return fmt.Errorf("pivotRoot err: %v", err)
+	}
+	// 工作目录不存在时创建，根目录只读时也可以使用
+	// 工作目录来自镜像配置，在pivot_root之后创建，镜像中的符号链接只能指向容器内
+	if config.WorkingDir != "" {
+		workingDir, err := secureJoin("/", config.WorkingDir)
+		if err != nil {
+			return fmt.Errorf("secureJoin err: %v", err)
+		}
+		if err = os.MkdirAll(workingDir, 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+	}
+	// 私有cgroup namespace下只读挂载容器自己的cgroup2子树
+	if config.CgroupNs == CgroupNsPrivate && unified {
+		if err = mountCgroup(); err != nil {
+			return fmt.Errorf("mountCgroup err: %v", err)
+		}
+	}
+	// 最后把根目录重新挂载为只读，卷、tmpfs等子挂载仍然可写
+	if config.ReadonlyRootfs {
+		if err = remountReadonly("/"); err != nil {
+			return fmt.Errorf("remountReadonly err: %v", err)
+		}
+	}
 	return nil
 }
 
 /*
-pivotRoot 切换根文件系统
+mountSysfs 在rootfs下挂载sysfs
+rootless时容器的network namespace可能不属于容器的user namespace，不能挂载sysfs，改为递归绑定宿主机的/sys
 */
-func pivotRoot(root string) error {
-	var err error
-	/*
-		systemd 加入linux之后, mount namespace 就变成 shared by default, 所以你必须显示
-		声明你要这个新的mount namespace独立。
-	*/
-	if err = syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+func mountSysfs(rootfs string, readonly bool) error {
+	sysPath, err := secureJoin(rootfs, "/sys")
+	if err != nil {
+		return fmt.Errorf("secureJoin err: %v", err)
+	}
+	if err = os.MkdirAll(sysPath, 0555); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	if readonly {
+		flags |= syscall.MS_RDONLY
+	}
+	err = syscall.Mount("sysfs", sysPath, "sysfs", flags, "")
+	if err == nil {
+		return nil
+	}
+	if err != syscall.EPERM {
+		return fmt.Errorf("syscall.Mount err: %v", err)
+	}
+	if err = syscall.Mount("/sys", sysPath, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind /sys err: %v", err)
+	}
+	if readonly {
+		if err = remountReadonly(sysPath); err != nil {
+			return fmt.Errorf("remountReadonly err: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+mountCgroup 只读挂载cgroup2到/sys/fs/cgroup，在cgroup namespace中挂载时根目录为容器的cgroup
+*/
+func mountCgroup() error {
+	if err := os.MkdirAll(cgroupMountPath, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	flags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_RDONLY
+	if err := syscall.Mount("cgroup2", cgroupMountPath, "cgroup2", uintptr(flags), ""); err != nil {
 		return fmt.Errorf("syscall.Mount err: %v", err)
 	}
+	return nil
+}
+
+/*
+pivotRoot 切换根文件系统，调用前需要把挂载传播设置为private
+*/
+func pivotRoot(root string) error {
+	var err error
 	/*
 		为了使当前root的老root和新root不在同一个文件系统下，我们把root重新mount了一次，
 		bind mount是把相同的内容换了一个挂载点的挂载方法。
@@ -109,20 +259,21 @@ func pivotRoot(root string) error {
 	return nil
 }
 
-func readUserCommand() ([]string, error) {
+/*
+readInitConfig 读取父进程通过管道发送的init配置，父进程写完后会关闭管道
+*/
+func readInitConfig() (*InitConfig, error) {
 	pipe := os.NewFile(uintptr(3), "pipe")
 	defer func() {
 		_ = pipe.Close()
 	}()
-	data := make([]byte, 200)
-	n, err := pipe.Read(data)
-	data = data[:n]
+	data, err := io.ReadAll(pipe)
 	if err != nil {
-		return nil, fmt.Errorf("readUserCommand err: %v", err)
+		return nil, fmt.Errorf("io.ReadAll err: %v", err)
 	}
-	userCommand := make([]string, 0)
-	if err = json.Unmarshal(data, &userCommand); err != nil {
+	var config InitConfig
+	if err = json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
 	}
-	return userCommand, nil
+	return &config, nil
 }
@@ -0,0 +1,143 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// UnmaskAll --security-opt unmask=ALL 取消所有屏蔽和只读路径
+	UnmaskAll = "ALL"
+	// statfs返回的relatime标志
+	stRelatime = 0x1000
+)
+
+// 与docker一致的默认屏蔽路径，文件绑定/dev/null，目录挂载只读的空tmpfs
+var defaultMaskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// 与docker一致的默认只读路径
+var defaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+/*
+unmaskPaths 从默认的屏蔽和只读路径中去掉unmask指定的路径，多个路径用冒号分隔，ALL表示全部去掉
+*/
+func unmaskPaths(unmask []string) ([]string, []string) {
+	excluded := make(map[string]bool)
+	for _, value := range unmask {
+		for _, p := range strings.Split(value, ":") {
+			if p == UnmaskAll {
+				return nil, nil
+			}
+			excluded[filepath.Clean(p)] = true
+		}
+	}
+	masked := make([]string, 0, len(defaultMaskedPaths))
+	for _, p := range defaultMaskedPaths {
+		if !excluded[p] {
+			masked = append(masked, p)
+		}
+	}
+	readonly := make([]string, 0, len(defaultReadonlyPaths))
+	for _, p := range defaultReadonlyPaths {
+		if !excluded[p] {
+			readonly = append(readonly, p)
+		}
+	}
+	return masked, readonly
+}
+
+/*
+maskPaths 屏蔽rootfs下的路径，不存在的路径忽略
+文件绑定宿主机的/dev/null，需要在pivot_root之前调用
+*/
+func maskPaths(rootfs string, paths []string) error {
+	for _, p := range paths {
+		target, err := secureJoin(rootfs, p)
+		if err != nil {
+			return fmt.Errorf("secureJoin err: %v", err)
+		}
+		fi, err := os.Stat(target)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("os.Stat err: %v", err)
+		}
+		if fi.IsDir() {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "")
+		} else {
+			err = syscall.Mount("/dev/null", target, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("mask %s err: %v", p, err)
+		}
+	}
+	return nil
+}
+
+/*
+readonlyPaths 把rootfs下的路径重新绑定挂载为只读，不存在的路径忽略
+*/
+func readonlyPaths(rootfs string, paths []string) error {
+	for _, p := range paths {
+		target, err := secureJoin(rootfs, p)
+		if err != nil {
+			return fmt.Errorf("secureJoin err: %v", err)
+		}
+		if _, err := os.Stat(target); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("os.Stat err: %v", err)
+		}
+		if err := syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s err: %v", p, err)
+		}
+		if err := remountReadonly(target); err != nil {
+			return fmt.Errorf("remountReadonly %s err: %v", p, err)
+		}
+	}
+	return nil
+}
+
+/*
+remountReadonly 把挂载点重新挂载为只读，只影响该挂载点，不影响其下的子挂载
+重新挂载时保留原有的nosuid、nodev、noexec等标志，user namespace中不能去掉这些被锁定的标志
+*/
+func remountReadonly(target string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return fmt.Errorf("syscall.Statfs err: %v", err)
+	}
+	// 这几个statfs返回的ST_*标志与MS_*的取值一致，relatime不一致需要单独转换
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	flags |= syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+	if err := syscall.Mount(target, target, "", flags, ""); err != nil {
+		return fmt.Errorf("syscall.Mount err: %v", err)
+	}
+	return nil
+}
@@ -1,32 +1,63 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"syscall"
 
 	"mydocker/path"
+	"mydocker/userns"
 )
 
 type Info struct {
-	Pid          string     `json:"pid,omitempty"`        // 容器在宿主机上的Pid
-	Id           string     `json:"id,omitempty"`         // 容器id
-	Name         string     `json:"name,omitempty"`       // 容器名
-	Command      string     `json:"command,omitempty"`    // 容器内init进程的运行命令
-	VolumePaths  []string   `json:"volumePaths"`          // 挂载的数据卷
-	Cgroup2Path  string     `json:"cgroup2Path"`          // cgroup路径
-	ImageName    string     `json:"imageName"`            // image名称
-	NetworkName  string     `json:"networkName"`          // 网络名称
-	PortMappings [][]string `json:"portMappings"`         // 端口映射
-	CreateTime   string     `json:"createTime,omitempty"` // 创建时间
-	Status       string     `json:"status,omitempty"`     // 容器状态
+	Pid          string          `json:"pid,omitempty"`         // 容器在宿主机上的Pid
+	Id           string          `json:"id,omitempty"`          // 容器id
+	Name         string          `json:"name,omitempty"`        // 容器名
+	Command      string          `json:"command,omitempty"`     // 容器内init进程的运行命令
+	VolumePaths  []string        `json:"volumePaths"`           // 挂载的数据卷
+	CgroupPath   string          `json:"cgroupPath"`            // cgroup路径(相对于hierarchy根目录)
+	ImageName    string          `json:"imageName"`             // image名称
+	ImageID      string          `json:"imageId,omitempty"`     // 镜像id
+	NetworkName  string          `json:"networkName"`           // 网络名称
+	PortMappings [][]string      `json:"portMappings"`          // 端口映射
+	IPAddress    string          `json:"ipAddress,omitempty"`   // 容器在网络中的ip
+	Hostname     string          `json:"hostname,omitempty"`    // 主机名
+	CreateTime   string          `json:"createTime,omitempty"`  // 创建时间
+	Status       string          `json:"status,omitempty"`      // 容器状态
+	OOMKilled    bool            `json:"oomKilled"`             // 容器内是否有进程因oom被杀死
+	OOMCount     uint64          `json:"oomCount"`              // 达到内存上限触发oom的次数
+	OOMKillCount uint64          `json:"oomKillCount"`          // 因oom被杀死的进程数
+	MemPressure  bool            `json:"memPressure"`           // 是否处于内存压力之下
+	UidMappings  []userns.IDMap  `json:"uidMappings,omitempty"` // user namespace的uid映射
+	GidMappings  []userns.IDMap  `json:"gidMappings,omitempty"` // user namespace的gid映射
+	Security     *SecurityConfig `json:"security,omitempty"`    // 安全配置，exec进入容器时同样应用
+}
+
+/*
+UnmarshalJSON 兼容之前保存的容器信息，cgroup路径原来保存在cgroup2Path字段中(cgroup v2下的绝对路径)
+*/
+func (info *Info) UnmarshalJSON(data []byte) error {
+	type plainInfo Info
+	aux := struct {
+		*plainInfo
+		Cgroup2Path string `json:"cgroup2Path"`
+	}{plainInfo: (*plainInfo)(info)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if info.CgroupPath == "" {
+		info.CgroupPath = aux.Cgroup2Path
+	}
+	return nil
 }
 
 /*
 NewParentProcessCmd 生成父进程启动命令，也即是容器 /proc/self/exe init [command]
+uidMaps、gidMaps不为空时(userns-remap)容器运行在独立的user namespace中
 */
-func NewParentProcessCmd(it bool, envs []string, containerName string) (*exec.Cmd, *os.File, error) {
+func NewParentProcessCmd(it bool, envs []string, containerName string, uidMaps []userns.IDMap, gidMaps []userns.IDMap) (*exec.Cmd, *os.File, error) {
 	readPipe, writePipe, err := os.Pipe()
 	if err != nil {
 		return nil, nil, fmt.Errorf("os.Pipe err: %v", err)
@@ -36,13 +67,22 @@ func NewParentProcessCmd(it bool, envs []string, containerName string) (*exec.Cm
 	init.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET,
 	}
+	// rootless: 创建user namespace，uid/gid映射由父进程在启动后通过newuidmap/newgidmap写入
+	if path.Rootless() {
+		init.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	} else if len(uidMaps) > 0 { // userns-remap: root可以直接写入任意映射
+		init.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		init.SysProcAttr.UidMappings = userns.ToSysProcIDMap(uidMaps)
+		init.SysProcAttr.GidMappings = userns.ToSysProcIDMap(gidMaps)
+		init.SysProcAttr.GidMappingsEnableSetgroups = true
+	}
 	if it { // 前台运行
 		init.Stdin = os.Stdin
 		init.Stdout = os.Stdout
 		init.Stderr = os.Stderr
 	} else { // 后台运行
 		// 生成容器对应的log文件
-		if err := os.MkdirAll(path.ContainerInfoPath(containerName), 0622); err != nil {
+		if err := os.MkdirAll(path.ContainerInfoPath(containerName), 0755); err != nil {
 			return nil, nil, fmt.Errorf("os.MkdirAll err: %v", err)
 		}
 		logPath := path.LogPath(containerName)
@@ -0,0 +1,92 @@
+package container
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// --ulimit支持的资源，与docker一致
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+/*
+Rlimit 容器进程的资源限制
+*/
+type Rlimit struct {
+	Name string `json:"name"` // 资源名称，例如nofile
+	Soft uint64 `json:"soft"` // 软限制
+	Hard uint64 `json:"hard"` // 硬限制
+}
+
+/*
+ParseUlimit 解析--ulimit <name>=<soft>[:<hard>]，没有指定硬限制时与软限制相同，-1表示不限制
+*/
+func ParseUlimit(spec string) (*Rlimit, error) {
+	name, value, found := strings.Cut(spec, "=")
+	if !found {
+		return nil, fmt.Errorf("invalid ulimit: %s", spec)
+	}
+	if _, ok := rlimitResources[name]; !ok {
+		return nil, fmt.Errorf("unknown ulimit type: %s", name)
+	}
+	softValue, hardValue, found := strings.Cut(value, ":")
+	if !found {
+		hardValue = softValue
+	}
+	soft, err := parseRlimitValue(softValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ulimit: %s", spec)
+	}
+	hard, err := parseRlimitValue(hardValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ulimit: %s", spec)
+	}
+	if soft > hard {
+		return nil, fmt.Errorf("ulimit soft limit must be less than or equal to hard limit: %s", spec)
+	}
+	return &Rlimit{Name: name, Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimitValue(value string) (uint64, error) {
+	if value == "-1" || value == "unlimited" {
+		return unix.RLIM_INFINITY, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+/*
+setRlimits 设置当前进程的资源限制，execve之后保持不变
+使用syscall.Setrlimit，go运行时才不会在execve之前恢复启动时的nofile
+*/
+func setRlimits(rlimits []*Rlimit) error {
+	for _, rlimit := range rlimits {
+		resource, ok := rlimitResources[rlimit.Name]
+		if !ok {
+			return fmt.Errorf("unknown ulimit type: %s", rlimit.Name)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}); err != nil {
+			return fmt.Errorf("syscall.Setrlimit %s err: %v", rlimit.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// 解析路径时最多跟随的符号链接数，与内核的限制一致
+	maxSymlinks = 40
+)
+
+/*
+secureJoin 计算容器内路径在rootfs下的位置，逐级解析符号链接，符号链接按容器的根目录解释，
+..不会超出rootfs，与github.com/cyphar/filepath-securejoin一致
+pivot_root之前镜像中的符号链接(例如/etc -> /host/path)会指向宿主机，rootfs下的路径都需要这样计算
+*/
+func secureJoin(rootfs string, unsafePath string) (string, error) {
+	current := "/"
+	links := 0
+	for remaining := unsafePath; remaining != ""; {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, part)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// 不存在的部分不会有符号链接，剩下的路径按字面拼接
+				current = next
+				continue
+			}
+			return "", fmt.Errorf("os.Lstat err: %v", err)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("resolve %s err: %v", unsafePath, syscall.ELOOP)
+		}
+		dest, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", fmt.Errorf("os.Readlink err: %v", err)
+		}
+		if filepath.IsAbs(dest) {
+			current = "/"
+		}
+		remaining = dest + "/" + remaining
+	}
+	return filepath.Join(rootfs, current), nil
+}
+
+/*
+secureJoinParent 与secureJoin相同，但不解析最后一级，用于需要替换最后一级(符号链接、已存在的设备)的场景
+*/
+func secureJoinParent(rootfs string, unsafePath string) (string, error) {
+	unsafePath = filepath.Clean("/" + unsafePath)
+	if unsafePath == "/" {
+		return rootfs, nil
+	}
+	parent, err := secureJoin(rootfs, filepath.Dir(unsafePath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(unsafePath)), nil
+}
+
+/*
+bindMountFd 把source绑定挂载到已打开的文件上，通过/proc/self/fd挂载，不会再次解析路径中的符号链接
+*/
+func bindMountFd(source string, target *os.File) error {
+	return syscall.Mount(source, fmt.Sprintf("/proc/self/fd/%d", target.Fd()), "", syscall.MS_BIND, "")
+}
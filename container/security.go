@@ -0,0 +1,128 @@
+package container
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"mydocker/capabilities"
+	"mydocker/seccomp"
+)
+
+/*
+SecurityConfig 容器进程的安全配置，init进程和exec进入容器的进程都会应用
+*/
+type SecurityConfig struct {
+	Privileged      bool              `json:"privileged"`              // 特权模式
+	Capabilities    *capabilities.Set `json:"capabilities"`            // capability集合
+	Seccomp         *seccomp.Profile  `json:"seccomp"`                 // seccomp配置，为空时不限制系统调用
+	User            string            `json:"user,omitempty"`          // 运行用户命令的用户 uid[:gid]或name[:group]
+	GroupAdd        []string          `json:"groupAdd,omitempty"`      // 附加组
+	NoNewPrivileges bool              `json:"noNewPrivileges"`         // 禁止execve获得新的权限(setuid、文件capability)
+	MaskedPaths     []string          `json:"maskedPaths,omitempty"`   // 容器内屏蔽的路径
+	ReadonlyPaths   []string          `json:"readonlyPaths,omitempty"` // 容器内只读的路径
+}
+
+/*
+ParseSecurityOpts 解析--security-opt，需要在设置Privileged和Capabilities之后调用
+seccomp=<profile.json>|unconfined，未指定时使用内置的默认配置，特权容器默认不启用seccomp
+no-new-privileges[=true|false]，默认开启
+unmask=ALL|<path1>:<path2>，取消默认的屏蔽和只读路径，特权容器不屏蔽任何路径
+*/
+func ParseSecurityOpts(opts []string, config *SecurityConfig) error {
+	seccompOpt := ""
+	var unmask []string
+	config.NoNewPrivileges = true
+	for _, opt := range opts {
+		key, value, found := strings.Cut(opt, "=")
+		if !found {
+			// 兼容docker旧的key:value格式
+			key, value, found = strings.Cut(opt, ":")
+		}
+		if !found && opt == "no-new-privileges" {
+			key, value, found = opt, "true", true
+		}
+		if !found {
+			return fmt.Errorf("invalid security option: %s", opt)
+		}
+		switch key {
+		case "seccomp":
+			seccompOpt = value
+		case "no-new-privileges":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid security option: %s", opt)
+			}
+			config.NoNewPrivileges = enabled
+		case "unmask":
+			unmask = append(unmask, value)
+		default:
+			return fmt.Errorf("unknown security option: %s", opt)
+		}
+	}
+	switch {
+	case seccompOpt == seccomp.Unconfined:
+		config.Seccomp = nil
+	case seccompOpt != "":
+		profile, err := seccomp.LoadProfile(seccompOpt)
+		if err != nil {
+			return fmt.Errorf("seccomp.LoadProfile err: %v", err)
+		}
+		config.Seccomp = profile
+	case !config.Privileged:
+		profile, err := seccomp.DefaultProfile()
+		if err != nil {
+			return fmt.Errorf("seccomp.DefaultProfile err: %v", err)
+		}
+		config.Seccomp = profile
+	}
+	if !config.Privileged {
+		config.MaskedPaths, config.ReadonlyPaths = unmaskPaths(unmask)
+	}
+	return nil
+}
+
+/*
+applySecurity 在execve之前应用安全配置，必须在锁定的线程上调用
+ 1. 在容器rootfs中解析用户
+ 2. 设置no_new_privs
+ 3. 切换用户，删除不需要的capability
+ 4. 安装seccomp，之后只剩下execve，避免过滤器影响前面的设置
+
+没有no_new_privs时内核要求安装seccomp的进程拥有CAP_SYS_ADMIN，此时在切换用户和删除capability之前安装
+*/
+func applySecurity(config *SecurityConfig) error {
+	user, err := resolveUser(config.User, config.GroupAdd)
+	if err != nil {
+		return fmt.Errorf("resolveUser err: %v", err)
+	}
+	var caps []string
+	if config.Capabilities != nil {
+		caps = config.Capabilities.Effective
+	}
+	if config.NoNewPrivileges {
+		if err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("prctl PR_SET_NO_NEW_PRIVS err: %v", err)
+		}
+	} else if config.Seccomp != nil {
+		if err = seccomp.Install(config.Seccomp, caps); err != nil {
+			return fmt.Errorf("seccomp.Install err: %v", err)
+		}
+	}
+	if err = setupUser(user); err != nil {
+		return fmt.Errorf("setupUser err: %v", err)
+	}
+	if config.Capabilities != nil {
+		if err = capabilities.Apply(config.Capabilities); err != nil {
+			return fmt.Errorf("capabilities.Apply err: %v", err)
+		}
+	}
+	if config.NoNewPrivileges && config.Seccomp != nil {
+		if err = seccomp.Install(config.Seccomp, caps); err != nil {
+			return fmt.Errorf("seccomp.Install err: %v", err)
+		}
+	}
+	return nil
+}
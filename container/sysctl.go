@@ -0,0 +1,73 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 属于ipc namespace的sysctl
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+/*
+ValidateSysctl 只允许容器有独立namespace的sysctl: ipc相关的kernel.*、fs.mqueue.*和net.*
+主机名、域名由--hostname、--domainname设置
+*/
+func ValidateSysctl(key string) error {
+	switch {
+	case ipcSysctls[key]:
+	case strings.HasPrefix(key, "fs.mqueue."):
+	case strings.HasPrefix(key, "net."):
+	default:
+		return fmt.Errorf("sysctl %s is not namespaced and can not be set in a container", key)
+	}
+	_, err := sysctlPath(key)
+	return err
+}
+
+/*
+sysctlPath 内核参数在/proc/sys下的相对路径，不能包含斜杠，点转换为斜杠后每一级都不能为空，因此不会出现..
+*/
+func sysctlPath(key string) (string, error) {
+	if strings.ContainsRune(key, '/') {
+		return "", fmt.Errorf("invalid sysctl: %s", key)
+	}
+	parts := strings.Split(key, ".")
+	for _, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("invalid sysctl: %s", key)
+		}
+	}
+	return filepath.Join(parts...), nil
+}
+
+/*
+writeSysctls 写入rootfs/proc/sys，需要在/proc/sys重新挂载为只读之前调用
+写入之前再次校验，只允许有独立namespace的sysctl，路径不能超出/proc/sys
+*/
+func writeSysctls(rootfs string, sysctls map[string]string) error {
+	for key, value := range sysctls {
+		if err := ValidateSysctl(key); err != nil {
+			return err
+		}
+		rel, err := sysctlPath(key)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(rootfs, "proc", "sys", rel)
+		if err = os.WriteFile(file, []byte(value), 0644); err != nil {
+			return fmt.Errorf("write sysctl %s err: %v", key, err)
+		}
+	}
+	return nil
+}
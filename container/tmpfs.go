@@ -0,0 +1,85 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// --tmpfs的挂载选项中对应挂载标志的部分，其余选项(size、mode等)作为tmpfs的参数
+var tmpfsFlagOptions = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":      {false, syscall.MS_RDONLY},
+	"rw":      {true, syscall.MS_RDONLY},
+	"nosuid":  {false, syscall.MS_NOSUID},
+	"suid":    {true, syscall.MS_NOSUID},
+	"nodev":   {false, syscall.MS_NODEV},
+	"dev":     {true, syscall.MS_NODEV},
+	"noexec":  {false, syscall.MS_NOEXEC},
+	"exec":    {true, syscall.MS_NOEXEC},
+	"noatime": {false, syscall.MS_NOATIME},
+	"atime":   {true, syscall.MS_NOATIME},
+}
+
+/*
+TmpfsMount --tmpfs指定的挂载
+*/
+type TmpfsMount struct {
+	Destination string  `json:"destination"` // 容器内路径
+	Flags       uintptr `json:"flags"`       // 挂载标志
+	Data        string  `json:"data"`        // tmpfs参数，例如size=64m,mode=1777
+}
+
+/*
+ParseTmpfs 解析--tmpfs <path>[:<options>]，与docker一致默认为noexec,nosuid,nodev
+*/
+func ParseTmpfs(spec string) (*TmpfsMount, error) {
+	destination, options, _ := strings.Cut(spec, ":")
+	if !filepath.IsAbs(destination) {
+		return nil, fmt.Errorf("invalid tmpfs destination: %s", spec)
+	}
+	mount := &TmpfsMount{
+		Destination: filepath.Clean(destination),
+		Flags:       syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV,
+	}
+	var data []string
+	for _, option := range strings.Split(options, ",") {
+		if option == "" {
+			continue
+		}
+		if f, ok := tmpfsFlagOptions[option]; ok {
+			if f.clear {
+				mount.Flags &^= f.flag
+			} else {
+				mount.Flags |= f.flag
+			}
+			continue
+		}
+		data = append(data, option)
+	}
+	mount.Data = strings.Join(data, ",")
+	return mount, nil
+}
+
+/*
+mountTmpfs 在rootfs下挂载tmpfs，需要在pivot_root之前调用，挂载点在rootfs中解析，镜像中的符号链接不会指向宿主机
+*/
+func mountTmpfs(rootfs string, mounts []*TmpfsMount) error {
+	for _, m := range mounts {
+		target, err := secureJoin(rootfs, m.Destination)
+		if err != nil {
+			return fmt.Errorf("secureJoin err: %v", err)
+		}
+		if err = os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+		if err = syscall.Mount("tmpfs", target, "tmpfs", m.Flags, m.Data); err != nil {
+			return fmt.Errorf("mount tmpfs %s err: %v", m.Destination, err)
+		}
+	}
+	return nil
+}
@@ -5,29 +5,38 @@ import (
 	"os"
 	"os/exec"
 	path2 "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"mydocker/path"
+	"mydocker/userns"
 
 	log "github.com/sirupsen/logrus"
 )
 
 /*
 NewRunningSpace 创建容器运行时文件系统
-unionPath: 容器运行联合文件系统
+lowerDirs: 镜像各层解压后的目录(从顶层到底层)，多个容器共享，作为overlay的只读层
 mntPath: Union File System挂载点
-busyboxTarPath: tar文件路径
 */
-func NewRunningSpace(imageName string, containerName string, volumePaths []string) (error, func()) {
+func NewRunningSpace(lowerDirs []string, containerName string, volumePaths []string, uidMaps []userns.IDMap, gidMaps []userns.IDMap) (error, func()) {
 	containerUnionPath := path.ContainerUnionPath(containerName)
-	lowerPath := path.LowerPath(containerName)
 	upperPath := path.UpperPath(containerName)
 	workerPath := path.WorkerPath(containerName)
 	mntPath := path.MntPath(containerName)
 	clearFunc := func() {
 		DeleteRunningSpace(containerUnionPath, mntPath, volumePaths)
 	}
-	if err := createLowerLayer(lowerPath, path.ImagePath(imageName)); err != nil {
-		return fmt.Errorf("createLowerLayer err: %v", err), clearFunc
+	// overlay至少需要一个lowerdir，没有层的镜像使用容器自己的空目录
+	if len(lowerDirs) == 0 {
+		if err := os.MkdirAll(path.LowerPath(containerName), 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err), clearFunc
+		}
+	}
+	if err := createLayerLinks(containerName, lowerDirs); err != nil {
+		return fmt.Errorf("createLayerLinks err: %v", err), clearFunc
 	}
 	if err := createUpperLayer(upperPath); err != nil {
 		return fmt.Errorf("createUpperLayer err: %v", err), clearFunc
@@ -35,10 +44,20 @@ func NewRunningSpace(imageName string, containerName string, volumePaths []strin
 	if err := createWorkerLayer(workerPath); err != nil {
 		return fmt.Errorf("createWorkerLayer err: %v", err), clearFunc
 	}
+	// userns-remap: 可写层的根目录属于容器root
+	if len(uidMaps) > 0 && !path.Rootless() {
+		if err := chownToContainerRoot(uidMaps, gidMaps, upperPath, workerPath); err != nil {
+			return fmt.Errorf("chownToContainerRoot err: %v", err), clearFunc
+		}
+	}
 	if err := createMntPath(mntPath); err != nil {
 		return fmt.Errorf("createMntPath err: %v", err), clearFunc
 	}
-	if err := execMountPoint(lowerPath, upperPath, workerPath, mntPath); err != nil {
+	// rootless模式下由容器init进程在自己的user namespace中挂载，见RootfsConfig
+	if path.Rootless() {
+		return nil, clearFunc
+	}
+	if err := execMountPoint(containerUnionPath, LowerDir(containerName, lowerDirs), upperPath, workerPath, mntPath); err != nil {
 		return fmt.Errorf("CreateMountPoint err: %v", err), clearFunc
 	}
 	if err := execMountVolume(mntPath, volumePaths); err != nil {
@@ -48,15 +67,64 @@ func NewRunningSpace(imageName string, containerName string, volumePaths []strin
 	return nil, clearFunc
 }
 
+/*
+LowerDir overlay的lowerdir选项，多个只读层用冒号连接，左边的层在上面
+使用容器目录下指向各层的短符号链接的相对路径，挂载时需要在容器目录下，
+层目录的绝对路径较长，几十层就会超过挂载选项一页的长度限制
+*/
+func LowerDir(containerName string, lowerDirs []string) string {
+	unionPath := path.ContainerUnionPath(containerName)
+	if len(lowerDirs) == 0 {
+		lower, _ := filepath.Rel(unionPath, path.LowerPath(containerName))
+		return lower
+	}
+	links, _ := filepath.Rel(unionPath, path.LayerLinksPath(containerName))
+	names := make([]string, 0, len(lowerDirs))
+	for i := range lowerDirs {
+		names = append(names, filepath.Join(links, strconv.Itoa(i)))
+	}
+	return strings.Join(names, ":")
+}
+
+/*
+createLayerLinks 在容器目录下创建指向镜像各层的符号链接，按从顶层到底层编号
+*/
+func createLayerLinks(containerName string, lowerDirs []string) error {
+	links := path.LayerLinksPath(containerName)
+	if err := os.MkdirAll(links, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	for i, dir := range lowerDirs {
+		if err := os.Symlink(dir, filepath.Join(links, strconv.Itoa(i))); err != nil {
+			return fmt.Errorf("os.Symlink err: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+overlayOptions overlay的挂载选项，挂载参数不能超过一页，超过时内核返回难以理解的EINVAL，提前报错
+*/
+func overlayOptions(lowerDir string, upperDir string, workDir string) (string, error) {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir)
+	if len(options) >= os.Getpagesize() {
+		return "", fmt.Errorf("too many image layers: overlay mount options are %d bytes, the limit is %d", len(options), os.Getpagesize()-1)
+	}
+	return options, nil
+}
+
 /*
 DeleteRunningSpace 删除容器运行时文件系统，退出容器
 */
 func DeleteRunningSpace(containerUnionPath, mntPath string, volumePaths []string) {
-	if err := deleteMountVolume(mntPath, volumePaths); err != nil {
-		log.Errorf("deleteMountVolume err: %v", err)
-	}
-	if err := deleteMountPoint(mntPath); err != nil {
-		log.Errorf("deleteMountPoint err: %v", err)
+	// rootless模式下的挂载点只存在于容器的mount namespace中，随容器退出自动卸载
+	if !path.Rootless() {
+		if err := deleteMountVolume(mntPath, volumePaths); err != nil {
+			log.Errorf("deleteMountVolume err: %v", err)
+		}
+		if err := deleteMountPoint(mntPath); err != nil {
+			log.Errorf("deleteMountPoint err: %v", err)
+		}
 	}
 	if err := deleteMntPath(mntPath); err != nil {
 		log.Errorf("deleteMntPath err: %v", err)
@@ -67,20 +135,20 @@ func DeleteRunningSpace(containerUnionPath, mntPath string, volumePaths []string
 }
 
 /*
-createLowerLayer 创建只读层lower
+chownToContainerRoot 把目录的属主设置为容器root在宿主机上对应的用户
 */
-func createLowerLayer(lowerPath string, imagePath string) error {
-	exist, err := pathExist(lowerPath)
-	if err != nil {
-		return fmt.Errorf("pathExist err: %v", err)
+func chownToContainerRoot(uidMaps []userns.IDMap, gidMaps []userns.IDMap, dirs ...string) error {
+	uid, ok := userns.ToHost(0, uidMaps)
+	if !ok {
+		return fmt.Errorf("container root is not mapped")
 	}
-	if !exist {
-		// 解压到busyboxUrl
-		if err = os.MkdirAll(lowerPath, 0777); err != nil {
-			return fmt.Errorf("os.Mkdir err: %v", err)
-		}
-		if _, err = exec.Command("tar", "-xvf", imagePath, "-C", lowerPath).CombinedOutput(); err != nil {
-			return fmt.Errorf("exec.Command.CombinedOutput err: %v", err)
+	gid, ok := userns.ToHost(0, gidMaps)
+	if !ok {
+		return fmt.Errorf("container root group is not mapped")
+	}
+	for _, dir := range dirs {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("os.Chown err: %v", err)
 		}
 	}
 	return nil
@@ -117,12 +185,16 @@ func createMntPath(mntPath string) error {
 }
 
 /*
-execMountPoint 挂载overlay文件系统
+execMountPoint 挂载overlay文件系统，lowerPath是相对容器目录unionPath的路径
 */
-func execMountPoint(lowerPath string, upperPath string, workerPath string, mntPath string) error {
+func execMountPoint(unionPath string, lowerPath string, upperPath string, workerPath string, mntPath string) error {
+	options, err := overlayOptions(lowerPath, upperPath, workerPath)
+	if err != nil {
+		return err
+	}
 	// 挂载到mnt路径下
-	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o",
-		fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerPath, upperPath, workerPath), mntPath)
+	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, mntPath)
+	cmd.Dir = unionPath
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -131,6 +203,52 @@ func execMountPoint(lowerPath string, upperPath string, workerPath string, mntPa
 	return nil
 }
 
+/*
+mountRootfs rootless模式下在容器的user namespace中挂载overlay和数据卷，并进入挂载后的目录
+优先使用内核overlay(5.11以上支持在user namespace中挂载，需要userxattr选项)，失败则回退到fuse-overlayfs
+*/
+func mountRootfs(rootfs *RootfsConfig) error {
+	options, err := overlayOptions(rootfs.LowerDir, rootfs.UpperDir, rootfs.WorkDir)
+	if err != nil {
+		return err
+	}
+	// lowerdir是相对容器目录的路径
+	if err = syscall.Chdir(rootfs.Dir); err != nil {
+		return fmt.Errorf("syscall.Chdir err: %v", err)
+	}
+	if err := syscall.Mount("overlay", rootfs.MntPath, "overlay", 0, options+",userxattr"); err != nil {
+		log.Warnf("mount overlay in user namespace err: %v, fallback to fuse-overlayfs", err)
+		fuseOverlayfs, lookErr := exec.LookPath("fuse-overlayfs")
+		if lookErr != nil {
+			return fmt.Errorf("mount overlay err: %v, and fuse-overlayfs not found", err)
+		}
+		cmd := exec.Command(fuseOverlayfs, "-o", options, rootfs.MntPath)
+		cmd.Dir = rootfs.Dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("fuse-overlayfs err: %v", err)
+		}
+	}
+	if len(rootfs.VolumePaths) == 2 {
+		containerVolumePath := path2.Join(rootfs.MntPath, rootfs.VolumePaths[1])
+		if err := os.MkdirAll(rootfs.VolumePaths[0], 0777); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+		if err := os.MkdirAll(containerVolumePath, 0777); err != nil {
+			return fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+		if err := syscall.Mount(rootfs.VolumePaths[0], containerVolumePath, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("syscall.Mount err: %v", err)
+		}
+	}
+	// 当前工作目录是挂载之前的mnt目录，需要重新进入才能看到挂载后的文件系统
+	if err := syscall.Chdir(rootfs.MntPath); err != nil {
+		return fmt.Errorf("syscall.Chdir err: %v", err)
+	}
+	return nil
+}
+
 /*
 execMountVolume 挂载数据卷
 */
@@ -0,0 +1,248 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 容器rootfs中的用户和组数据库，pivot_root之后读取
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+/*
+execUser 解析后的容器进程用户
+*/
+type execUser struct {
+	Uid   int
+	Gid   int
+	Sgids []int // 附加组
+}
+
+type passwdEntry struct {
+	Name string
+	Uid  int
+	Gid  int
+}
+
+type groupEntry struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+/*
+resolveUser 在容器rootfs中解析--user uid[:gid]|name[:group]和--group-add
+数字形式的uid、gid可以不在/etc/passwd、/etc/group中，名称必须存在
+附加组包括/etc/group中该用户所属的组和--group-add指定的组
+*/
+func resolveUser(spec string, groupAdd []string) (*execUser, error) {
+	passwds, err := parsePasswdFile(passwdFile)
+	if err != nil {
+		return nil, fmt.Errorf("parsePasswdFile err: %v", err)
+	}
+	groups, err := parseGroupFile(groupFile)
+	if err != nil {
+		return nil, fmt.Errorf("parseGroupFile err: %v", err)
+	}
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	if userSpec == "" {
+		userSpec = "0"
+	}
+	user := &execUser{}
+	var userName string
+	var entry *passwdEntry
+	if uid, err := strconv.Atoi(userSpec); err == nil {
+		user.Uid = uid
+		for i := range passwds {
+			if passwds[i].Uid == uid {
+				entry = &passwds[i]
+				break
+			}
+		}
+	} else {
+		for i := range passwds {
+			if passwds[i].Name == userSpec {
+				entry = &passwds[i]
+				break
+			}
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userSpec)
+		}
+		user.Uid = entry.Uid
+	}
+	if entry != nil {
+		userName = entry.Name
+		user.Gid = entry.Gid
+	}
+	if hasGroup && groupSpec != "" {
+		gid, err := lookupGroup(groupSpec, groups)
+		if err != nil {
+			return nil, err
+		}
+		user.Gid = gid
+	}
+	// 只有没有显式指定组时才继承/etc/group中的附加组，与docker一致
+	if !hasGroup && userName != "" {
+		for _, g := range groups {
+			for _, member := range g.Members {
+				if member == userName {
+					user.Sgids = append(user.Sgids, g.Gid)
+					break
+				}
+			}
+		}
+	}
+	for _, name := range groupAdd {
+		gid, err := lookupGroup(name, groups)
+		if err != nil {
+			return nil, err
+		}
+		user.Sgids = append(user.Sgids, gid)
+	}
+	return user, nil
+}
+
+func lookupGroup(spec string, groups []groupEntry) (int, error) {
+	if gid, err := strconv.Atoi(spec); err == nil {
+		return gid, nil
+	}
+	for _, g := range groups {
+		if g.Name == spec {
+			return g.Gid, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to find group %s: no matching entries in group file", spec)
+}
+
+/*
+parsePasswdFile 解析passwd文件，格式: name:password:uid:gid:gecos:home:shell，文件不存在时返回空
+*/
+func parsePasswdFile(file string) ([]passwdEntry, error) {
+	lines, err := readColonFile(file)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]passwdEntry, 0, len(lines))
+	for _, fields := range lines {
+		if len(fields) < 7 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, passwdEntry{Name: fields[0], Uid: uid, Gid: gid})
+	}
+	return entries, nil
+}
+
+/*
+parseGroupFile 解析group文件，格式: name:password:gid:member1,member2，文件不存在时返回空
+*/
+func parseGroupFile(file string) ([]groupEntry, error) {
+	lines, err := readColonFile(file)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]groupEntry, 0, len(lines))
+	for _, fields := range lines {
+		if len(fields) < 4 {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{Name: fields[0], Gid: gid, Members: members})
+	}
+	return entries, nil
+}
+
+func readColonFile(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("os.Open err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	lines := make([][]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Split(line, ":"))
+	}
+	return lines, scanner.Err()
+}
+
+/*
+setupUser 切换到容器用户
+切换uid会清空capability，先设置keepcaps保留permitted，切换后把effective恢复为permitted，再由capabilities.Apply设置最终的capability
+*/
+func setupUser(user *execUser) error {
+	// rootless只映射了当前用户时setgroups被禁用，没有附加组可以跳过
+	if !setgroupsDenied() || len(user.Sgids) > 0 {
+		if err := syscall.Setgroups(user.Sgids); err != nil {
+			return fmt.Errorf("syscall.Setgroups err: %v", err)
+		}
+	}
+	if err := syscall.Setresgid(user.Gid, user.Gid, user.Gid); err != nil {
+		return fmt.Errorf("syscall.Setresgid err: %v", err)
+	}
+	if user.Uid != 0 {
+		if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("prctl PR_SET_KEEPCAPS err: %v", err)
+		}
+		if err := syscall.Setresuid(user.Uid, user.Uid, user.Uid); err != nil {
+			return fmt.Errorf("syscall.Setresuid err: %v", err)
+		}
+		if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+			return fmt.Errorf("prctl PR_SET_KEEPCAPS err: %v", err)
+		}
+		if err := restoreEffectiveCaps(); err != nil {
+			return fmt.Errorf("restoreEffectiveCaps err: %v", err)
+		}
+	}
+	return nil
+}
+
+func setgroupsDenied() bool {
+	content, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(content)) == "deny"
+}
+
+func restoreEffectiveCaps() error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("unix.Capget err: %v", err)
+	}
+	data[0].Effective, data[1].Effective = data[0].Permitted, data[1].Permitted
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("unix.Capset err: %v", err)
+	}
+	return nil
+}
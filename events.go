@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mydocker/container"
+	"mydocker/path"
+)
+
+const (
+	// 事件类型
+	eventOOM            = "oom"
+	eventOOMKill        = "oom-kill"
+	eventMemoryPressure = "memory-pressure"
+)
+
+/*
+Event 容器事件，按行以json格式追加写入事件记录文件
+*/
+type Event struct {
+	Time       string            `json:"time"`
+	Action     string            `json:"action"`
+	Id         string            `json:"id"`
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+/*
+emitEvent 记录容器事件
+*/
+func emitEvent(info *container.Info, action string, attributes map[string]string) error {
+	event := Event{
+		Time:       time.Now().Format("2006-01-02 15:04:05"),
+		Action:     action,
+		Id:         info.Id,
+		Name:       info.Name,
+		Attributes: attributes,
+	}
+	content, err := json.Marshal(&event)
+	if err != nil {
+		return fmt.Errorf("json.Marshal err: %v", err)
+	}
+	eventsPath := path.EventsPath()
+	if err = os.MkdirAll(filepath.Dir(eventsPath), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	file, err := os.OpenFile(eventsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile err: %v", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err = file.Write(append(content, '\n')); err != nil {
+		return fmt.Errorf("file.Write err: %v", err)
+	}
+	return nil
+}
+
+/*
+listEvents 打印记录的容器事件
+*/
+func listEvents() error {
+	file, err := os.Open(path.EventsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.Open err: %v", err)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	if _, err = fmt.Fprintf(writer, "TIME\tACTION\tID\tNAME\tATTRIBUTES\n"); err != nil {
+		return fmt.Errorf("fmt.Fprintf: %v", err)
+	}
+	if file != nil {
+		defer func() {
+			_ = file.Close()
+		}()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event Event
+			if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			attributes := make([]string, 0, len(event.Attributes))
+			for k, v := range event.Attributes {
+				attributes = append(attributes, k+"="+v)
+			}
+			sort.Strings(attributes)
+			_, err = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", event.Time, event.Action, event.Id, event.Name, strings.Join(attributes, ","))
+			if err != nil {
+				return fmt.Errorf("fmt.Fprintf: %v", err)
+			}
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("flush err: %v", err)
+	}
+	return nil
+}
@@ -15,8 +15,10 @@ import (
 )
 
 const (
-	EnvExecPid = "mydocker_pid"
-	EnvExecCmd = "mydocker_cmd"
+	EnvExecPid    = "mydocker_pid"
+	EnvExecCmd    = "mydocker_cmd"
+	EnvExecUserns = "mydocker_userns" // 容器有独立的user namespace时需要先进入user namespace
+	EnvExecConfig = "mydocker_config" // 容器的安全配置
 )
 
 func ExecContainer(containerName string, commandArray []string) error {
@@ -37,6 +39,20 @@ func ExecContainer(containerName string, commandArray []string) error {
 	if err = os.Setenv(EnvExecCmd, cmdStr); err != nil {
 		return fmt.Errorf("os.Setenv err: %v", err)
 	}
+	if len(info.UidMappings) > 0 {
+		if err = os.Setenv(EnvExecUserns, "1"); err != nil {
+			return fmt.Errorf("os.Setenv err: %v", err)
+		}
+	}
+	if info.Security != nil {
+		security, err := json.Marshal(info.Security)
+		if err != nil {
+			return fmt.Errorf("json.Marshal err: %v", err)
+		}
+		if err = os.Setenv(EnvExecConfig, string(security)); err != nil {
+			return fmt.Errorf("os.Setenv err: %v", err)
+		}
+	}
 	envs, err := getEnvsByPid(pid)
 	if err != nil {
 		return fmt.Errorf("getEnvsByPid err: %v", err)
@@ -48,6 +64,25 @@ func ExecContainer(containerName string, commandArray []string) error {
 	return nil
 }
 
+/*
+execCallback nsenter进入容器namespace之后再次运行的docker exec，应用安全配置后执行用户命令
+*/
+func execCallback() error {
+	command := os.Getenv(EnvExecCmd)
+	var security *container.SecurityConfig
+	if content := os.Getenv(EnvExecConfig); content != "" {
+		security = &container.SecurityConfig{}
+		if err := json.Unmarshal([]byte(content), security); err != nil {
+			return fmt.Errorf("json.Unmarshal err: %v", err)
+		}
+	}
+	// 用户命令不需要看到mydocker自己的环境变量
+	for _, env := range []string{EnvExecPid, EnvExecCmd, EnvExecUserns, EnvExecConfig} {
+		_ = os.Unsetenv(env)
+	}
+	return container.RunContainerExecProcess(command, security)
+}
+
 func getContainerInfoByName(containerName string) (*container.Info, error) {
 	infoPath := path.InfoPath(containerName)
 	content, err := os.ReadFile(infoPath)
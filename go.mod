@@ -2,12 +2,15 @@ module mydocker
 
 go 1.21
 
+require (
+	github.com/sirupsen/logrus v1.9.3
+	github.com/urfave/cli v1.22.14
+	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netns v0.0.4
+	golang.org/x/sys v0.18.0
+)
+
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	github.com/urfave/cli v1.22.14 // indirect
-	github.com/vishvananda/netlink v1.1.0 // indirect
-	github.com/vishvananda/netns v0.0.4 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 )
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"mydocker/image"
+)
+
+const (
+	// 不使用--no-trunc时CREATED BY显示的最大长度
+	createdByWidth = 45
+)
+
+/*
+historyRow history输出的一行，字段名与--format模板中使用的一致
+*/
+type historyRow struct {
+	ID           string
+	CreatedAt    string
+	CreatedSince string
+	CreatedBy    string
+	Size         string
+	Comment      string
+}
+
+/*
+imageHistory 按从新到旧的顺序列出镜像的构建记录: 产生每一层的命令、层的大小和创建时间
+只有最新的一条记录显示镜像id，之前的中间镜像显示为<missing>
+*/
+func imageHistory(imageName string, noTrunc bool, format string) error {
+	id, img, err := image.Resolve(imageName)
+	if err != nil {
+		return err
+	}
+	var rows []historyRow
+	layer := 0
+	for _, h := range img.History {
+		row := historyRow{CreatedBy: h.CreatedBy, Comment: h.Comment, Size: humanSize(0)}
+		if h.Created != nil {
+			row.CreatedAt, row.CreatedSince = h.Created.Format(time.RFC3339), humanDuration(*h.Created)
+		} else {
+			row.CreatedSince = humanDuration(time.Time{})
+		}
+		if !h.EmptyLayer && layer < len(img.RootFS.DiffIDs) {
+			row.Size = humanSize(layerSize(img.RootFS.DiffIDs[layer]))
+			layer++
+		}
+		rows = append(rows, row)
+	}
+	// 其他工具生成的镜像可能没有构建记录
+	for ; layer < len(img.RootFS.DiffIDs); layer++ {
+		rows = append(rows, historyRow{CreatedSince: humanDuration(time.Time{}), Size: humanSize(layerSize(img.RootFS.DiffIDs[layer]))})
+	}
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+	for i := range rows {
+		rows[i].ID = "<missing>"
+		if i == 0 {
+			rows[i].ID = id.Short()
+			if noTrunc {
+				rows[i].ID = id.String()
+			}
+		}
+		if !noTrunc && len([]rune(rows[i].CreatedBy)) > createdByWidth {
+			rows[i].CreatedBy = string([]rune(rows[i].CreatedBy)[:createdByWidth-1]) + "…"
+		}
+	}
+	if format != "" {
+		tmpl, err := parseFormat(format)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err = executeFormat(tmpl, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	_, err = fmt.Fprintf(writer, "IMAGE\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	if err != nil {
+		return fmt.Errorf("fmt.Fprintf: %v", err)
+	}
+	for _, row := range rows {
+		_, err = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", row.ID, row.CreatedSince, row.CreatedBy, row.Size, row.Comment)
+		if err != nil {
+			return fmt.Errorf("fmt.Fprintf: %v", err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("flush err: %v", err)
+	}
+	return nil
+}
+
+func layerSize(diffID image.Digest) int64 {
+	layer, err := image.GetLayer(diffID)
+	if err != nil {
+		return 0
+	}
+	return layer.Size
+}
@@ -2,42 +2,160 @@ package main
 
 import (
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"mydocker/image"
 	"mydocker/path"
 )
 
+/*
+imageRow images输出的一行
+*/
+type imageRow struct {
+	repository string
+	tag        string
+	id         image.Digest
+	created    time.Time
+	size       int64
+}
+
+/*
+listImages 列出镜像存储中的镜像，每个引用一行，没有名称的镜像显示为<none>
+还没有导入镜像存储的镜像tar包先导入
+*/
 func listImages() error {
-	storagePath := path.ImageStoragePath()
-	imageNames := make([]string, 0)
-	err := filepath.Walk(storagePath, func(path string, info fs.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+	if err := importLegacyImages(); err != nil {
+		return fmt.Errorf("importLegacyImages err: %v", err)
+	}
+	ids, err := image.ListIDs()
+	if err != nil {
+		return fmt.Errorf("image.ListIDs err: %v", err)
+	}
+	references, err := image.References()
+	if err != nil {
+		return fmt.Errorf("image.References err: %v", err)
+	}
+	var rows []imageRow
+	for _, id := range ids {
+		img, err := image.Get(id)
+		if err != nil {
+			return fmt.Errorf("image.Get err: %v", err)
+		}
+		row := imageRow{repository: "<none>", tag: "<none>", id: id, size: img.Size()}
+		if img.Created != nil {
+			row.created = *img.Created
 		}
-		var name string
-		if len(info.Name()) > 4 && info.Name()[len(info.Name())-4:] == ".tar" {
-			name = info.Name()[:len(info.Name())-4]
-		} else {
-			name = info.Name()
+		refs := references[id]
+		if len(refs) == 0 {
+			rows = append(rows, row)
 		}
-		imageNames = append(imageNames, name)
-		return nil
+		for _, ref := range refs {
+			// 只按摘要引用时标签显示为<none>
+			row.repository, row.tag = ref.Repository, ref.Tag
+			if ref.Tag == "" {
+				row.tag = "<none>"
+			}
+			rows = append(rows, row)
+		}
+	}
+	// 新创建的镜像在前
+	sort.SliceStable(rows, func(i, j int) bool {
+		if !rows[i].created.Equal(rows[j].created) {
+			return rows[i].created.After(rows[j].created)
+		}
+		return rows[i].repository+":"+rows[i].tag < rows[j].repository+":"+rows[j].tag
 	})
+	writer := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	// 控制台输出的信息列
+	_, err = fmt.Fprintf(writer, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
 	if err != nil {
-		return fmt.Errorf("filepath.Walk err: %v", err)
+		return fmt.Errorf("fmt.Fprintf: %v", err)
 	}
-	var res string
-	for _, name := range imageNames {
-		res += name + " "
+	for _, row := range rows {
+		_, err = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", row.repository, row.tag, row.id.Short(), humanDuration(row.created), humanSize(row.size))
+		if err != nil {
+			return fmt.Errorf("fmt.Fprintf: %v", err)
+		}
 	}
-	res = res[:len(res)-1]
-	// 控制台输出的信息列
-	_, err = os.Stdout.Write([]byte(res))
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("flush err: %v", err)
+	}
+	return nil
+}
+
+/*
+importLegacyImages 导入数据根目录下的镜像tar包
+*/
+func importLegacyImages() error {
+	entries, err := os.ReadDir(path.ImageStoragePath())
 	if err != nil {
-		return fmt.Errorf("os.Stdout.Write err: %v", err)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("os.ReadDir err: %v", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".tar")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, ok = image.LegacyName(name); !ok {
+			continue
+		}
+		if _, _, err = image.Resolve(name); err != nil {
+			return fmt.Errorf("import %s err: %v", filepath.Join(path.ImageStoragePath(), entry.Name()), err)
+		}
 	}
-	_ = os.Stdout.Close()
 	return nil
 }
+
+/*
+humanDuration 距现在的时间，例如2 hours ago
+*/
+func humanDuration(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "Less than a minute ago"
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute")
+	case d < 48*time.Hour:
+		return plural(int(d.Hours()), "hour")
+	case d < 14*24*time.Hour:
+		return plural(int(d.Hours()/24), "day")
+	case d < 60*24*time.Hour:
+		return plural(int(d.Hours()/24/7), "week")
+	case d < 365*24*time.Hour:
+		return plural(int(d.Hours()/24/30), "month")
+	}
+	return plural(int(d.Hours()/24/365), "year")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s ago", unit)
+	}
+	return fmt.Sprintf("%d %ss ago", n, unit)
+}
+
+/*
+humanSize 十进制单位的大小，例如4.2MB
+*/
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
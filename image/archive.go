@@ -0,0 +1,269 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"mydocker/path"
+)
+
+const (
+	// 层tar包中的whiteout文件，表示删除下层的同名文件
+	whiteoutPrefix = ".wh."
+	// 层tar包中的opaque标记，表示目录不继承下层的内容
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// tar包PAX头中扩展属性的前缀
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+/*
+Extract 把层tar包解压到dest，返回普通文件的总大小
+whiteout文件转换为overlay的格式: .wh.<name>转为0/0字符设备，.wh..wh..opq转为目录的opaque扩展属性
+rootless模式下不能修改属主、创建设备节点，忽略这些错误
+*/
+func Extract(r io.Reader, dest string) (int64, error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	var (
+		size int64
+		// 目录的权限和修改时间在最后设置，否则只读目录中无法创建文件，创建文件也会改变目录的修改时间
+		dirs []*tar.Header
+	)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("tr.Next err: %v", err)
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		target, err := securePath(dest, name)
+		if err != nil {
+			return 0, err
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return 0, fmt.Errorf("os.MkdirAll err: %v", err)
+		}
+		base := filepath.Base(name)
+		if base == whiteoutOpaqueDir {
+			if err = setOpaque(filepath.Dir(target)); err != nil {
+				return 0, fmt.Errorf("setOpaque err: %v", err)
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whiteout := filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, whiteoutPrefix))
+			if err = createWhiteout(whiteout); err != nil {
+				return 0, fmt.Errorf("createWhiteout err: %v", err)
+			}
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+				_ = os.RemoveAll(target)
+				if err = os.Mkdir(target, 0755); err != nil {
+					return 0, fmt.Errorf("os.Mkdir err: %v", err)
+				}
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			n, err := writeFile(target, tr)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+		case tar.TypeSymlink:
+			_ = os.RemoveAll(target)
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return 0, fmt.Errorf("os.Symlink err: %v", err)
+			}
+		case tar.TypeLink:
+			source, err := securePath(dest, filepath.Clean("/"+hdr.Linkname))
+			if err != nil {
+				return 0, err
+			}
+			_ = os.RemoveAll(target)
+			if err = os.Link(source, target); err != nil {
+				return 0, fmt.Errorf("os.Link err: %v", err)
+			}
+			// 硬链接与源文件共享属性，不需要再设置
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			_ = os.RemoveAll(target)
+			mode := uint32(hdr.Mode & 07777)
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				mode |= syscall.S_IFCHR
+			case tar.TypeBlock:
+				mode |= syscall.S_IFBLK
+			default:
+				mode |= syscall.S_IFIFO
+			}
+			err = syscall.Mknod(target, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+			if err == syscall.EPERM && path.Rootless() {
+				log.Warnf("skip device %s in rootless mode", name)
+				continue
+			}
+			if err != nil {
+				return 0, fmt.Errorf("syscall.Mknod err: %v", err)
+			}
+		default:
+			log.Warnf("skip unsupported tar entry %s, type %c", name, hdr.Typeflag)
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err = setAttributes(target, hdr); err != nil {
+				return 0, fmt.Errorf("setAttributes %s err: %v", name, err)
+			}
+		}
+	}
+	// 从深到浅设置目录属性
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, _ := securePath(dest, filepath.Clean("/"+dirs[i].Name))
+		if err := setAttributes(target, dirs[i]); err != nil {
+			return 0, fmt.Errorf("setAttributes %s err: %v", dirs[i].Name, err)
+		}
+	}
+	return size, nil
+}
+
+/*
+securePath 计算tar包中的路径在dest下的位置，上级路径中不能有符号链接，防止通过符号链接写到dest之外
+*/
+func securePath(dest string, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if name == "/" {
+		return target, nil
+	}
+	current := dest
+	for _, part := range strings.Split(strings.TrimPrefix(filepath.Dir(name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return "", fmt.Errorf("os.Lstat err: %v", err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("invalid tar entry %s: parent is a symlink", name)
+		}
+	}
+	return target, nil
+}
+
+func writeFile(target string, r io.Reader) (int64, error) {
+	_ = os.RemoveAll(target)
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("os.OpenFile err: %v", err)
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		return 0, fmt.Errorf("io.Copy err: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		return 0, fmt.Errorf("f.Close err: %v", err)
+	}
+	return n, nil
+}
+
+/*
+setAttributes 设置属主、权限、扩展属性和修改时间，chown会清除setuid位，需要在chmod之前
+*/
+func setAttributes(target string, hdr *tar.Header) error {
+	if !path.Rootless() {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("os.Lchown err: %v", err)
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, hdr.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("os.Chmod err: %v", err)
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		attr, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			// 普通用户不能设置trusted、security命名空间的扩展属性，文件系统也可能不支持
+			if err != unix.EPERM && err != unix.ENOTSUP {
+				return fmt.Errorf("unix.Lsetxattr err: %v", err)
+			}
+			log.Warnf("skip xattr %s of %s: %v", attr, hdr.Name, err)
+		}
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(accessTime(hdr).UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("unix.UtimesNanoAt err: %v", err)
+	}
+	return nil
+}
+
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+/*
+setOpaque 把目录标记为overlay的opaque目录，rootless模式下overlay使用userxattr选项，标记在user命名空间
+*/
+func setOpaque(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err := unix.Lsetxattr(dir, overlayXattr("opaque"), []byte("y"), 0); err != nil {
+		return fmt.Errorf("unix.Lsetxattr err: %v", err)
+	}
+	return nil
+}
+
+/*
+createWhiteout 创建overlay的whiteout文件(0/0字符设备)，内核5.8之前普通用户不能创建，rootless时忽略
+*/
+func createWhiteout(target string) error {
+	_ = os.RemoveAll(target)
+	err := syscall.Mknod(target, syscall.S_IFCHR, 0)
+	if err == syscall.EPERM && path.Rootless() {
+		log.Warnf("skip whiteout %s in rootless mode", target)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("syscall.Mknod err: %v", err)
+	}
+	return nil
+}
+
+/*
+overlayXattr overlay使用的扩展属性名
+*/
+func overlayXattr(name string) string {
+	if path.Rootless() {
+		return "user.overlay." + name
+	}
+	return "trusted.overlay." + name
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"mydocker/path"
+)
+
+/*
+WriteBlob 把内容按摘要写入blob存储，已存在时直接返回
+*/
+func WriteBlob(content []byte) (Digest, error) {
+	d := FromBytes(content)
+	if blobExist(d) {
+		return d, nil
+	}
+	tmp, err := createTemp()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return "", fmt.Errorf("tmp.Write err: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return "", fmt.Errorf("tmp.Close err: %v", err)
+	}
+	if err = commitBlob(tmp.Name(), d); err != nil {
+		return "", err
+	}
+	return d, nil
+}
+
+/*
+writeBlobFrom 把流写入blob存储，边写边计算摘要，返回摘要和大小
+lease不为空时，在blob写入存储之前把摘要加入租约
+*/
+func writeBlobFrom(r io.Reader, lease *Lease) (Digest, int64, error) {
+	tmp, err := createTemp()
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		_ = tmp.Close()
+		return "", 0, fmt.Errorf("io.Copy err: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return "", 0, fmt.Errorf("tmp.Close err: %v", err)
+	}
+	d := fromHash(h)
+	if err = lease.Add(d); err != nil {
+		return "", 0, err
+	}
+	if err = commitBlob(tmp.Name(), d); err != nil {
+		return "", 0, err
+	}
+	return d, size, nil
+}
+
+/*
+OpenBlob 打开blob
+*/
+func OpenBlob(d Digest) (*os.File, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return os.Open(path.BlobPath(d.Hex()))
+}
+
+func blobExist(d Digest) bool {
+	_, err := os.Stat(path.BlobPath(d.Hex()))
+	return err == nil
+}
+
+/*
+commitBlob 把临时文件重命名为blob，rename是原子的，并发写入同一内容不会互相影响
+*/
+func commitBlob(tmpPath string, d Digest) error {
+	if err := os.MkdirAll(path.BlobsPath(), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return fmt.Errorf("os.Chmod err: %v", err)
+	}
+	if err := os.Rename(tmpPath, path.BlobPath(d.Hex())); err != nil {
+		return fmt.Errorf("os.Rename err: %v", err)
+	}
+	return nil
+}
+
+func createTemp() (*os.File, error) {
+	if err := os.MkdirAll(path.ImageTmpPath(), 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	f, err := os.CreateTemp(path.ImageTmpPath(), "blob-")
+	if err != nil {
+		return nil, fmt.Errorf("os.CreateTemp err: %v", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,83 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"mydocker/path"
+)
+
+/*
+CacheGet 查找构建缓存，缓存的镜像或者它的层已经被删除时视为没有缓存
+*/
+func CacheGet(key Digest) (Digest, bool) {
+	cache, err := readBuildCache()
+	if err != nil {
+		return "", false
+	}
+	id, ok := cache[key]
+	if !ok {
+		return "", false
+	}
+	img, err := Get(id)
+	if err != nil {
+		return "", false
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !LayerExist(diffID) {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+/*
+CacheSet 记录构建步骤产生的镜像
+*/
+func CacheSet(key Digest, id Digest) error {
+	return withLock(func() error {
+		cache, err := readBuildCache()
+		if err != nil {
+			return err
+		}
+		cache[key] = id
+		content, err := json.Marshal(cache)
+		if err != nil {
+			return fmt.Errorf("json.Marshal err: %v", err)
+		}
+		tmp, err := createTemp()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = os.Remove(tmp.Name())
+		}()
+		if _, err = tmp.Write(content); err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("tmp.Write err: %v", err)
+		}
+		if err = tmp.Close(); err != nil {
+			return fmt.Errorf("tmp.Close err: %v", err)
+		}
+		if err = os.Rename(tmp.Name(), path.BuildCachePath()); err != nil {
+			return fmt.Errorf("os.Rename err: %v", err)
+		}
+		return nil
+	})
+}
+
+func readBuildCache() (map[Digest]Digest, error) {
+	cache := make(map[Digest]Digest)
+	content, err := os.ReadFile(path.BuildCachePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	if err = json.Unmarshal(content, &cache); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	return cache, nil
+}
@@ -0,0 +1,165 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ApplyChange 把一条Dockerfile指令应用到镜像配置，commit --change和build使用
+支持CMD、ENTRYPOINT、ENV、EXPOSE、LABEL、USER、WORKDIR
+*/
+func ApplyChange(config *Config, change string) error {
+	instruction, args, _ := strings.Cut(strings.TrimSpace(change), " ")
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return fmt.Errorf("%s requires at least one argument", instruction)
+	}
+	switch strings.ToUpper(instruction) {
+	case "CMD":
+		config.Cmd = ParseCommand(args)
+	case "ENTRYPOINT":
+		config.Entrypoint = ParseCommand(args)
+	case "ENV":
+		pairs, err := parsePairs(args, true)
+		if err != nil {
+			return fmt.Errorf("ENV: %v", err)
+		}
+		for _, pair := range pairs {
+			config.Env = SetEnv(config.Env, pair[0], pair[1])
+		}
+	case "LABEL":
+		pairs, err := parsePairs(args, false)
+		if err != nil {
+			return fmt.Errorf("LABEL: %v", err)
+		}
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		for _, pair := range pairs {
+			config.Labels[pair[0]] = pair[1]
+		}
+	case "EXPOSE":
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			config.ExposedPorts[port] = struct{}{}
+		}
+	case "USER":
+		config.User = args
+	case "WORKDIR":
+		// 相对路径相对于之前的工作目录
+		if !filepath.IsAbs(args) {
+			args = filepath.Join("/", config.WorkingDir, args)
+		}
+		config.WorkingDir = filepath.Clean(args)
+	default:
+		return fmt.Errorf("unsupported change instruction: %s", instruction)
+	}
+	return nil
+}
+
+/*
+ParseCommand 解析CMD、ENTRYPOINT、RUN的参数: JSON数组为exec格式，否则为shell格式，用/bin/sh -c执行
+*/
+func ParseCommand(args string) []string {
+	if strings.HasPrefix(args, "[") {
+		var command []string
+		if err := json.Unmarshal([]byte(args), &command); err == nil {
+			return command
+		}
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+/*
+SetEnv 设置环境变量，已存在时覆盖
+*/
+func SetEnv(envs []string, key string, value string) []string {
+	for i, env := range envs {
+		if k, _, _ := strings.Cut(env, "="); k == key {
+			envs[i] = key + "=" + value
+			return envs
+		}
+	}
+	return append(envs, key+"="+value)
+}
+
+/*
+parsePairs 解析key=value列表，值可以用引号包围，legacy为true时支持ENV key value的旧格式
+*/
+func parsePairs(args string, legacy bool) ([][2]string, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+	if legacy && !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(args, " ")
+		words, err = splitWords(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		return [][2]string{{key, strings.Join(words, " ")}}, nil
+	}
+	pairs := make([][2]string, 0, len(words))
+	for _, word := range words {
+		key, value, found := strings.Cut(word, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid key=value: %s", word)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
+
+/*
+splitWords 按空白分割，支持单引号、双引号和反斜杠转义
+*/
+func splitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in: %s", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,89 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"mydocker/userns"
+)
+
+/*
+CommitOptions 提交容器时记录到镜像中的信息
+*/
+type CommitOptions struct {
+	Author    string
+	Comment   string
+	CreatedBy string   // 产生这一层的命令
+	Changes   []string // 应用到镜像配置的Dockerfile指令
+	// 构建过程中的中间镜像不加入镜像列表，见CreateIntermediate
+	Intermediate bool
+	Lease        *Lease // 新的层加入租约，调用者打标签(中间镜像为构建结束)之后释放，为nil时Commit使用自己的租约
+	UidMaps      []userns.IDMap
+	GidMaps      []userns.IDMap
+}
+
+/*
+Commit 把容器的upper目录作为新的一层加到父镜像之上，返回新镜像的id
+*/
+func Commit(parent Digest, upperDir string, options *CommitOptions) (Digest, error) {
+	parentImg, err := Get(parent)
+	if err != nil {
+		return "", err
+	}
+	img, err := parentImg.Clone()
+	if err != nil {
+		return "", err
+	}
+	for _, change := range options.Changes {
+		if err = ApplyChange(&img.Config, change); err != nil {
+			return "", fmt.Errorf("ApplyChange err: %v", err)
+		}
+	}
+	lease := options.Lease
+	if lease == nil {
+		if lease, err = NewLease(); err != nil {
+			return "", fmt.Errorf("NewLease err: %v", err)
+		}
+		defer lease.Release()
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(WriteDiff(upperDir, pw, options.UidMaps, options.GidMaps))
+	}()
+	layer, err := ImportLayer(pr, lease)
+	_ = pr.Close()
+	if err != nil {
+		return "", fmt.Errorf("ImportLayer err: %v", err)
+	}
+	created := time.Now().UTC()
+	img.Created = &created
+	img.Author = options.Author
+	img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, layer.DiffID)
+	img.History = append(img.History, History{
+		Created:   &created,
+		CreatedBy: options.CreatedBy,
+		Author:    options.Author,
+		Comment:   options.Comment,
+	})
+	if options.Intermediate {
+		return CreateIntermediate(img)
+	}
+	return Create(img)
+}
+
+/*
+Clone 深拷贝镜像配置
+*/
+func (img *Image) Clone() (*Image, error) {
+	content, err := json.Marshal(img)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal err: %v", err)
+	}
+	var res Image
+	if err = json.Unmarshal(content, &res); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,191 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// 压缩格式的文件头
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+const (
+	// 层的压缩方式
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+/*
+ValidateCompression 校验压缩方式，zstd使用宿主机上的zstd命令
+*/
+func ValidateCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip:
+		return nil
+	case CompressionZstd:
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("zstd compression requires the zstd binary: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported compression: %s", compression)
+}
+
+/*
+layerMediaType 压缩方式对应的OCI层媒体类型
+*/
+func layerMediaType(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return MediaTypeLayerGzip
+	case CompressionZstd:
+		return MediaTypeLayerZstd
+	}
+	return MediaTypeLayer
+}
+
+/*
+CompressLayer 把层的tar包压缩到临时文件，返回临时文件和压缩后的描述符，调用方负责删除临时文件
+*/
+func CompressLayer(diffID Digest, compression string) (string, *Descriptor, error) {
+	blob, err := OpenBlob(diffID)
+	if err != nil {
+		return "", nil, fmt.Errorf("OpenBlob err: %v", err)
+	}
+	defer func() {
+		_ = blob.Close()
+	}()
+	tmp, err := createTemp()
+	if err != nil {
+		return "", nil, err
+	}
+	h := sha256.New()
+	counter := &countWriter{w: io.MultiWriter(tmp, h)}
+	err = compressTo(counter, blob, compression)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), &Descriptor{
+		MediaType: layerMediaType(compression),
+		Digest:    fromHash(h),
+		Size:      counter.n,
+	}, nil
+}
+
+func compressTo(w io.Writer, r io.Reader, compression string) error {
+	switch compression {
+	case CompressionGzip:
+		gw := gzip.NewWriter(w)
+		if _, err := io.Copy(gw, r); err != nil {
+			return fmt.Errorf("io.Copy err: %v", err)
+		}
+		return gw.Close()
+	case CompressionZstd:
+		var stderr bytes.Buffer
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = r, w, &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("zstd err: %v, output: %s", err, stderr.String())
+		}
+		return nil
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("io.Copy err: %v", err)
+	}
+	return nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+/*
+Decompress 根据文件头判断压缩格式(gzip、zstd)，返回解压后的流
+*/
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("br.Peek err: %v", err)
+	}
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader err: %v", err)
+		}
+		return gr, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return newZstdReader(br)
+	}
+	return io.NopCloser(br), nil
+}
+
+/*
+zstdReader 通过zstd命令解压，读到结尾时检查命令的退出状态，避免把截断的数据当作完整的层
+*/
+type zstdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+func newZstdReader(r io.Reader) (*zstdReader, error) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return nil, fmt.Errorf("zstd compressed layer requires the zstd binary: %v", err)
+	}
+	z := &zstdReader{cmd: exec.Command("zstd", "-d", "-q", "-c")}
+	z.cmd.Stdin, z.cmd.Stderr = r, &z.stderr
+	stdout, err := z.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cmd.StdoutPipe err: %v", err)
+	}
+	z.stdout = stdout
+	if err = z.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cmd.Start err: %v", err)
+	}
+	return z, nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.stdout.Read(p)
+	if err == io.EOF && !z.done {
+		z.done = true
+		if waitErr := z.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("zstd err: %v, output: %s", waitErr, z.stderr.String())
+		}
+	}
+	return n, err
+}
+
+func (z *zstdReader) Close() error {
+	if z.done {
+		return nil
+	}
+	z.done = true
+	_ = z.stdout.Close()
+	_ = z.cmd.Process.Kill()
+	_ = z.cmd.Wait()
+	return nil
+}
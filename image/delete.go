@@ -0,0 +1,137 @@
+package image
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"mydocker/path"
+)
+
+/*
+Untag 删除镜像的一个引用，返回引用指向的镜像id
+*/
+func Untag(ref *Reference) (Digest, error) {
+	var id Digest
+	err := withLock(func() error {
+		store, err := readRepositories()
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if id, ok = store.get(ref); !ok {
+			return fmt.Errorf("no such image: %s", ref)
+		}
+		delete(store.Repositories[ref.Repository], ref.String())
+		if len(store.Repositories[ref.Repository]) == 0 {
+			delete(store.Repositories, ref.Repository)
+		}
+		if err = writeRepositories(store); err != nil {
+			return err
+		}
+		// 镜像存储之前导入的镜像还留着tar包时标记为已导入，否则删除后会再次导入
+		if legacy, ok := LegacyName(ref.String()); ok {
+			return markLegacyImported(legacy)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+/*
+Delete 删除没有引用的镜像，不再被任何镜像使用的层由GC删除
+*/
+func Delete(id Digest) error {
+	return withLock(func() error {
+		references, err := References()
+		if err != nil {
+			return err
+		}
+		if len(references[id]) > 0 {
+			return fmt.Errorf("image %s is still referenced by %s", id.Short(), references[id][0])
+		}
+		if err = os.Remove(path.ImageEntryPath(id.Hex())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("os.Remove err: %v", err)
+		}
+		if err = os.Remove(path.BlobPath(id.Hex())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("os.Remove err: %v", err)
+		}
+		return nil
+	})
+}
+
+/*
+GC 删除不被任何镜像使用的层(解压的目录和tar包)，返回删除的层
+正在进行的构建、拉取用租约保留还没有注册到镜像的层，见Lease
+*/
+func GC() ([]*Layer, error) {
+	var removed []*Layer
+	err := withLock(func() error {
+		ids, err := ListIDs()
+		if err != nil {
+			return err
+		}
+		used, err := leasedLayers()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			img, err := Get(id)
+			if err != nil {
+				return err
+			}
+			for _, diffID := range img.RootFS.DiffIDs {
+				used[diffID] = true
+			}
+		}
+		entries, err := os.ReadDir(path.LayersPath())
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("os.ReadDir err: %v", err)
+		}
+		for _, entry := range entries {
+			diffID := Digest(digestPrefix + entry.Name())
+			if diffID.Validate() != nil || used[diffID] {
+				continue
+			}
+			layer, err := GetLayer(diffID)
+			if err != nil {
+				layer = &Layer{DiffID: diffID}
+			}
+			if err = removeAll(path.LayerPath(diffID.Hex())); err != nil {
+				return fmt.Errorf("removeAll err: %v", err)
+			}
+			if err = os.Remove(path.BlobPath(diffID.Hex())); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("os.Remove err: %v", err)
+			}
+			removed = append(removed, layer)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+/*
+removeAll 删除目录，rootless模式下层中的只读目录需要先加上写权限
+*/
+func removeAll(dir string) error {
+	if err := os.RemoveAll(dir); err == nil || !os.IsPermission(err) {
+		return err
+	}
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,188 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"mydocker/userns"
+)
+
+// 容器运行时绑定挂载的文件，upper中只是空的挂载点，提交时忽略
+var commitExcludes = map[string]bool{
+	"/etc/hosts":       true,
+	"/etc/resolv.conf": true,
+	"/etc/hostname":    true,
+	"/.pivot_root":     true,
+}
+
+/*
+WriteDiff 把容器overlay的upper目录打包为层tar包
+overlay的whiteout(0/0字符设备)转为.wh.<name>，opaque目录加上.wh..wh..opq
+uidMaps、gidMaps不为空时(user namespace)把宿主机上的属主转换回容器内的属主
+*/
+func WriteDiff(upperDir string, w io.Writer, uidMaps []userns.IDMap, gidMaps []userns.IDMap) error {
+	tw := tar.NewWriter(w)
+	// 同一inode的文件作为硬链接写入
+	inodes := make(map[uint64]string)
+	err := filepath.Walk(upperDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if commitExcludes["/"+name] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		// whiteout: 删除下层的文件
+		if info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+			whiteout := filepath.ToSlash(filepath.Join(filepath.Dir(rel), whiteoutPrefix+info.Name()))
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     whiteout,
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+				Format:   tar.FormatPAX,
+			})
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Format = tar.FormatPAX
+		// 用户名、组名以容器内的/etc/passwd为准，不记录宿主机上的名称
+		hdr.Uname, hdr.Gname = "", ""
+		if len(uidMaps) > 0 {
+			hdr.Uid = toContainerID(hdr.Uid, uidMaps)
+			hdr.Gid = toContainerID(hdr.Gid, gidMaps)
+		}
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else if info.Mode().IsRegular() && st.Nlink > 1 {
+			if source, ok := inodes[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = source
+				hdr.Size = 0
+			} else {
+				inodes[st.Ino] = name
+			}
+		}
+		opaque, err := readXattrs(file, hdr)
+		if err != nil {
+			return err
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if err = copyFile(tw, file); err != nil {
+				return err
+			}
+		}
+		if opaque {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name + "/" + whiteoutOpaqueDir,
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+				Format:   tar.FormatPAX,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("filepath.Walk err: %v", err)
+	}
+	return tw.Close()
+}
+
+func toContainerID(id int, maps []userns.IDMap) int {
+	if containerID, ok := userns.ToContainer(id, maps); ok {
+		return containerID
+	}
+	// 不在映射范围内的文件在容器内显示为overflow id
+	return 65534
+}
+
+/*
+readXattrs 把文件的扩展属性记录到PAX头中，overlay自己的扩展属性不写入层，返回目录是否为opaque
+*/
+func readXattrs(file string, hdr *tar.Header) (bool, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if err != nil || size == 0 {
+		// 文件系统不支持扩展属性
+		return false, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(file, buf); err != nil {
+		return false, fmt.Errorf("unix.Llistxattr err: %v", err)
+	}
+	opaque := false
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" {
+			continue
+		}
+		value, err := getXattr(file, attr)
+		if err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.") {
+			if attr == overlayXattr("opaque") && string(value) == "y" {
+				opaque = true
+			}
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+attr] = string(value)
+	}
+	return opaque, nil
+}
+
+func getXattr(file string, attr string) ([]byte, error) {
+	size, err := unix.Lgetxattr(file, attr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unix.Lgetxattr err: %v", err)
+	}
+	value := make([]byte, size)
+	if size, err = unix.Lgetxattr(file, attr, value); err != nil {
+		return nil, fmt.Errorf("unix.Lgetxattr err: %v", err)
+	}
+	return value[:size], nil
+}
+
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = io.Copy(w, f)
+	return err
+}
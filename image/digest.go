@@ -0,0 +1,94 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+const (
+	// 摘要算法前缀
+	digestPrefix = "sha256:"
+)
+
+/*
+Digest 内容摘要，格式为sha256:<64位十六进制>
+*/
+type Digest string
+
+/*
+FromBytes 计算内容的摘要
+*/
+func FromBytes(content []byte) Digest {
+	sum := sha256.Sum256(content)
+	return Digest(digestPrefix + hex.EncodeToString(sum[:]))
+}
+
+/*
+FromReader 计算流的摘要，返回摘要和读取的大小
+*/
+func FromReader(r io.Reader) (Digest, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("io.Copy err: %v", err)
+	}
+	return fromHash(h), n, nil
+}
+
+func fromHash(h hash.Hash) Digest {
+	return Digest(digestPrefix + hex.EncodeToString(h.Sum(nil)))
+}
+
+/*
+ParseDigest 解析并校验摘要
+*/
+func ParseDigest(s string) (Digest, error) {
+	d := Digest(s)
+	if err := d.Validate(); err != nil {
+		return "", err
+	}
+	return d, nil
+}
+
+/*
+Validate 校验摘要格式，只支持sha256，十六进制部分必须是小写，与OCI规范一致，
+同一个摘要只有一种写法，用作存储路径和比较时不会出现大小写不同的两份
+*/
+func (d Digest) Validate() error {
+	hexPart, ok := strings.CutPrefix(string(d), digestPrefix)
+	if !ok || len(hexPart) != sha256.Size*2 {
+		return fmt.Errorf("invalid digest: %s", d)
+	}
+	for _, c := range hexPart {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("invalid digest: %s", d)
+		}
+	}
+	return nil
+}
+
+/*
+Hex 摘要的十六进制部分，用作存储路径
+*/
+func (d Digest) Hex() string {
+	return strings.TrimPrefix(string(d), digestPrefix)
+}
+
+/*
+Short 12位短摘要，用于显示
+*/
+func (d Digest) Short() string {
+	h := d.Hex()
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+func (d Digest) String() string {
+	return string(d)
+}
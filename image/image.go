@@ -0,0 +1,189 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"mydocker/path"
+)
+
+const (
+	// rootfs类型，OCI镜像配置中固定为layers
+	rootfsTypeLayers = "layers"
+)
+
+/*
+Image OCI镜像配置(application/vnd.oci.image.config.v1+json)，镜像id为配置内容的摘要
+*/
+type Image struct {
+	Created      *time.Time `json:"created,omitempty"`
+	Author       string     `json:"author,omitempty"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	Config       Config     `json:"config,omitempty"`
+	RootFS       RootFS     `json:"rootfs"`
+	History      []History  `json:"history,omitempty"`
+}
+
+/*
+Config 镜像中运行容器的默认参数
+*/
+type Config struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+/*
+RootFS 镜像的层，DiffIDs为未压缩层tar包的摘要，从底层到顶层排列
+*/
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []Digest `json:"diff_ids"`
+}
+
+/*
+History 镜像每一步的构建记录，EmptyLayer表示这一步没有产生新的层
+*/
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+/*
+Create 保存镜像配置并加入镜像列表，返回镜像id，相同的配置得到相同的id
+*/
+func Create(img *Image) (Digest, error) {
+	id, err := CreateIntermediate(img)
+	if err != nil {
+		return "", err
+	}
+	if err = Register(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+/*
+CreateIntermediate 保存镜像配置但不加入镜像列表，用于构建过程中每一步的中间镜像
+中间镜像只能通过id访问，不在images中显示，层不再被镜像使用时由GC清理
+*/
+func CreateIntermediate(img *Image) (Digest, error) {
+	if img.RootFS.Type == "" {
+		img.RootFS.Type = rootfsTypeLayers
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !LayerExist(diffID) {
+			return "", fmt.Errorf("layer %s not found", diffID)
+		}
+	}
+	content, err := json.Marshal(img)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal err: %v", err)
+	}
+	id, err := WriteBlob(content)
+	if err != nil {
+		return "", fmt.Errorf("WriteBlob err: %v", err)
+	}
+	return id, nil
+}
+
+/*
+Register 把镜像加入镜像列表，blob中除了镜像配置还有层，需要单独记录哪些是镜像
+*/
+func Register(id Digest) error {
+	if err := os.MkdirAll(path.ImagesPath(), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	f, err := os.OpenFile(path.ImageEntryPath(id.Hex()), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile err: %v", err)
+	}
+	return f.Close()
+}
+
+/*
+ListIDs 镜像存储中所有镜像的id，包括没有名称的镜像
+*/
+func ListIDs() ([]Digest, error) {
+	entries, err := os.ReadDir(path.ImagesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("os.ReadDir err: %v", err)
+	}
+	seen := make(map[Digest]bool)
+	var ids []Digest
+	for _, entry := range entries {
+		id := Digest(digestPrefix + entry.Name())
+		if id.Validate() == nil && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	// 镜像列表之前创建的镜像只记录在名称索引中
+	references, err := References()
+	if err != nil {
+		return nil, err
+	}
+	for id := range references {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+/*
+Get 根据镜像id读取镜像配置
+*/
+func Get(id Digest) (*Image, error) {
+	if err := id.Validate(); err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path.BlobPath(id.Hex()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("image %s not found", id)
+		}
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	var img Image
+	if err = json.Unmarshal(content, &img); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	return &img, nil
+}
+
+/*
+Scratch 没有层的空镜像，用于FROM scratch
+*/
+func Scratch() *Image {
+	return &Image{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       RootFS{Type: rootfsTypeLayers, DiffIDs: []Digest{}},
+	}
+}
+
+/*
+Size 镜像所有层解压后的大小
+*/
+func (img *Image) Size() int64 {
+	var size int64
+	for _, diffID := range img.RootFS.DiffIDs {
+		if layer, err := GetLayer(diffID); err == nil {
+			size += layer.Size
+		}
+	}
+	return size
+}
@@ -0,0 +1,30 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+/*
+Import 把rootfs的tar包(可以是压缩的)导入为单层镜像，返回镜像id
+层在镜像注册之前加入lease，调用者在注册、打标签之后释放租约；
+只有持有镜像存储锁的调用者(GC无法运行)可以传nil
+*/
+func Import(r io.Reader, createdBy string, config Config, lease *Lease) (Digest, error) {
+	layer, err := ImportLayer(r, lease)
+	if err != nil {
+		return "", fmt.Errorf("ImportLayer err: %v", err)
+	}
+	created := time.Now().UTC()
+	img := &Image{
+		Created:      &created,
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Config:       config,
+		RootFS:       RootFS{Type: rootfsTypeLayers, DiffIDs: []Digest{layer.DiffID}},
+		History:      []History{{Created: &created, CreatedBy: createdBy}},
+	}
+	return Create(img)
+}
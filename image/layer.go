@@ -0,0 +1,194 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"mydocker/path"
+	"mydocker/userns"
+)
+
+const (
+	// 层目录中的文件
+	layerDiffDir  = "diff"       // 解压后的层内容，作为overlay的lowerdir
+	layerMetaFile = "layer.json" // 层的元数据
+)
+
+/*
+Layer 解压到存储中的一层，DiffID为未压缩tar包的摘要
+*/
+type Layer struct {
+	DiffID Digest `json:"diffId"`
+	Size   int64  `json:"size"` // 解压后文件的总大小
+}
+
+/*
+ImportLayer 导入一个层的tar包(可以是gzip压缩的)，tar包保存到blob存储，内容解压到层目录
+同一个层只会解压一次，lease不为空时层加入租约，注册镜像之前不会被GC删除
+未压缩的tar包和解压后的目录都需要保留，磁盘占用约为层大小的两倍，去重发生在层这一级(相同diff id的层只存一份):
+镜像配置中的diff id是原始tar包的摘要，从解压后的目录重新打包得不到相同的字节(文件顺序、时间、硬链接、扩展属性)，
+save、push需要原样的tar包，否则摘要对不上；userns-remap也需要从tar包解压出属主平移后的副本，见LayerDir
+*/
+func ImportLayer(r io.Reader, lease *Lease) (*Layer, error) {
+	reader, err := Decompress(r)
+	if err != nil {
+		return nil, fmt.Errorf("Decompress err: %v", err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	diffID, _, err := writeBlobFrom(reader, lease)
+	if err != nil {
+		return nil, fmt.Errorf("writeBlobFrom err: %v", err)
+	}
+	return extractLayer(diffID)
+}
+
+/*
+extractLayer 把blob中的层tar包解压到层目录，先解压到临时目录再重命名，避免并发导入时看到不完整的层
+*/
+func extractLayer(diffID Digest) (*Layer, error) {
+	if layer, err := GetLayer(diffID); err == nil {
+		return layer, nil
+	}
+	tmpDir, err := makeTempDir("layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	size, err := extractBlob(diffID, filepath.Join(tmpDir, layerDiffDir))
+	if err != nil {
+		return nil, err
+	}
+	layer := &Layer{DiffID: diffID, Size: size}
+	content, err := json.Marshal(layer)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal err: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(tmpDir, layerMetaFile), content, 0644); err != nil {
+		return nil, fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	if err = os.MkdirAll(path.LayersPath(), 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err = os.Rename(tmpDir, path.LayerPath(diffID.Hex())); err != nil && !LayerExist(diffID) {
+		return nil, fmt.Errorf("os.Rename err: %v", err)
+	}
+	return layer, nil
+}
+
+func extractBlob(diffID Digest, dest string) (int64, error) {
+	blob, err := OpenBlob(diffID)
+	if err != nil {
+		return 0, fmt.Errorf("OpenBlob err: %v", err)
+	}
+	defer func() {
+		_ = blob.Close()
+	}()
+	size, err := Extract(blob, dest)
+	if err != nil {
+		return 0, fmt.Errorf("Extract err: %v", err)
+	}
+	return size, nil
+}
+
+/*
+GetLayer 读取层的元数据
+*/
+func GetLayer(diffID Digest) (*Layer, error) {
+	if err := diffID.Validate(); err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(filepath.Join(path.LayerPath(diffID.Hex()), layerMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var layer Layer
+	if err = json.Unmarshal(content, &layer); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	return &layer, nil
+}
+
+/*
+LayerExist 层是否已经导入
+*/
+func LayerExist(diffID Digest) bool {
+	_, err := GetLayer(diffID)
+	return err == nil
+}
+
+/*
+LayerDir 层解压后的目录
+userns-remap时需要一份属主平移到映射范围的副本，按宿主机上容器root的uid、gid区分，第一次使用时从blob解压生成
+*/
+func LayerDir(diffID Digest, uidMaps []userns.IDMap, gidMaps []userns.IDMap) (string, error) {
+	if !LayerExist(diffID) {
+		return "", fmt.Errorf("layer %s not found", diffID)
+	}
+	layerPath := path.LayerPath(diffID.Hex())
+	if len(uidMaps) == 0 || path.Rootless() {
+		return filepath.Join(layerPath, layerDiffDir), nil
+	}
+	uid, _ := userns.ToHost(0, uidMaps)
+	gid, _ := userns.ToHost(0, gidMaps)
+	remapDir := filepath.Join(layerPath, fmt.Sprintf("%s-%d-%d", layerDiffDir, uid, gid))
+	if _, err := os.Stat(remapDir); err == nil {
+		return remapDir, nil
+	}
+	tmpDir, err := makeTempDir("remap-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	dest := filepath.Join(tmpDir, layerDiffDir)
+	if _, err = extractBlob(diffID, dest); err != nil {
+		return "", err
+	}
+	if err = userns.ChownTree(dest, uidMaps, gidMaps); err != nil {
+		return "", fmt.Errorf("userns.ChownTree err: %v", err)
+	}
+	if err = os.Rename(dest, remapDir); err != nil {
+		if _, statErr := os.Stat(remapDir); statErr != nil {
+			return "", fmt.Errorf("os.Rename err: %v", err)
+		}
+	}
+	return remapDir, nil
+}
+
+/*
+LayerDirs 镜像各层的目录，按overlay lowerdir的顺序从顶层到底层排列
+*/
+func LayerDirs(img *Image, uidMaps []userns.IDMap, gidMaps []userns.IDMap) ([]string, error) {
+	dirs := make([]string, 0, len(img.RootFS.DiffIDs))
+	for i := len(img.RootFS.DiffIDs) - 1; i >= 0; i-- {
+		dir, err := LayerDir(img.RootFS.DiffIDs[i], uidMaps, gidMaps)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+func makeTempDir(prefix string) (string, error) {
+	if err := os.MkdirAll(path.ImageTmpPath(), 0755); err != nil {
+		return "", fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	dir, err := os.MkdirTemp(path.ImageTmpPath(), prefix)
+	if err != nil {
+		return "", fmt.Errorf("os.MkdirTemp err: %v", err)
+	}
+	// MkdirTemp创建的目录权限为0700，层目录需要容器内的其他用户可以访问
+	if err = os.Chmod(dir, 0755); err != nil {
+		return "", fmt.Errorf("os.Chmod err: %v", err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,376 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"mydocker/path"
+)
+
+/*
+Save 把镜像导出为OCI image layout格式的tar包，多个镜像共享的blob只写入一次
+compression为层的压缩方式: gzip、zstd或none
+*/
+func Save(w io.Writer, names []string, compression string) error {
+	if err := ValidateCompression(compression); err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", ociBlobsDir + "/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: time.Unix(0, 0)}); err != nil {
+			return fmt.Errorf("tw.WriteHeader err: %v", err)
+		}
+	}
+	index := &Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	written := make(map[Digest]bool)
+	layers := make(map[Digest]Descriptor)
+	for _, name := range names {
+		id, img, err := Resolve(name)
+		if err != nil {
+			return err
+		}
+		manifest := &Manifest{SchemaVersion: 2, MediaType: MediaTypeImageManifest}
+		for _, diffID := range img.RootFS.DiffIDs {
+			desc, ok := layers[diffID]
+			if !ok {
+				tmpPath, compressed, err := CompressLayer(diffID, compression)
+				if err != nil {
+					return fmt.Errorf("CompressLayer err: %v", err)
+				}
+				err = writeLayoutFile(tw, compressed.Digest, tmpPath, compressed.Size)
+				_ = os.Remove(tmpPath)
+				if err != nil {
+					return err
+				}
+				desc, layers[diffID], written[compressed.Digest] = *compressed, *compressed, true
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		fi, err := os.Stat(path.BlobPath(id.Hex()))
+		if err != nil {
+			return fmt.Errorf("os.Stat err: %v", err)
+		}
+		manifest.Config = Descriptor{MediaType: MediaTypeImageConfig, Digest: id, Size: fi.Size()}
+		if !written[id] {
+			if err = writeLayoutFile(tw, id, path.BlobPath(id.Hex()), manifest.Config.Size); err != nil {
+				return err
+			}
+			written[id] = true
+		}
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("json.Marshal err: %v", err)
+		}
+		desc := Descriptor{
+			MediaType: MediaTypeImageManifest,
+			Digest:    FromBytes(content),
+			Size:      int64(len(content)),
+			Platform:  &Platform{Architecture: img.Architecture, OS: img.OS},
+		}
+		if !written[desc.Digest] {
+			if err = writeLayoutEntry(tw, filepath.Join(ociBlobsDir, desc.Digest.Hex()), content); err != nil {
+				return err
+			}
+			written[desc.Digest] = true
+		}
+		// 按镜像id导出时不记录名称，ref.name按OCI规范只记录标签
+		if ref, ok := lookupReference(name); ok {
+			desc.Annotations = map[string]string{AnnotationImageName: ref.String()}
+			if ref.Tag != "" {
+				desc.Annotations[AnnotationRefName] = ref.Tag
+			}
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	layout, err := json.Marshal(&ImageLayout{Version: ociImageLayoutVersion})
+	if err != nil {
+		return fmt.Errorf("json.Marshal err: %v", err)
+	}
+	if err = writeLayoutEntry(tw, ociLayoutFile, layout); err != nil {
+		return err
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("json.Marshal err: %v", err)
+	}
+	if err = writeLayoutEntry(tw, ociIndexFile, content); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeLayoutEntry(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Unix(0, 0)}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tw.WriteHeader err: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		return fmt.Errorf("tw.Write err: %v", err)
+	}
+	return nil
+}
+
+func writeLayoutFile(tw *tar.Writer, d Digest, file string, size int64) error {
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: filepath.Join(ociBlobsDir, d.Hex()), Mode: 0644, Size: size, ModTime: time.Unix(0, 0)}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tw.WriteHeader err: %v", err)
+	}
+	if err := copyFile(tw, file); err != nil {
+		return fmt.Errorf("copyFile err: %v", err)
+	}
+	return nil
+}
+
+/*
+Load 导入OCI image layout格式的tar包(可以是压缩的)，校验所有blob的摘要，返回导入的镜像名称或id
+镜像索引中有多个平台时只导入当前平台
+*/
+func Load(r io.Reader) ([]string, error) {
+	reader, err := Decompress(r)
+	if err != nil {
+		return nil, fmt.Errorf("Decompress err: %v", err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	dir, err := makeTempDir("load-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if err = untarLayout(reader, dir); err != nil {
+		return nil, fmt.Errorf("untarLayout err: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, ociLayoutFile))
+	if err != nil {
+		return nil, fmt.Errorf("not an oci image layout: %v", err)
+	}
+	var layout ImageLayout
+	if err = json.Unmarshal(content, &layout); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if layout.Version != ociImageLayoutVersion {
+		return nil, fmt.Errorf("unsupported image layout version: %s", layout.Version)
+	}
+	if content, err = os.ReadFile(filepath.Join(dir, ociIndexFile)); err != nil {
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	var index Index
+	if err = json.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	return loadIndex(dir, &index, nil)
+}
+
+/*
+annotationReference 从描述符的注解中获取镜像名称，优先使用完整的镜像名
+其他工具可能只在ref.name中记录完整的引用，只有标签时无法确定仓库，不设置名称
+*/
+func annotationReference(annotations map[string]string) (*Reference, error) {
+	name := annotations[AnnotationImageName]
+	if name == "" {
+		name = annotations[AnnotationRefName]
+		if tagRegexp.MatchString(name) && !strings.ContainsAny(name, ":/") {
+			return nil, nil
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+	ref, err := ParseReference(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name in annotations: %v", err)
+	}
+	return ref, nil
+}
+
+func loadIndex(dir string, index *Index, ref *Reference) ([]string, error) {
+	var loaded []string
+	for _, desc := range index.Manifests {
+		if desc.Platform != nil && !MatchPlatform(desc.Platform) {
+			continue
+		}
+		descRef, err := annotationReference(desc.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		if descRef == nil {
+			descRef = ref
+		}
+		content, err := readLayoutBlob(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case IsIndex(desc.MediaType):
+			var child Index
+			if err = json.Unmarshal(content, &child); err != nil {
+				return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+			}
+			names, err := loadIndex(dir, &child, descRef)
+			if err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, names...)
+		case IsManifest(desc.MediaType):
+			var manifest Manifest
+			if err = json.Unmarshal(content, &manifest); err != nil {
+				return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+			}
+			id, err := loadManifest(dir, &manifest)
+			if err != nil {
+				return nil, fmt.Errorf("load manifest %s err: %v", desc.Digest, err)
+			}
+			if descRef == nil {
+				loaded = append(loaded, id.String())
+				continue
+			}
+			if err = Tag(descRef, id); err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, descRef.String())
+		default:
+			return nil, fmt.Errorf("unsupported media type: %s", desc.MediaType)
+		}
+	}
+	return loaded, nil
+}
+
+/*
+MatchPlatform 平台是否与当前主机一致
+*/
+func MatchPlatform(platform *Platform) bool {
+	return platform.OS == "linux" && platform.Architecture == runtime.GOARCH
+}
+
+func loadManifest(dir string, manifest *Manifest) (Digest, error) {
+	content, err := readLayoutBlob(dir, manifest.Config)
+	if err != nil {
+		return "", err
+	}
+	var img Image
+	if err = json.Unmarshal(content, &img); err != nil {
+		return "", fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return "", fmt.Errorf("config has %d diff ids but manifest has %d layers", len(img.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	// 注册镜像之前层不被任何镜像使用，先加入租约再检查层是否存在
+	lease, err := NewLease()
+	if err != nil {
+		return "", err
+	}
+	defer lease.Release()
+	if err = lease.Add(img.RootFS.DiffIDs...); err != nil {
+		return "", err
+	}
+	for i, desc := range manifest.Layers {
+		if LayerExist(img.RootFS.DiffIDs[i]) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, ociBlobsDir, desc.Digest.Hex()))
+		if err != nil {
+			return "", fmt.Errorf("os.Open err: %v", err)
+		}
+		err = ImportVerifiedLayer(f, desc, img.RootFS.DiffIDs[i])
+		_ = f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	id, err := WriteBlob(content)
+	if err != nil {
+		return "", fmt.Errorf("WriteBlob err: %v", err)
+	}
+	if err = Register(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+/*
+ImportVerifiedLayer 导入层，校验压缩后的摘要、大小以及解压后的diff id
+*/
+func ImportVerifiedLayer(r io.Reader, desc Descriptor, diffID Digest) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	h := sha256.New()
+	counter := &countWriter{w: h}
+	tee := io.TeeReader(r, counter)
+	layer, err := ImportLayer(tee, nil)
+	if err != nil {
+		return fmt.Errorf("ImportLayer err: %v", err)
+	}
+	// 解压时可能没有读到结尾
+	if _, err = io.Copy(io.Discard, tee); err != nil {
+		return fmt.Errorf("io.Copy err: %v", err)
+	}
+	if d := fromHash(h); d != desc.Digest || counter.n != desc.Size {
+		return fmt.Errorf("layer digest mismatch: expected %s, got %s", desc.Digest, d)
+	}
+	if layer.DiffID != diffID {
+		return fmt.Errorf("layer diff id mismatch: expected %s, got %s", diffID, layer.DiffID)
+	}
+	return nil
+}
+
+/*
+readLayoutBlob 读取image layout中的blob并校验摘要和大小
+*/
+func readLayoutBlob(dir string, desc Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, ociBlobsDir, desc.Digest.Hex()))
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	if FromBytes(content) != desc.Digest || int64(len(content)) != desc.Size {
+		return nil, fmt.Errorf("blob %s digest mismatch", desc.Digest)
+	}
+	return content, nil
+}
+
+/*
+untarLayout 解压image layout，只包含目录和普通文件
+*/
+func untarLayout(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tr.Next err: %v", err)
+		}
+		target, err := securePath(dir, filepath.Clean("/"+hdr.Name))
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("os.MkdirAll err: %v", err)
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("os.MkdirAll err: %v", err)
+			}
+			if _, err = writeFile(target, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package image
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"mydocker/path"
+)
+
+/*
+Lease 租约，构建、拉取过程中导入的层在镜像注册之前不被任何镜像使用，
+持有租约期间GC保留租约中的层，租约文件名以进程号开头，进程异常退出后GC删除失效的租约
+*/
+type Lease struct {
+	file string
+}
+
+/*
+NewLease 创建租约，用完后需要Release
+*/
+func NewLease() (*Lease, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("rand.Read err: %v", err)
+	}
+	if err := os.MkdirAll(path.LeasesPath(), 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	file := path.LeasePath(fmt.Sprintf("%d-%s", os.Getpid(), hex.EncodeToString(buf)))
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		return nil, fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	return &Lease{file: file}, nil
+}
+
+/*
+Add 把层加入租约，与GC互斥，返回后GC不会删除这些层
+需要在层导入存储之前调用，否则GC可能在导入和加入租约之间删除它
+*/
+func (l *Lease) Add(diffIDs ...Digest) error {
+	if l == nil || len(diffIDs) == 0 {
+		return nil
+	}
+	return withLock(func() error {
+		f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile err: %v", err)
+		}
+		var b strings.Builder
+		for _, diffID := range diffIDs {
+			b.WriteString(diffID.String() + "\n")
+		}
+		if _, err = f.WriteString(b.String()); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("f.WriteString err: %v", err)
+		}
+		return f.Close()
+	})
+}
+
+/*
+Release 释放租约，镜像注册之后调用
+*/
+func (l *Lease) Release() {
+	if l != nil {
+		_ = os.Remove(l.file)
+	}
+}
+
+/*
+leasedLayers 有效租约中的层，调用者需要持有锁，失效的租约直接删除
+*/
+func leasedLayers() (map[Digest]bool, error) {
+	leased := make(map[Digest]bool)
+	entries, err := os.ReadDir(path.LeasesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return leased, nil
+		}
+		return nil, fmt.Errorf("os.ReadDir err: %v", err)
+	}
+	for _, entry := range entries {
+		file := path.LeasePath(entry.Name())
+		pidStr, _, _ := strings.Cut(entry.Name(), "-")
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || !processAlive(pid) {
+			_ = os.Remove(file)
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("os.Open err: %v", err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			leased[Digest(scanner.Text())] = true
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("scanner.Err: %v", err)
+		}
+	}
+	return leased, nil
+}
+
+/*
+processAlive 进程是否还在运行，没有权限发送信号(EPERM)说明进程存在
+*/
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,86 @@
+package image
+
+const (
+	// OCI镜像格式的媒体类型
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer         = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeLayerZstd     = "application/vnd.oci.image.layer.v1.tar+zstd"
+	// docker镜像格式的媒体类型，与OCI格式结构相同
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// index.json中记录镜像名称的注解
+	AnnotationRefName     = "org.opencontainers.image.ref.name"
+	AnnotationImageName   = "io.containerd.image.name"
+	ociLayoutFile         = "oci-layout"
+	ociIndexFile          = "index.json"
+	ociBlobsDir           = "blobs/sha256"
+	ociImageLayoutVersion = "1.0.0"
+)
+
+/*
+Descriptor 指向一个blob的描述符
+*/
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      Digest            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+/*
+Platform 镜像适用的平台
+*/
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+/*
+Manifest 镜像清单: 镜像配置和各层
+*/
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+/*
+Index 镜像索引，指向多个清单(例如多平台镜像)
+*/
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+/*
+ImageLayout oci-layout文件的内容
+*/
+type ImageLayout struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+/*
+IsIndex 媒体类型是否为镜像索引
+*/
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
+
+/*
+IsManifest 媒体类型是否为镜像清单
+*/
+func IsManifest(mediaType string) bool {
+	return mediaType == MediaTypeImageManifest || mediaType == MediaTypeDockerManifest
+}
@@ -0,0 +1,126 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultTag 没有指定标签时使用的标签
+	DefaultTag = "latest"
+)
+
+var (
+	// 仓库名的每一段: 小写字母数字，中间可以有.、_、__、-
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	// 仓库名的第一段可以是registry地址: 域名或ip，可以带端口
+	domainRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?))*(?::[0-9]+)?$`)
+	tagRegexp    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+/*
+Reference 镜像引用: repository[:tag][@digest]
+*/
+type Reference struct {
+	Repository string
+	Tag        string
+	Digest     Digest
+}
+
+/*
+ParseReference 解析镜像引用，既没有标签也没有摘要时使用latest标签
+*/
+func ParseReference(s string) (*Reference, error) {
+	ref := &Reference{}
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		d, err := ParseDigest(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference %s: %v", s, err)
+		}
+		ref.Digest, name = d, name[:i]
+	}
+	// 最后一个/之后的冒号是标签，之前的是registry端口
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag, name = name[i+1:], name[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("invalid reference %s: invalid tag %s", s, ref.Tag)
+		}
+	}
+	if err := validateRepository(name); err != nil {
+		return nil, fmt.Errorf("invalid reference %s: %v", s, err)
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+/*
+ParseTag 解析作为标签目标的镜像引用，不能带摘要
+*/
+func ParseTag(s string) (*Reference, error) {
+	ref, err := ParseReference(s)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest != "" {
+		return nil, fmt.Errorf("cannot tag with a digest reference: %s", s)
+	}
+	return ref, nil
+}
+
+func validateRepository(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty repository name")
+	}
+	if len(name) > 255 {
+		return fmt.Errorf("repository name must not be longer than 255 characters")
+	}
+	components := strings.Split(name, "/")
+	if len(components) > 1 && (strings.ContainsAny(components[0], ".:") || components[0] == "localhost") {
+		if !domainRegexp.MatchString(components[0]) {
+			return fmt.Errorf("invalid registry: %s", components[0])
+		}
+		components = components[1:]
+	}
+	for _, component := range components {
+		if !pathComponentRegexp.MatchString(component) {
+			return fmt.Errorf("repository name must be lowercase: %s", name)
+		}
+	}
+	return nil
+}
+
+/*
+Domain 仓库名中的registry地址，没有时为空
+*/
+func (ref *Reference) Domain() string {
+	domain, _, found := strings.Cut(ref.Repository, "/")
+	if found && (strings.ContainsAny(domain, ".:") || domain == "localhost") {
+		return domain
+	}
+	return ""
+}
+
+/*
+Path 仓库名去掉registry地址的部分
+*/
+func (ref *Reference) Path() string {
+	if domain := ref.Domain(); domain != "" {
+		return strings.TrimPrefix(ref.Repository, domain+"/")
+	}
+	return ref.Repository
+}
+
+/*
+String 完整的引用，有摘要时优先使用摘要
+*/
+func (ref *Reference) String() string {
+	if ref.Digest != "" {
+		return ref.Repository + "@" + ref.Digest.String()
+	}
+	return ref.Repository + ":" + ref.Tag
+}
@@ -0,0 +1,78 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		input      string
+		repository string
+		tag        string
+		digest     string
+		domain     string
+		path       string
+	}{
+		{"busybox", "busybox", "latest", "", "", "busybox"},
+		{"busybox:1.36", "busybox", "1.36", "", "", "busybox"},
+		{"library/busybox:v1", "library/busybox", "v1", "", "", "library/busybox"},
+		{"localhost/app", "localhost/app", "latest", "", "localhost", "app"},
+		{"localhost:5000/team/app:v2", "localhost:5000/team/app", "v2", "", "localhost:5000", "team/app"},
+		{"registry.example.com/app", "registry.example.com/app", "latest", "", "registry.example.com", "app"},
+		{"app@" + digest, "app", "", digest, "", "app"},
+		{"127.0.0.1:5000/app:v1@" + digest, "127.0.0.1:5000/app", "v1", digest, "127.0.0.1:5000", "app"},
+		{"my-app/some_name__x:tag.1-a", "my-app/some_name__x", "tag.1-a", "", "", "my-app/some_name__x"},
+	}
+	for _, tt := range tests {
+		ref, err := ParseReference(tt.input)
+		if err != nil {
+			t.Errorf("ParseReference(%q) err: %v", tt.input, err)
+			continue
+		}
+		if ref.Repository != tt.repository || ref.Tag != tt.tag || ref.Digest.String() != tt.digest {
+			t.Errorf("ParseReference(%q) = %+v, want repository %q tag %q digest %q", tt.input, ref, tt.repository, tt.tag, tt.digest)
+		}
+		if ref.Domain() != tt.domain || ref.Path() != tt.path {
+			t.Errorf("ParseReference(%q): domain %q path %q, want %q %q", tt.input, ref.Domain(), ref.Path(), tt.domain, tt.path)
+		}
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	inputs := []string{
+		"",
+		"Busybox",
+		"busybox:",
+		"busybox:-tag",
+		"busybox:" + strings.Repeat("t", 129),
+		"app@sha256:1234",
+		"app@sha256:" + strings.Repeat("AB", 32),
+		"app@md5:" + strings.Repeat("ab", 16),
+		"/app",
+		"app/",
+		"team//app",
+		"app-",
+		"-registry.com/app",
+		strings.Repeat("a", 256),
+	}
+	for _, input := range inputs {
+		if ref, err := ParseReference(input); err == nil {
+			t.Errorf("ParseReference(%q) = %+v, want error", input, ref)
+		}
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	if _, err := ParseTag("app@sha256:" + strings.Repeat("ab", 32)); err == nil {
+		t.Errorf("ParseTag accepted a digest reference")
+	}
+	ref, err := ParseTag("app:v1")
+	if err != nil {
+		t.Fatalf("ParseTag err: %v", err)
+	}
+	if ref.String() != "app:v1" {
+		t.Errorf("ref.String() = %q, want app:v1", ref.String())
+	}
+}
@@ -0,0 +1,327 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"mydocker/path"
+)
+
+// 镜像id的前缀(短id)，与docker一致至少6位，避免很短的名称被当作id前缀匹配到镜像
+var shortIDRegexp = regexp.MustCompile(`^[a-f0-9]{6,64}$`)
+
+/*
+repositoryStore 镜像名称索引，仓库名 -> 完整引用(repo:tag或repo@digest) -> 镜像id，与docker的repositories.json格式一致
+*/
+type repositoryStore struct {
+	Repositories map[string]map[string]Digest `json:"Repositories"`
+}
+
+/*
+withLock 持有镜像存储的文件锁执行fn，多个mydocker进程同时导入、打标签时串行化
+*/
+func withLock(fn func() error) error {
+	if err := os.MkdirAll(path.ImageLocation(), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	f, err := os.OpenFile(path.ImageLockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("syscall.Flock err: %v", err)
+	}
+	defer func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}()
+	return fn()
+}
+
+/*
+readRepositories 读取镜像名称索引，兼容之前名称到镜像id的格式
+*/
+func readRepositories() (*repositoryStore, error) {
+	store := &repositoryStore{Repositories: make(map[string]map[string]Digest)}
+	content, err := os.ReadFile(path.RepositoriesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if _, ok := raw["Repositories"]; ok {
+		if err = json.Unmarshal(content, store); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+		}
+		if store.Repositories == nil {
+			store.Repositories = make(map[string]map[string]Digest)
+		}
+		return store, nil
+	}
+	var names map[string]Digest
+	if err = json.Unmarshal(content, &names); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	for name, id := range names {
+		if ref, err := ParseReference(name); err == nil {
+			store.set(ref, id)
+		}
+	}
+	return store, nil
+}
+
+func writeRepositories(store *repositoryStore) error {
+	content, err := json.Marshal(store)
+	if err != nil {
+		return fmt.Errorf("json.Marshal err: %v", err)
+	}
+	tmp, err := createTemp()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("tmp.Write err: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close err: %v", err)
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("os.Chmod err: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), path.RepositoriesPath()); err != nil {
+		return fmt.Errorf("os.Rename err: %v", err)
+	}
+	return nil
+}
+
+func (store *repositoryStore) set(ref *Reference, id Digest) {
+	repository, ok := store.Repositories[ref.Repository]
+	if !ok {
+		repository = make(map[string]Digest)
+		store.Repositories[ref.Repository] = repository
+	}
+	repository[ref.String()] = id
+}
+
+func (store *repositoryStore) get(ref *Reference) (Digest, bool) {
+	id, ok := store.Repositories[ref.Repository][ref.String()]
+	return id, ok
+}
+
+/*
+Tag 给镜像设置名称，名称已存在时指向新的镜像
+*/
+func Tag(ref *Reference, id Digest) error {
+	if _, err := Get(id); err != nil {
+		return err
+	}
+	return withLock(func() error {
+		return tagLocked(ref, id)
+	})
+}
+
+func tagLocked(ref *Reference, id Digest) error {
+	store, err := readRepositories()
+	if err != nil {
+		return err
+	}
+	store.set(ref, id)
+	return writeRepositories(store)
+}
+
+/*
+Lookup 查找镜像id，name可以是镜像引用、完整的镜像id或者唯一的镜像id前缀
+*/
+func Lookup(name string) (Digest, error) {
+	if d, err := ParseDigest(name); err == nil {
+		if _, err = Get(d); err != nil {
+			return "", err
+		}
+		return d, nil
+	}
+	if ref, err := ParseReference(name); err == nil {
+		store, err := readRepositories()
+		if err != nil {
+			return "", err
+		}
+		if id, ok := store.get(ref); ok {
+			return id, nil
+		}
+	}
+	if shortIDRegexp.MatchString(name) {
+		ids, err := ListIDs()
+		if err != nil {
+			return "", err
+		}
+		var found Digest
+		for _, id := range ids {
+			if strings.HasPrefix(id.Hex(), name) {
+				if found != "" {
+					return "", fmt.Errorf("image id prefix %s is ambiguous", name)
+				}
+				found = id
+			}
+		}
+		if found != "" {
+			return found, nil
+		}
+	}
+	return "", &notFoundError{name: name}
+}
+
+/*
+notFoundError 镜像不存在，Resolve只在这种情况下查找镜像tar包，其他错误(例如短id有歧义)直接返回
+*/
+type notFoundError struct {
+	name string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("image %s not found", e.name)
+}
+
+/*
+lookupReference name是镜像存储中的引用时返回解析后的引用，name为镜像id时返回false
+*/
+func lookupReference(name string) (*Reference, bool) {
+	ref, err := ParseReference(name)
+	if err != nil {
+		return nil, false
+	}
+	store, err := readRepositories()
+	if err != nil {
+		return nil, false
+	}
+	_, ok := store.get(ref)
+	return ref, ok
+}
+
+/*
+References 每个镜像的所有引用，按引用排序
+*/
+func References() (map[Digest][]*Reference, error) {
+	store, err := readRepositories()
+	if err != nil {
+		return nil, err
+	}
+	references := make(map[Digest][]*Reference)
+	for _, repository := range store.Repositories {
+		for name, id := range repository {
+			ref, err := ParseReference(name)
+			if err != nil {
+				continue
+			}
+			references[id] = append(references[id], ref)
+		}
+	}
+	for _, refs := range references {
+		sort.Slice(refs, func(i, j int) bool {
+			return refs[i].String() < refs[j].String()
+		})
+	}
+	return references, nil
+}
+
+/*
+Resolve 查找镜像，镜像存储中没有时导入数据根目录下同名的镜像tar包(mydocker之前的镜像格式)
+*/
+func Resolve(name string) (Digest, *Image, error) {
+	id, err := Lookup(name)
+	if err != nil {
+		if _, ok := err.(*notFoundError); !ok {
+			return "", nil, err
+		}
+		if id, err = importLegacy(name); err != nil {
+			return "", nil, err
+		}
+	}
+	img, err := Get(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, img, nil
+}
+
+/*
+LegacyName 镜像tar包对应的镜像引用，只有不带registry和标签的名称(即latest标签)可以对应tar包
+*/
+func LegacyName(name string) (*Reference, bool) {
+	ref, err := ParseReference(name)
+	if err != nil || ref.Digest != "" || ref.Tag != DefaultTag || strings.Contains(ref.Repository, "/") {
+		return nil, false
+	}
+	if _, err = os.Stat(path.ImagePath(ref.Repository)); err != nil {
+		return nil, false
+	}
+	return ref, true
+}
+
+/*
+importLegacy 把镜像tar包作为单层镜像导入镜像存储
+*/
+func importLegacy(name string) (Digest, error) {
+	ref, ok := LegacyName(name)
+	if !ok {
+		return "", fmt.Errorf("image %s not found", name)
+	}
+	tarPath := path.ImagePath(ref.Repository)
+	var id Digest
+	err := withLock(func() error {
+		// 等待锁期间其他进程可能已经导入
+		store, err := readRepositories()
+		if err != nil {
+			return err
+		}
+		if existing, ok := store.get(ref); ok {
+			id = existing
+			return markLegacyImported(ref)
+		}
+		f, err := os.Open(tarPath)
+		if err != nil {
+			return fmt.Errorf("os.Open err: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		// 之前的镜像tar包没有配置，与原来的默认命令一致
+		// 导入和打标签都持有镜像存储的锁，GC不能在其间删除层，不需要租约(租约的Add也需要这个锁)
+		if id, err = Import(f, "import "+ref.Repository+".tar", Config{Cmd: []string{"sh"}}, nil); err != nil {
+			return fmt.Errorf("Import err: %v", err)
+		}
+		if err = tagLocked(ref, id); err != nil {
+			return err
+		}
+		return markLegacyImported(ref)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+/*
+markLegacyImported 把已经导入的镜像tar包重命名，删除镜像后不会再从tar包导入
+*/
+func markLegacyImported(ref *Reference) error {
+	err := os.Rename(path.ImagePath(ref.Repository), path.ImportedImagePath(ref.Repository))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.Rename err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package image
+
+import (
+	"strings"
+	"testing"
+
+	"mydocker/path"
+)
+
+func TestResolveShortID(t *testing.T) {
+	oldRoot := path.DataRoot()
+	t.Cleanup(func() {
+		path.SetDataRoot(oldRoot)
+	})
+	path.SetDataRoot(t.TempDir())
+
+	id, err := Create(&Image{Config: Config{Cmd: []string{"/hello"}}})
+	if err != nil {
+		t.Fatalf("Create err: %v", err)
+	}
+	got, _, err := Resolve(id.Hex()[:12])
+	if err != nil || got != id {
+		t.Errorf("Resolve(%q) = %s, %v, want %s", id.Hex()[:12], got, err, id)
+	}
+
+	// 两个镜像id有相同的前缀，短id有歧义时不能当作镜像不存在
+	prefix := "abcdef"
+	for _, suffix := range []string{"1", "2"} {
+		if err = Register(Digest(digestPrefix + prefix + strings.Repeat("0", 57) + suffix)); err != nil {
+			t.Fatalf("Register err: %v", err)
+		}
+	}
+	if _, _, err = Resolve(prefix); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("Resolve(%q) err = %v, want ambiguous", prefix, err)
+	}
+	if _, _, err = Resolve("nosuchimage"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Resolve(nosuchimage) err = %v, want not found", err)
+	}
+}
@@ -0,0 +1,103 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 解析符号链接的最大次数，防止循环链接
+const maxSymlinks = 255
+
+/*
+Lstat 在镜像各层合并后的文件系统中查找文件，不跟随符号链接
+按overlay的规则从顶层到底层查找，whiteout文件、opaque目录和上层的非目录文件遮住下层的内容
+*/
+func Lstat(img *Image, name string) (os.FileInfo, error) {
+	_, fi, err := lookup(img, name)
+	return fi, err
+}
+
+/*
+ResolvePath 解析镜像文件系统中路径的符号链接，链接的目标限制在镜像根目录之内
+路径不存在的部分保持不变，返回绝对路径
+*/
+func ResolvePath(img *Image, name string) (string, error) {
+	resolved, links := "/", 0
+	rest := strings.Split(filepath.Clean("/"+name), "/")
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		if part == "" {
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		file, fi, err := lookup(img, next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", name)
+		}
+		target, err := os.Readlink(file)
+		if err != nil {
+			return "", fmt.Errorf("os.Readlink err: %v", err)
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+/*
+lookup 返回文件所在层中的路径和文件信息
+*/
+func lookup(img *Image, name string) (string, os.FileInfo, error) {
+	dirs, err := LayerDirs(img, nil, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	name = filepath.Clean("/" + name)
+	for _, dir := range dirs {
+		file := filepath.Join(dir, name)
+		if fi, err := os.Lstat(file); err == nil {
+			if isWhiteout(fi) {
+				break
+			}
+			return file, fi, nil
+		}
+		if hidden(dir, name) {
+			break
+		}
+	}
+	return "", nil, os.ErrNotExist
+}
+
+/*
+hidden 判断这一层是否遮住了下层中的name: 上级路径是whiteout、非目录文件或者opaque目录
+*/
+func hidden(dir string, name string) bool {
+	for parent := filepath.Dir(name); parent != "/"; parent = filepath.Dir(parent) {
+		fi, err := os.Lstat(filepath.Join(dir, parent))
+		if err != nil {
+			continue
+		}
+		if !fi.IsDir() {
+			return true
+		}
+		if value, err := getXattr(filepath.Join(dir, parent), overlayXattr("opaque")); err == nil && string(value) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+func isWhiteout(fi os.FileInfo) bool {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
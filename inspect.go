@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"mydocker/image"
+)
+
+/*
+inspectContainer 以json格式打印容器信息
+*/
+func inspectContainer(containerName string) error {
+	info, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("getContainerInfoByName err: %v", err)
+	}
+	content, err := json.MarshalIndent(info, "", "    ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent err: %v", err)
+	}
+	if _, err = fmt.Fprintln(os.Stdout, string(content)); err != nil {
+		return fmt.Errorf("fmt.Fprintln err: %v", err)
+	}
+	return nil
+}
+
+/*
+imageInspect image inspect输出的镜像信息
+Size为所有层的总大小，VirtualSize与Size相同，与docker一致保留该字段
+*/
+type imageInspect struct {
+	Id           image.Digest
+	RepoTags     []string
+	Created      *time.Time
+	Author       string
+	Comment      string
+	Architecture string
+	Os           string
+	Config       image.Config
+	Labels       map[string]string
+	RootFS       imageRootFS
+	Layers       []layerInspect
+	Size         int64
+	VirtualSize  int64
+}
+
+/*
+imageRootFS 镜像的diff id列表，从底层到顶层
+*/
+type imageRootFS struct {
+	Type   string
+	Layers []image.Digest
+}
+
+/*
+layerInspect 存储中的层: blob的摘要和解压后的大小
+*/
+type layerInspect struct {
+	Digest image.Digest
+	Size   int64
+}
+
+/*
+inspectImages 打印镜像的配置、层和大小，默认输出json数组，format不为空时按go模板输出每个镜像
+*/
+func inspectImages(format string, imageNames []string) error {
+	var tmpl *template.Template
+	if format != "" {
+		var err error
+		if tmpl, err = parseFormat(format); err != nil {
+			return err
+		}
+	}
+	references, err := image.References()
+	if err != nil {
+		return fmt.Errorf("image.References err: %v", err)
+	}
+	inspects := make([]*imageInspect, 0, len(imageNames))
+	for _, name := range imageNames {
+		id, img, err := image.Resolve(name)
+		if err != nil {
+			return err
+		}
+		inspect := &imageInspect{
+			Id:           id,
+			RepoTags:     make([]string, 0),
+			Created:      img.Created,
+			Author:       img.Author,
+			Architecture: img.Architecture,
+			Os:           img.OS,
+			Config:       img.Config,
+			Labels:       img.Config.Labels,
+			RootFS:       imageRootFS{Type: img.RootFS.Type, Layers: img.RootFS.DiffIDs},
+			Layers:       make([]layerInspect, 0, len(img.RootFS.DiffIDs)),
+		}
+		for _, ref := range references[id] {
+			if ref.Tag != "" {
+				inspect.RepoTags = append(inspect.RepoTags, ref.String())
+			}
+		}
+		if n := len(img.History); n > 0 {
+			inspect.Comment = img.History[n-1].Comment
+		}
+		// 层的blob是未压缩的tar包，摘要即为diff id
+		for _, diffID := range img.RootFS.DiffIDs {
+			layer := layerInspect{Digest: diffID}
+			if l, err := image.GetLayer(diffID); err == nil {
+				layer.Size = l.Size
+			}
+			inspect.Layers = append(inspect.Layers, layer)
+			inspect.Size += layer.Size
+		}
+		inspect.VirtualSize = inspect.Size
+		inspects = append(inspects, inspect)
+	}
+	if tmpl == nil {
+		content, err := json.MarshalIndent(inspects, "", "    ")
+		if err != nil {
+			return fmt.Errorf("json.MarshalIndent err: %v", err)
+		}
+		if _, err = fmt.Fprintln(os.Stdout, string(content)); err != nil {
+			return fmt.Errorf("fmt.Fprintln err: %v", err)
+		}
+		return nil
+	}
+	for _, inspect := range inspects {
+		if err = executeFormat(tmpl, inspect); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+parseFormat 解析--format指定的go模板，支持json和join函数，例如{{json .Config}}、{{join .RepoTags ","}}
+*/
+func parseFormat(format string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			content, err := json.Marshal(v)
+			return string(content), err
+		},
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+	tmpl, err := template.New("format").Funcs(funcs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format: %v", err)
+	}
+	return tmpl, nil
+}
+
+/*
+executeFormat 按模板输出一项，每项一行
+*/
+func executeFormat(tmpl *template.Template, data interface{}) error {
+	if err := tmpl.Execute(os.Stdout, data); err != nil {
+		return fmt.Errorf("tmpl.Execute err: %v", err)
+	}
+	if _, err := fmt.Fprintln(os.Stdout); err != nil {
+		return fmt.Errorf("fmt.Fprintln err: %v", err)
+	}
+	return nil
+}
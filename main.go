@@ -7,18 +7,39 @@ import (
 	"github.com/urfave/cli"
 
 	"mydocker/app"
+	"mydocker/cgroups"
 )
 
 func main() {
 	a := cli.NewApp()
 	a.Name = app.Name
 	a.Usage = app.Usage
+	a.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "cgroup-parent",
+			Value: cgroups.DefaultCgroupParent,
+			Usage: "default cgroup parent for containers",
+		},
+	}
 	a.Commands = []cli.Command{
 		runCommand,
 		initCommand,
+		monitorCommand,
 		commitCommand,
 		psCommand,
+		inspectCommand,
+		eventsCommand,
 		imagesCommand,
+		tagCommand,
+		rmiCommand,
+		imageCommand,
+		historyCommand,
+		saveCommand,
+		loadCommand,
+		buildCommand,
+		pullCommand,
+		pushCommand,
+		registryCommand,
 		logCommand,
 		execCommand,
 		stopCommand,
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"mydocker/cgroups"
+	"mydocker/container"
+	"mydocker/path"
+)
+
+const (
+	// memory.pressure中some avg10超过该值(%)认为容器处于内存压力之下
+	memoryPressureThreshold = 10.0
+	// 内存压力没有通知，按该间隔检查，avg10是10秒窗口的平均值，更频繁地检查没有意义
+	memoryPressureInterval = 10 * time.Second
+	// 无法用pidfd等待进程退出时检查进程是否存在的间隔
+	processPollInterval = time.Second
+)
+
+/*
+syncMemoryEvents 从容器cgroup中读取oom计数和内存压力，与记录的容器信息比较，有新的事件则记录事件
+返回容器信息是否发生变化
+*/
+func syncMemoryEvents(info *container.Info) (bool, error) {
+	if info.CgroupPath == "" {
+		return false, nil
+	}
+	manager, err := cgroups.NewManager(info.CgroupPath)
+	if err != nil {
+		return false, fmt.Errorf("cgroups.NewManager err: %v", err)
+	}
+	events, err := manager.MemoryEvents()
+	if err != nil {
+		return false, fmt.Errorf("manager.MemoryEvents err: %v", err)
+	}
+	changed := false
+	if events.Oom > info.OOMCount {
+		if err = emitEvent(info, eventOOM, map[string]string{"count": strconv.FormatUint(events.Oom, 10)}); err != nil {
+			return false, fmt.Errorf("emitEvent err: %v", err)
+		}
+		info.OOMCount = events.Oom
+		changed = true
+	}
+	if events.OomKill > info.OOMKillCount {
+		if err = emitEvent(info, eventOOMKill, map[string]string{"count": strconv.FormatUint(events.OomKill, 10)}); err != nil {
+			return false, fmt.Errorf("emitEvent err: %v", err)
+		}
+		info.OOMKilled = true
+		info.OOMKillCount = events.OomKill
+		changed = true
+	}
+	underPressure := events.PressureSome >= memoryPressureThreshold
+	if underPressure != info.MemPressure {
+		if underPressure {
+			attributes := map[string]string{
+				"some": strconv.FormatFloat(events.PressureSome, 'f', 2, 64),
+				"full": strconv.FormatFloat(events.PressureFull, 'f', 2, 64),
+			}
+			if err = emitEvent(info, eventMemoryPressure, attributes); err != nil {
+				return false, fmt.Errorf("emitEvent err: %v", err)
+			}
+		}
+		info.MemPressure = underPressure
+		changed = true
+	}
+	// init进程因oom被杀死后不会再有人更新容器状态
+	if info.OOMKilled && info.Status == container.RUNNING && !processExist(info.Pid) {
+		info.Status = container.Exit
+		changed = true
+	}
+	return changed, nil
+}
+
+/*
+syncStoredContainerInfo 持有容器信息的锁读取保存的容器信息并同步内存事件，有变化则保存，
+避免与其他命令对容器信息的修改互相覆盖，返回同步后的容器信息
+容器已经被删除时不做任何事，返回nil
+*/
+func syncStoredContainerInfo(containerName string) (*container.Info, error) {
+	var info *container.Info
+	err := withContainerInfoLock(containerName, func() error {
+		if _, err := os.Stat(path.InfoPath(containerName)); err != nil {
+			return err
+		}
+		var err error
+		if info, err = getContainerInfoByName(containerName); err != nil {
+			return fmt.Errorf("getContainerInfoByName err: %v", err)
+		}
+		changed, err := syncMemoryEvents(info)
+		if err != nil {
+			return fmt.Errorf("syncMemoryEvents err: %v", err)
+		}
+		if !changed {
+			return nil
+		}
+		return dumpContainerInfo(info)
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return info, err
+}
+
+/*
+watchMemoryEvents 容器运行期间监听内存事件，done关闭后退出
+oom事件由cgroup通知(v2 inotify memory.events，v1 eventfd)，只有cgroup v2的内存压力需要定期检查，
+无法注册通知时退化为定期检查
+*/
+func watchMemoryEvents(info *container.Info, refresh func(), done <-chan struct{}) {
+	if info.CgroupPath == "" {
+		return
+	}
+	var notify <-chan struct{}
+	if manager, err := cgroups.NewManager(info.CgroupPath); err != nil {
+		log.Warnf("cgroups.NewManager err: %v", err)
+	} else if notify, err = manager.NotifyMemoryEvents(done); err != nil {
+		log.Warnf("manager.NotifyMemoryEvents err: %v", err)
+	}
+	// cgroup v1没有cgroup级别的PSI
+	unified, err := cgroups.IsUnified()
+	if err != nil {
+		log.Warnf("cgroups.IsUnified err: %v", err)
+	}
+	var tick <-chan time.Time
+	if notify == nil || unified {
+		ticker := time.NewTicker(memoryPressureInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-notify:
+			if !ok {
+				notify = nil
+				continue
+			}
+			refresh()
+		case <-tick:
+			refresh()
+		}
+	}
+}
+
+/*
+startMonitor 启动后台容器的监控进程 /proc/self/exe monitor [name]，监控进程不随mydocker run退出
+*/
+func startMonitor(containerName string) error {
+	cmd := exec.Command("/proc/self/exe", "monitor", containerName)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cmd.Start err: %v", err)
+	}
+	return cmd.Process.Release()
+}
+
+/*
+monitorContainer 监控后台容器，记录oom和内存压力事件，容器进程退出或者容器被删除后结束
+*/
+func monitorContainer(containerName string) error {
+	info, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("getContainerInfoByName err: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		waitProcessExit(info.Pid)
+		close(done)
+	}()
+	watchMemoryEvents(info, func() {
+		if _, err := syncStoredContainerInfo(containerName); err != nil {
+			log.Warnf("syncStoredContainerInfo err: %v", err)
+		}
+	}, done)
+	// 容器退出后最后同步一次，记录导致退出的oom
+	_, err = syncStoredContainerInfo(containerName)
+	return err
+}
+
+/*
+waitProcessExit 等待进程退出，监控进程不是容器进程的父进程，不能wait，
+用pidfd在进程退出时得到通知，内核不支持pidfd时定期检查进程是否存在
+*/
+func waitProcessExit(pid string) {
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return
+	}
+	if fd, err := unix.PidfdOpen(p, 0); err == nil {
+		defer func() {
+			_ = unix.Close(fd)
+		}()
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for {
+			if _, err = unix.Poll(fds, -1); err != unix.EINTR {
+				return
+			}
+		}
+	} else if err == unix.ESRCH {
+		return
+	}
+	for processExist(pid) {
+		time.Sleep(processPollInterval)
+	}
+}
+
+/*
+判断进程是否存在，已经退出但还没有被回收的僵尸进程视为不存在
+*/
+func processExist(pid string) bool {
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return false
+	}
+	if syscall.Kill(p, 0) != nil {
+		return false
+	}
+	// /proc/[pid]/stat的格式为"pid (comm) state ..."，comm中可能有空格和括号
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", p))
+	if err != nil {
+		return true
+	}
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	return len(fields) == 0 || fields[0] != "Z"
+}
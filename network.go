@@ -17,8 +17,11 @@ import (
 	"mydocker/network"
 )
 
-// 每次运行前都设置一下ipv4转发
-func init() {
+/*
+enableIPForward 开启ipv4转发
+只在需要网络的命令中调用，不放在init中，避免exec进入容器时在容器内执行
+*/
+func enableIPForward() {
 	// 执行sysctl命令
 	cmd := exec.Command("sysctl", "net.ipv4.ip_forward=1")
 	_, err := cmd.CombinedOutput()
@@ -56,6 +59,7 @@ func CreateNetwork(driverName, subnet, gateway, networkName string) error {
 	if err != nil {
 		return fmt.Errorf("network.NewNetwork err: %v", err)
 	}
+	enableIPForward()
 	// 网络驱动创建子网
 	_, err = driver.Create(nw)
 	if err != nil {
@@ -84,6 +88,7 @@ func Connect(networkName string, cInfo *container.Info) error {
 	if !b {
 		return fmt.Errorf("no such driver: %v", nw.Driver)
 	}
+	enableIPForward()
 	peerVethIp, err := nw.AllocateIp()
 	if err != nil {
 		return fmt.Errorf("nw.AllocateIp err: %v", err)
@@ -109,6 +114,7 @@ func Connect(networkName string, cInfo *container.Info) error {
 	if err = configPortMappings(device.Addr, cInfo); err != nil { // 配置端口映射
 		return fmt.Errorf("configPortMappings err: %v", err)
 	}
+	cInfo.IPAddress = peerVethIp.String()
 	nw.Devices = append(nw.Devices, device)
 	// 保存网络配置
 	if err = nw.Dump(); err != nil {
@@ -319,7 +325,7 @@ func enterContainerNetns(pid string) (func(), error) {
 	}
 	return func() {
 		if err = netns.Set(originNs); err != nil {
-			log.Error("netns.Set err: %v", err)
+			log.Errorf("netns.Set err: %v", err)
 		}
 		runtime.UnlockOSThread()
 		_ = originNs.Close()
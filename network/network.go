@@ -117,28 +117,21 @@ func (n *Network) ReleaseIp(ip net.IP) error {
 	return nil
 }
 
-func init() {
-	networkPath := path.NetworkPath()
-	// 检查保存的目录是否存在，不存在就创建
-	if _, err := os.Stat(networkPath); err != nil {
-		if os.IsNotExist(err) {
-			if err = os.MkdirAll(networkPath, 0644); err != nil {
-				panic("os.MkdirAll err: " + err.Error())
-			}
-		} else {
-			panic("os.Stat err: " + err.Error())
-		}
-	}
-}
-
 /*
 LoadAllNetworks 加载所有Networks
 */
 func LoadAllNetworks() map[string]*Network {
 	networks := make(map[string]*Network)
 	networkPath := path.NetworkPath()
+	// 目录还未创建说明没有任何网络
+	if _, err := os.Stat(networkPath); os.IsNotExist(err) {
+		return networks
+	}
 	// 加载所有network配置
 	if err := filepath.Walk(networkPath, func(nwFilePath string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -164,6 +157,10 @@ Dump 保存网络信息
 */
 func (n *Network) Dump() error {
 	networkPath := path.NetworkPath()
+	// 保存的目录在第一次使用时创建，不放在init中，避免exec进入容器时在容器内创建
+	if err := os.MkdirAll(networkPath, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
 	filePath := path2.Join(networkPath, n.Name+".json")
 	content, err := json.Marshal(n)
 	if err != nil {
@@ -9,6 +9,7 @@ package nsenter
 #include <stdlib.h>
 #include <string.h>
 #include <fcntl.h>
+#include <sys/wait.h>
 
 __attribute__((constructor)) void enter_namespace(void) {
 	// 从环境变量中获取需要进入容器的pid
@@ -28,9 +29,20 @@ __attribute__((constructor)) void enter_namespace(void) {
 	}
 	int i;
 	char nspath[1024];
-	// 需要进入的五种Namespace
-	char *namespace[] = {"ipc","uts","net","pid","mnt"};
-	for (i=0;i < 5;i++) {
+	// 容器有独立的user namespace时先进入user namespace，才有权限进入其余namespace
+	if (getenv("mydocker_userns")) {
+		sprintf(nspath,"/proc/%s/ns/user",mydocker_pid);
+		int fd = open(nspath,O_RDONLY);
+		// 进入user namespace失败时没有权限进入其余namespace，继续执行会留在宿主机上，直接退出
+		if (setns(fd,0) == -1) {
+			fprintf(stderr, "setns on user namespace failed: %s\n", strerror(errno));
+			exit(1);
+		}
+		close(fd);
+	}
+	// 需要进入的六种Namespace
+	char *namespace[] = {"ipc","uts","net","pid","cgroup","mnt"};
+	for (i=0;i < 6;i++) {
 		// 拼接对应的路径
 		sprintf(nspath,"/proc/%s/ns/%s",mydocker_pid,namespace[i]);
 		int fd = open(nspath,O_RDONLY);
@@ -40,9 +52,21 @@ __attribute__((constructor)) void enter_namespace(void) {
 		}
 		close(fd);
 	}
-	// 执行指令
-	int res = system(mydocker_cmd);
-	exit(0);
+	// 进入pid namespace只对子进程生效，fork出子进程回到go代码中设置capability等安全配置后执行指令
+	pid_t child = fork();
+	if (child == -1) {
+		fprintf(stderr, "fork failed: %s\n", strerror(errno));
+		exit(1);
+	}
+	if (child == 0) {
+		return;
+	}
+	int status;
+	if (waitpid(child, &status, 0) == -1) {
+		fprintf(stderr, "waitpid failed: %s\n", strerror(errno));
+		exit(1);
+	}
+	exit(WIFEXITED(status) ? WEXITSTATUS(status) : 1);
 }
 */
 import "C" // 必须紧贴在代码下面
@@ -2,64 +2,214 @@ package path
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 
 	"mydocker/app"
 )
 
 const (
-	// 镜像容器存储路径
-	overlayUnionLocation = "/var/lib/" + app.Name + "/overlay" // 联合文件系统
+	// 镜像容器存储路径(相对于数据根目录)
+	overlayUnionLocation = "/overlay" // 联合文件系统
 	imageStoragePath     = overlayUnionLocation + "/image"
-	imagePath            = imageStoragePath + "/%s.tar"
+	imagePath            = imageStoragePath + "/%s.tar"           // 导入镜像存储之前的镜像tar包
+	importedImagePath    = imageStoragePath + "/%s.tar.imported"  // 已经导入镜像存储的镜像tar包，不会再次导入
 	containerUnionPath   = overlayUnionLocation + "/container/%s" // 容器目录（%s为容器名称）
 	mntPath              = containerUnionPath + "/mnt"            // 挂载路径 （%s为容器名称）
 	lowerPath            = containerUnionPath + "/lower"          // lower路径 （%s为容器名称）
 	upperPath            = containerUnionPath + "/upper"          // upper路径 （%s为容器名称）
 	workerPath           = containerUnionPath + "/worker"         // worker路径 （%s为容器名称）
-	// 容器基本信息
-	containerInfoLocation = "/var/run/" + app.Name + "/container"
+	layerLinksPath       = containerUnionPath + "/l"              // 指向镜像各层的短符号链接 （%s为容器名称）
+	// 镜像存储(相对于数据根目录)，层和blob按sha256摘要寻址，多个镜像、容器共享
+	imageLocation         = "/image"
+	layersPath            = imageLocation + "/layers/sha256"
+	layerPath             = layersPath + "/%s" // 层目录（%s为diff id的十六进制摘要）
+	blobsPath             = imageLocation + "/blobs/sha256"
+	blobPath              = blobsPath + "/%s" // 层tar包、镜像配置（%s为十六进制摘要）
+	imagesPath            = imageLocation + "/images/sha256"
+	imageEntryPath        = imagesPath + "/%s"                   // 镜像列表（%s为镜像id的十六进制摘要），镜像配置保存在blob中
+	repositoriesPath      = imageLocation + "/repositories.json" // 镜像名称索引
+	imageTmpPath          = imageLocation + "/tmp"               // 导入过程中的临时文件，与存储在同一文件系统便于rename
+	imageLockPath         = imageLocation + "/lock"
+	buildCachePath        = imageLocation + "/buildcache.json" // 构建缓存，构建步骤 -> 中间镜像id
+	leasesPath            = imageLocation + "/leases"
+	leasePath             = leasesPath + "/%s" // 构建、拉取过程中持有的租约，GC保留其中的层（%s为进程号-随机数）
+	downloadsPath         = imageLocation + "/downloads"
+	downloadPath          = downloadsPath + "/%s" // pull下载中的层（%s为压缩后层的十六进制摘要），中断后可以继续下载
+	registryPath          = imageLocation + "/registry"
+	uploadPath            = registryPath + "/uploads/%s" // registry serve接收中的上传（%s为上传id）
+	stagedBlobPath        = registryPath + "/blobs/%s"   // 上传完成、等待清单导入的blob（%s为十六进制摘要）
+	registryManifestsPath = registryPath + "/manifests"
+	registryManifestPath  = registryManifestsPath + "/%s" // 推送的清单，按原样返回给客户端（%s为镜像id的十六进制摘要）
+	// 容器基本信息(相对于运行时根目录)
+	containerInfoLocation = "/container"
 	containerInfoPath     = containerInfoLocation + "/%s"
 	infoPath              = containerInfoPath + "/info.json"
+	infoLockPath          = containerInfoPath + "/info.lock" // 修改info.json时持有的文件锁
 	logPath               = containerInfoPath + "/container.log"
+	hostsPath             = containerInfoPath + "/hosts"       // 绑定挂载到容器的/etc/hosts
+	resolvConfPath        = containerInfoPath + "/resolv.conf" // 绑定挂载到容器的/etc/resolv.conf
+	hostnamePath          = containerInfoPath + "/hostname"    // 绑定挂载到容器的/etc/hostname
+	eventsPath            = "/events.log"                      // 事件记录
 	// 网络配置存储目录
-	networkLocation = "/var/run/" + app.Name + "/network"
+	networkLocation = "/network"
 	networkPath     = networkLocation + "/network"
 )
 
+var (
+	dataRoot = "/var/lib/" + app.Name // 数据根目录，存放镜像和容器文件系统
+	runRoot  = "/var/run/" + app.Name // 运行时根目录，存放容器信息
+)
+
+/*
+非root用户运行时(rootless)，数据根目录为$XDG_DATA_HOME/mydocker，运行时根目录为$XDG_RUNTIME_DIR/mydocker
+*/
+func init() {
+	if !Rootless() {
+		return
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+	dataRoot = filepath.Join(dataHome, app.Name)
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join(os.TempDir(), app.Name+"-"+strconv.Itoa(os.Geteuid()))
+	}
+	runRoot = filepath.Join(runtimeDir, app.Name)
+}
+
+/*
+Rootless 是否以非root用户运行
+*/
+func Rootless() bool {
+	return os.Geteuid() != 0
+}
+
+func DataRoot() string {
+	return dataRoot
+}
+
+/*
+SetDataRoot 修改数据根目录，测试中使用临时目录作为镜像存储
+*/
+func SetDataRoot(root string) {
+	dataRoot = root
+}
 func ImageStoragePath() string {
-	return imageStoragePath
+	return dataRoot + imageStoragePath
 }
 func ImagePath(imageName string) string {
-	return fmt.Sprintf(imagePath, imageName)
+	return dataRoot + fmt.Sprintf(imagePath, imageName)
+}
+func ImportedImagePath(imageName string) string {
+	return dataRoot + fmt.Sprintf(importedImagePath, imageName)
+}
+func ImageLocation() string {
+	return dataRoot + imageLocation
+}
+func LayersPath() string {
+	return dataRoot + layersPath
+}
+func LayerPath(hex string) string {
+	return dataRoot + fmt.Sprintf(layerPath, hex)
+}
+func BlobsPath() string {
+	return dataRoot + blobsPath
+}
+func BlobPath(hex string) string {
+	return dataRoot + fmt.Sprintf(blobPath, hex)
+}
+func ImagesPath() string {
+	return dataRoot + imagesPath
+}
+func ImageEntryPath(hex string) string {
+	return dataRoot + fmt.Sprintf(imageEntryPath, hex)
+}
+func RepositoriesPath() string {
+	return dataRoot + repositoriesPath
+}
+func ImageTmpPath() string {
+	return dataRoot + imageTmpPath
+}
+func BuildCachePath() string {
+	return dataRoot + buildCachePath
+}
+func LeasesPath() string {
+	return dataRoot + leasesPath
+}
+func LeasePath(name string) string {
+	return dataRoot + fmt.Sprintf(leasePath, name)
+}
+func DownloadsPath() string {
+	return dataRoot + downloadsPath
+}
+func DownloadPath(hex string) string {
+	return dataRoot + fmt.Sprintf(downloadPath, hex)
+}
+func UploadPath(uuid string) string {
+	return dataRoot + fmt.Sprintf(uploadPath, uuid)
+}
+func StagedBlobPath(hex string) string {
+	return dataRoot + fmt.Sprintf(stagedBlobPath, hex)
+}
+func RegistryManifestsPath() string {
+	return dataRoot + registryManifestsPath
+}
+func RegistryManifestPath(hex string) string {
+	return dataRoot + fmt.Sprintf(registryManifestPath, hex)
+}
+func ImageLockPath() string {
+	return dataRoot + imageLockPath
 }
 func ContainerUnionPath(containerName string) string {
-	return fmt.Sprintf(containerUnionPath, containerName)
+	return dataRoot + fmt.Sprintf(containerUnionPath, containerName)
 }
 func MntPath(containerName string) string {
-	return fmt.Sprintf(mntPath, containerName)
+	return dataRoot + fmt.Sprintf(mntPath, containerName)
 }
 func LowerPath(containerName string) string {
-	return fmt.Sprintf(lowerPath, containerName)
+	return dataRoot + fmt.Sprintf(lowerPath, containerName)
 }
 func UpperPath(containerName string) string {
-	return fmt.Sprintf(upperPath, containerName)
+	return dataRoot + fmt.Sprintf(upperPath, containerName)
 }
 func WorkerPath(containerName string) string {
-	return fmt.Sprintf(workerPath, containerName)
+	return dataRoot + fmt.Sprintf(workerPath, containerName)
+}
+func LayerLinksPath(containerName string) string {
+	return dataRoot + fmt.Sprintf(layerLinksPath, containerName)
 }
 func ContainerInfoLocation() string {
-	return containerInfoLocation
+	return runRoot + containerInfoLocation
 }
 func ContainerInfoPath(containerName string) string {
-	return fmt.Sprintf(containerInfoPath, containerName)
+	return runRoot + fmt.Sprintf(containerInfoPath, containerName)
 }
 func InfoPath(containerName string) string {
-	return fmt.Sprintf(infoPath, containerName)
+	return runRoot + fmt.Sprintf(infoPath, containerName)
+}
+func InfoLockPath(containerName string) string {
+	return runRoot + fmt.Sprintf(infoLockPath, containerName)
 }
 func LogPath(containerName string) string {
-	return fmt.Sprintf(logPath, containerName)
+	return runRoot + fmt.Sprintf(logPath, containerName)
+}
+func HostsPath(containerName string) string {
+	return runRoot + fmt.Sprintf(hostsPath, containerName)
+}
+func ResolvConfPath(containerName string) string {
+	return runRoot + fmt.Sprintf(resolvConfPath, containerName)
+}
+func HostnamePath(containerName string) string {
+	return runRoot + fmt.Sprintf(hostnamePath, containerName)
+}
+func EventsPath() string {
+	return runRoot + eventsPath
 }
 
 func NetworkPath() string {
-	return networkPath
+	return runRoot + networkPath
 }
@@ -11,10 +11,37 @@ import (
 )
 
 func listContainers() error {
+	infos, err := listContainerInfos()
+	if err != nil {
+		return fmt.Errorf("listContainerInfos err: %v", err)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	// 控制台输出的信息列
+	_, err = fmt.Fprintf(writer, "ID\tNAME\tPID\tSTATUS\tOOMKILLED\tCOMMAND\tCREATED\n")
+	if err != nil {
+		return fmt.Errorf("fmt.Fprintf: %v", err)
+	}
+	for _, info := range infos {
+		_, err = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n", info.Id, info.Name, info.Pid, info.Status, info.OOMKilled, info.Command, info.CreateTime)
+		if err != nil {
+			return fmt.Errorf("fmt.Fprintf: %v", err)
+		}
+	}
+	// 刷新，使容器列表打印出来
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("flush err: %v", err)
+	}
+	return nil
+}
+
+/*
+listContainerInfos 读取所有容器的信息
+*/
+func listContainerInfos() ([]container.Info, error) {
 	// 读取容器存储目录下的所有文件
 	entries, err := os.ReadDir(path.ContainerInfoLocation())
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("os.ReadDir err: %v", err)
+		return nil, fmt.Errorf("os.ReadDir err: %v", err)
 	}
 	infos := make([]container.Info, 0, len(entries))
 	for _, entry := range entries {
@@ -23,30 +50,14 @@ func listContainers() error {
 			configFilePath := path.InfoPath(containerName)
 			content, err := os.ReadFile(configFilePath)
 			if err != nil {
-				return fmt.Errorf("os.ReadFile err: %v", err)
+				return nil, fmt.Errorf("os.ReadFile err: %v", err)
 			}
 			var info container.Info
 			if err = json.Unmarshal(content, &info); err != nil {
-				return fmt.Errorf("json.Unmarshal err: %v", err)
+				return nil, fmt.Errorf("json.Unmarshal err: %v", err)
 			}
 			infos = append(infos, info)
 		}
 	}
-	writer := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	// 控制台输出的信息列
-	_, err = fmt.Fprintf(writer, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
-	if err != nil {
-		return fmt.Errorf("fmt.Fprintf: %v", err)
-	}
-	for _, info := range infos {
-		_, err = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Id, info.Name, info.Pid, info.Status, info.Command, info.CreateTime)
-		if err != nil {
-			return fmt.Errorf("fmt.Fprintf: %v", err)
-		}
-	}
-	// 刷新，使容器列表打印出来
-	if err = writer.Flush(); err != nil {
-		return fmt.Errorf("flush err: %v", err)
-	}
-	return nil
+	return infos, nil
 }
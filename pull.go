@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"mydocker/registry"
+)
+
+/*
+pullImage 从registry拉取镜像，user的格式为用户名:密码，socket不为空时通过unix socket访问registry
+*/
+func pullImage(name string, user string, insecure bool, socket string) error {
+	if _, err := registry.Pull(name, registryOptions(user, insecure, socket), os.Stdout); err != nil {
+		return fmt.Errorf("registry.Pull err: %v", err)
+	}
+	return nil
+}
+
+func registryOptions(user string, insecure bool, socket string) *registry.Options {
+	username, password, _ := strings.Cut(user, ":")
+	return &registry.Options{Username: username, Password: password, Insecure: insecure, Socket: socket}
+}
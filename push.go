@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"mydocker/registry"
+)
+
+/*
+pushImage 把镜像推送到registry
+*/
+func pushImage(name string, compression string, user string, insecure bool, socket string) error {
+	if err := registry.Push(name, compression, registryOptions(user, insecure, socket), os.Stdout); err != nil {
+		return fmt.Errorf("registry.Push err: %v", err)
+	}
+	return nil
+}
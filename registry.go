@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"mydocker/registry"
+)
+
+/*
+serveRegistry 把镜像存储作为registry服务，socket不为空时监听unix socket，否则监听tcp地址
+收到SIGINT、SIGTERM时停止服务并删除unix socket
+*/
+func serveRegistry(addr string, socket string) error {
+	network, address := "tcp", addr
+	if socket != "" {
+		network, address = "unix", socket
+		// 删除上次没有清理的socket文件
+		if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(socket)
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("net.Listen err: %v", err)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		_ = l.Close()
+	}()
+	if tcp, ok := l.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		log.Warnf("registry on %s has no authentication and is reachable from other hosts", l.Addr())
+	}
+	log.Infof("registry listening on %s %s", network, l.Addr())
+	err = registry.Serve(l)
+	if socket != "" {
+		_ = os.Remove(socket)
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("registry.Serve err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mydocker/image"
+)
+
+const (
+	// 镜像名没有registry地址时使用Docker Hub
+	defaultDomain   = "docker.io"
+	defaultRegistry = "registry-1.docker.io"
+	defaultIndex    = "https://index.docker.io/v1/"
+	// Docker Hub的官方镜像在library下
+	officialRepoPrefix = "library/"
+	// 清单的最大大小，防止registry返回过大的内容
+	maxManifestSize = 4 << 20
+)
+
+/*
+Options 连接registry的参数
+*/
+type Options struct {
+	Username string // 用户名和密码为空时使用docker配置文件中保存的认证信息
+	Password string
+	Insecure bool   // 使用http访问registry，localhost默认使用http
+	Socket   string // 不为空时通过unix socket连接registry，使用http
+}
+
+/*
+Client Docker Registry HTTP API v2的客户端，访问一个仓库
+*/
+type Client struct {
+	base     *url.URL // registry地址，如https://registry-1.docker.io
+	name     string   // registry中的仓库名，如library/busybox
+	scope    string   // bearer认证时申请的权限
+	client   *http.Client
+	username string
+	password string
+	auth     string // 认证后的Authorization头
+}
+
+/*
+NewClient 创建访问镜像引用所在仓库的客户端，actions为需要的权限: pull或pull,push
+*/
+func NewClient(ref *image.Reference, actions string, options *Options) (*Client, error) {
+	domain, name := ref.Domain(), ref.Path()
+	host := domain
+	if domain == "" || domain == defaultDomain {
+		domain, host = defaultDomain, defaultRegistry
+		if !strings.Contains(name, "/") {
+			name = officialRepoPrefix + name
+		}
+	}
+	scheme := "https"
+	if options.Insecure || options.Socket != "" || isLocalhost(host) {
+		scheme = "http"
+	}
+	client := &http.Client{}
+	if options.Socket != "" {
+		// 所有请求都连接到unix socket，地址中的host只用于Host头
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", options.Socket)
+			},
+		}
+	}
+	c := &Client{
+		base:     &url.URL{Scheme: scheme, Host: host},
+		name:     name,
+		scope:    fmt.Sprintf("repository:%s:%s", name, actions),
+		client:   client,
+		username: options.Username,
+		password: options.Password,
+	}
+	if c.username == "" {
+		var err error
+		if c.username, c.password, err = configCredentials(domain); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func isLocalhost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+configCredentials 读取docker配置文件($DOCKER_CONFIG/config.json或~/.docker/config.json)中registry的用户名和密码
+*/
+func configCredentials(domain string) (string, string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", "", nil
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err = json.Unmarshal(content, &config); err != nil {
+		return "", "", fmt.Errorf("invalid docker config %s: %v", filepath.Join(dir, "config.json"), err)
+	}
+	keys := []string{domain, "https://" + domain, "http://" + domain}
+	if domain == defaultDomain {
+		keys = append(keys, defaultIndex)
+	}
+	for _, key := range keys {
+		entry, ok := config.Auths[key]
+		if !ok || entry.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth for %s in docker config: %v", key, err)
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return username, password, nil
+	}
+	return "", "", nil
+}
+
+/*
+url 仓库下的API地址，如/v2/<name>/manifests/<reference>
+*/
+func (c *Client) url(format string, args ...interface{}) string {
+	u := *c.base
+	u.Path = fmt.Sprintf("/v2/%s/"+format, append([]interface{}{c.name}, args...)...)
+	return u.String()
+}
+
+/*
+resolve 解析registry返回的Location，可能是相对地址
+*/
+func (c *Client) resolve(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid location %s: %v", location, err)
+	}
+	return c.base.ResolveReference(u).String(), nil
+}
+
+/*
+do 发送请求，返回401时按WWW-Authenticate的要求认证后重试一次
+*/
+func (c *Client) do(method string, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("http.NewRequest err: %v", err)
+		}
+		req.ContentLength = int64(len(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+		if err = c.authenticate(challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+authenticate 根据registry的认证要求设置Authorization头，支持Basic和Bearer token
+*/
+func (c *Client) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry %s requires authentication", c.base.Host)
+		}
+		c.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(params)
+		if err != nil {
+			return err
+		}
+		c.auth = "Bearer " + token
+		return nil
+	}
+	return fmt.Errorf("unsupported authentication challenge: %q", challenge)
+}
+
+/*
+fetchToken 向认证服务申请bearer token，有用户名时使用Basic认证，否则匿名申请
+*/
+func (c *Client) fetchToken(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm: %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	// 推送时registry可能只要求pull权限，同时申请需要的权限
+	for _, scope := range []string{params["scope"], c.scope} {
+		if scope != "" && !contains(query["scope"], scope) {
+			query.Add("scope", scope)
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequest err: %v", err)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: c.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetch token err: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch token err: %s", resp.Status)
+	}
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("json.Decode err: %v", err)
+	}
+	if result.Token != "" {
+		return result.Token, nil
+	}
+	if result.AccessToken != "" {
+		return result.AccessToken, nil
+	}
+	return "", fmt.Errorf("fetch token err: empty token")
+}
+
+/*
+parseChallenge 解析WWW-Authenticate头，如Bearer realm="...",service="...",scope="..."
+*/
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			// 引号中的值可能包含逗号，如scope="repository:a:pull,push"
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return scheme, params
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+checkResponse 检查响应状态码，不符合时返回registry的错误信息
+*/
+func checkResponse(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var result struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(content, &result) == nil && len(result.Errors) > 0 {
+		messages := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			messages = append(messages, e.Code+": "+e.Message)
+		}
+		return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Status, strings.Join(messages, "; "))
+	}
+	return fmt.Errorf("%s %s", resp.Request.Method, resp.Status)
+}
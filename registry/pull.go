@@ -0,0 +1,346 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"mydocker/image"
+	"mydocker/path"
+)
+
+const (
+	// 下载层中断时续传的次数
+	maxRetries = 3
+)
+
+// 获取清单时接受的媒体类型
+var manifestMediaTypes = []string{
+	image.MediaTypeImageIndex,
+	image.MediaTypeDockerManifestList,
+	image.MediaTypeImageManifest,
+	image.MediaTypeDockerManifest,
+}
+
+/*
+Pull 从registry拉取镜像到镜像存储，返回镜像id
+镜像索引中选择与当前主机平台一致的清单，所有内容都校验摘要，层下载中断时从已下载的位置继续
+*/
+func Pull(name string, options *Options, out io.Writer) (image.Digest, error) {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return "", err
+	}
+	c, err := NewClient(ref, "pull", options)
+	if err != nil {
+		return "", err
+	}
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest.String()
+	}
+	_, _ = fmt.Fprintf(out, "%s: Pulling from %s\n", reference, c.name)
+	manifest, manifestDigest, err := c.getImageManifest(reference, ref.Digest)
+	if err != nil {
+		return "", err
+	}
+	config, err := c.getBlob(manifest.Config)
+	if err != nil {
+		return "", fmt.Errorf("get config err: %v", err)
+	}
+	var img image.Image
+	if err = json.Unmarshal(config, &img); err != nil {
+		return "", fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return "", fmt.Errorf("config has %d diff ids but manifest has %d layers", len(img.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	// 注册镜像之前层不被任何镜像使用，先加入租约再检查层是否存在，避免并发的rmi、prune删除
+	lease, err := image.NewLease()
+	if err != nil {
+		return "", err
+	}
+	defer lease.Release()
+	if err = lease.Add(img.RootFS.DiffIDs...); err != nil {
+		return "", err
+	}
+	_, getErr := image.Get(manifest.Config.Digest)
+	upToDate := getErr == nil
+	for i, desc := range manifest.Layers {
+		diffID := img.RootFS.DiffIDs[i]
+		if image.LayerExist(diffID) {
+			_, _ = fmt.Fprintf(out, "%s: Already exists\n", desc.Digest.Short())
+			continue
+		}
+		upToDate = false
+		if err = c.pullLayer(desc, diffID); err != nil {
+			return "", fmt.Errorf("pull layer %s err: %v", desc.Digest, err)
+		}
+		_, _ = fmt.Fprintf(out, "%s: Pull complete\n", desc.Digest.Short())
+	}
+	id, err := image.WriteBlob(config)
+	if err != nil {
+		return "", fmt.Errorf("image.WriteBlob err: %v", err)
+	}
+	if err = image.Register(id); err != nil {
+		return "", err
+	}
+	// 按摘要拉取时没有标签可以记录
+	if ref.Digest == "" {
+		if err = image.Tag(ref, id); err != nil {
+			return "", fmt.Errorf("image.Tag err: %v", err)
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Digest: %s\n", manifestDigest)
+	if upToDate {
+		_, _ = fmt.Fprintf(out, "Status: Image is up to date for %s\n", ref)
+	} else {
+		_, _ = fmt.Fprintf(out, "Status: Downloaded newer image for %s\n", ref)
+	}
+	return id, nil
+}
+
+/*
+getImageManifest 获取镜像清单，镜像索引(多平台镜像)中选择当前平台的清单，返回清单和清单的摘要
+*/
+func (c *Client) getImageManifest(reference string, expected image.Digest) (*image.Manifest, image.Digest, error) {
+	content, mediaType, d, err := c.getManifest(reference, expected)
+	if err != nil {
+		return nil, "", err
+	}
+	if image.IsIndex(mediaType) {
+		var index image.Index
+		if err = json.Unmarshal(content, &index); err != nil {
+			return nil, "", fmt.Errorf("json.Unmarshal err: %v", err)
+		}
+		found := false
+		for _, desc := range index.Manifests {
+			if desc.Platform == nil || !image.MatchPlatform(desc.Platform) || !image.IsManifest(desc.MediaType) {
+				continue
+			}
+			if content, mediaType, d, err = c.getManifest(desc.Digest.String(), desc.Digest); err != nil {
+				return nil, "", err
+			}
+			found = true
+			break
+		}
+		if !found {
+			return nil, "", fmt.Errorf("no matching manifest for linux/%s in the manifest list entries", runtime.GOARCH)
+		}
+	}
+	if !image.IsManifest(mediaType) {
+		return nil, "", fmt.Errorf("unsupported manifest media type: %s", mediaType)
+	}
+	var manifest image.Manifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, "", fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	return &manifest, d, nil
+}
+
+/*
+getManifest 获取清单或镜像索引并校验摘要，按摘要获取时与请求的摘要比较，否则与registry返回的摘要比较
+*/
+func (c *Client) getManifest(reference string, expected image.Digest) ([]byte, string, image.Digest, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	resp, err := c.do(http.MethodGet, c.url("manifests/%s", reference), header, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err = checkResponse(resp, http.StatusOK); err != nil {
+		return nil, "", "", fmt.Errorf("get manifest %s err: %v", reference, err)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("io.ReadAll err: %v", err)
+	}
+	if len(content) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest %s is too large", reference)
+	}
+	d := image.FromBytes(content)
+	if expected == "" {
+		expected = image.Digest(resp.Header.Get("Docker-Content-Digest"))
+	}
+	if expected != "" && d != expected {
+		return nil, "", "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", expected, d)
+	}
+	// 优先使用清单中的mediaType，registry返回的Content-Type可能是application/json
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err = json.Unmarshal(content, &versioned); err != nil {
+		return nil, "", "", fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	mediaType := versioned.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+	return content, mediaType, d, nil
+}
+
+/*
+getBlob 读取小的blob(镜像配置)并校验摘要和大小
+*/
+func (c *Client) getBlob(desc image.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	resp, err := c.do(http.MethodGet, c.url("blobs/%s", desc.Digest), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err = checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, desc.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll err: %v", err)
+	}
+	if image.FromBytes(content) != desc.Digest || int64(len(content)) != desc.Size {
+		return nil, fmt.Errorf("blob %s digest mismatch", desc.Digest)
+	}
+	return content, nil
+}
+
+/*
+pullLayer 下载层并导入镜像存储，导入时再次校验压缩后的摘要和解压后的diff id
+*/
+func (c *Client) pullLayer(desc image.Descriptor, diffID image.Digest) error {
+	file, err := c.download(desc)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("os.Open err: %v", err)
+	}
+	err = image.ImportVerifiedLayer(f, desc, diffID)
+	_ = f.Close()
+	_ = os.Remove(file)
+	return err
+}
+
+/*
+download 把blob下载到下载目录，已经下载了一部分时用Range请求继续下载，传输中断时重试
+下载完成后校验摘要，不一致时删除文件
+*/
+func (c *Client) download(desc image.Descriptor) (string, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(path.DownloadsPath(), 0755); err != nil {
+		return "", fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	file := path.DownloadPath(desc.Digest.Hex())
+	for attempt := 0; ; attempt++ {
+		retry, err := c.fetchBlob(desc, file)
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= maxRetries {
+			return "", err
+		}
+		log.Warnf("download %s err: %v, resuming", desc.Digest.Short(), err)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("os.Open err: %v", err)
+	}
+	d, size, err := image.FromReader(f)
+	_ = f.Close()
+	if err != nil {
+		return "", err
+	}
+	if d != desc.Digest || size != desc.Size {
+		_ = os.Remove(file)
+		return "", fmt.Errorf("blob digest mismatch: expected %s, got %s", desc.Digest, d)
+	}
+	return file, nil
+}
+
+/*
+fetchBlob 从文件已有的大小开始下载，registry不支持Range请求时重新下载，返回错误是否可以重试
+*/
+func (c *Client) fetchBlob(desc image.Descriptor, file string) (bool, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, fmt.Errorf("os.OpenFile err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, fmt.Errorf("f.Seek err: %v", err)
+	}
+	if offset == desc.Size {
+		return false, nil
+	}
+	if offset > desc.Size {
+		if offset, err = restart(f); err != nil {
+			return false, err
+		}
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(http.MethodGet, c.url("blobs/%s", desc.Digest), header, nil)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			_, _ = restart(f)
+			return true, fmt.Errorf("unexpected content range: %s", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// 不支持Range请求，返回的是完整的内容
+		if offset, err = restart(f); err != nil {
+			return false, err
+		}
+	default:
+		return false, checkResponse(resp)
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, desc.Size-offset))
+	if err != nil {
+		return true, fmt.Errorf("io.Copy err: %v", err)
+	}
+	if offset+n != desc.Size {
+		return true, io.ErrUnexpectedEOF
+	}
+	return false, nil
+}
+
+/*
+restart 清空已下载的内容
+*/
+func restart(f *os.File) (int64, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, fmt.Errorf("f.Truncate err: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("f.Seek err: %v", err)
+	}
+	return 0, nil
+}
@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"mydocker/image"
+	"mydocker/path"
+)
+
+const (
+	// 分块上传时每一块的大小
+	chunkSize = 5 << 20
+)
+
+/*
+Push 把镜像推送到registry，层按compression压缩后分块上传，registry中已经存在的blob不再上传
+*/
+func Push(name string, compression string, options *Options, out io.Writer) error {
+	if err := image.ValidateCompression(compression); err != nil {
+		return err
+	}
+	ref, err := image.ParseTag(name)
+	if err != nil {
+		return err
+	}
+	id, img, err := image.Resolve(ref.String())
+	if err != nil {
+		return err
+	}
+	c, err := NewClient(ref, "pull,push", options)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "The push refers to repository [%s]\n", ref.Repository)
+	manifest := &image.Manifest{SchemaVersion: 2, MediaType: image.MediaTypeImageManifest}
+	for _, diffID := range img.RootFS.DiffIDs {
+		desc, err := c.pushLayer(diffID, compression, out)
+		if err != nil {
+			return fmt.Errorf("push layer %s err: %v", diffID, err)
+		}
+		manifest.Layers = append(manifest.Layers, *desc)
+	}
+	configPath := path.BlobPath(id.Hex())
+	fi, err := os.Stat(configPath)
+	if err != nil {
+		return fmt.Errorf("os.Stat err: %v", err)
+	}
+	manifest.Config = image.Descriptor{MediaType: image.MediaTypeImageConfig, Digest: id, Size: fi.Size()}
+	if err = c.pushBlob(id, configPath, fi.Size()); err != nil {
+		return fmt.Errorf("push config err: %v", err)
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("json.Marshal err: %v", err)
+	}
+	d, err := c.putManifest(ref.Tag, content)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "%s: digest: %s size: %d\n", ref.Tag, d, len(content))
+	return nil
+}
+
+/*
+pushLayer 压缩层并上传，返回压缩后层的描述符
+*/
+func (c *Client) pushLayer(diffID image.Digest, compression string, out io.Writer) (*image.Descriptor, error) {
+	tmpPath, desc, err := image.CompressLayer(diffID, compression)
+	if err != nil {
+		return nil, fmt.Errorf("image.CompressLayer err: %v", err)
+	}
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+	exists, err := c.blobExists(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		_, _ = fmt.Fprintf(out, "%s: Layer already exists\n", desc.Digest.Short())
+		return desc, nil
+	}
+	if err = c.uploadBlob(desc.Digest, tmpPath, desc.Size); err != nil {
+		return nil, err
+	}
+	_, _ = fmt.Fprintf(out, "%s: Pushed\n", desc.Digest.Short())
+	return desc, nil
+}
+
+/*
+pushBlob 上传registry中还没有的blob
+*/
+func (c *Client) pushBlob(d image.Digest, file string, size int64) error {
+	exists, err := c.blobExists(d)
+	if err != nil || exists {
+		return err
+	}
+	return c.uploadBlob(d, file, size)
+}
+
+func (c *Client) blobExists(d image.Digest) (bool, error) {
+	resp, err := c.do(http.MethodHead, c.url("blobs/%s", d), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err = checkResponse(resp, http.StatusOK); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+uploadBlob 分块上传blob: POST开始上传，每一块用PATCH上传并带上Content-Range，最后PUT带上摘要完成上传
+*/
+func (c *Client) uploadBlob(d image.Digest, file string, size int64) error {
+	resp, err := c.do(http.MethodPost, c.url("blobs/uploads/"), nil, nil)
+	if err != nil {
+		return err
+	}
+	location, err := c.uploadLocation(resp, http.StatusAccepted)
+	if err != nil {
+		return fmt.Errorf("start upload err: %v", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("os.Open err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	buf := make([]byte, chunkSize)
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("io.ReadFull err: %v", err)
+		}
+		header := http.Header{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+int64(n)-1)},
+		}
+		if resp, err = c.do(http.MethodPatch, location, header, buf[:n]); err != nil {
+			return err
+		}
+		if location, err = c.uploadLocation(resp, http.StatusAccepted); err != nil {
+			return fmt.Errorf("upload chunk err: %v", err)
+		}
+		offset += int64(n)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("url.Parse err: %v", err)
+	}
+	query := u.Query()
+	query.Set("digest", d.String())
+	u.RawQuery = query.Encode()
+	if resp, err = c.do(http.MethodPut, u.String(), nil, nil); err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err = checkResponse(resp, http.StatusCreated); err != nil {
+		return fmt.Errorf("complete upload err: %v", err)
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != "" && got != d.String() {
+		return fmt.Errorf("blob digest mismatch: expected %s, got %s", d, got)
+	}
+	return nil
+}
+
+/*
+uploadLocation 检查上传请求的响应，返回继续上传的地址
+*/
+func (c *Client) uploadLocation(resp *http.Response, expected int) (string, error) {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, expected); err != nil {
+		return "", err
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("registry returned no upload location")
+	}
+	return c.resolve(location)
+}
+
+/*
+putManifest 上传清单，返回清单的摘要
+*/
+func (c *Client) putManifest(tag string, content []byte) (image.Digest, error) {
+	header := http.Header{"Content-Type": {image.MediaTypeImageManifest}}
+	resp, err := c.do(http.MethodPut, c.url("manifests/%s", tag), header, content)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err = checkResponse(resp, http.StatusCreated); err != nil {
+		return "", fmt.Errorf("put manifest err: %v", err)
+	}
+	d := image.FromBytes(content)
+	if got := resp.Header.Get("Docker-Content-Digest"); got != "" && got != d.String() {
+		return "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", d, got)
+	}
+	return d, nil
+}
@@ -0,0 +1,330 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"mydocker/image"
+	"mydocker/path"
+)
+
+const (
+	testRepo  = "test/app"
+	testToken = "secret-token"
+)
+
+/*
+fakeRegistry 测试用的registry: 要求bearer token，支持分块上传和Range请求，
+大blob第一次下载时中途断开连接
+*/
+type fakeRegistry struct {
+	mu            sync.Mutex
+	url           string
+	blobs         map[image.Digest][]byte
+	manifests     map[string]fakeManifest
+	uploads       map[string][]byte
+	interrupted   map[image.Digest]bool
+	tokenRequests int
+	chunks        int
+	ranges        int
+}
+
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:       make(map[image.Digest][]byte),
+		manifests:   make(map[string]fakeManifest),
+		uploads:     make(map[string][]byte),
+		interrupted: make(map[image.Digest]bool),
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	r.url = srv.URL
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.url, "http://")
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		if !contains(req.URL.Query()["scope"], "repository:"+testRepo+":pull") {
+			http.Error(w, "missing scope", http.StatusForbidden)
+			return
+		}
+		r.tokenRequests++
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, r.url, testRepo))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/"+testRepo+"/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	switch {
+	case rest == "blobs/uploads/" && req.Method == http.MethodPost:
+		id := strconv.Itoa(len(r.uploads) + 1)
+		r.uploads[id] = nil
+		w.Header().Set("Location", "/v2/"+testRepo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(rest, "blobs/uploads/"):
+		r.serveUpload(w, req, strings.TrimPrefix(rest, "blobs/uploads/"), body)
+	case strings.HasPrefix(rest, "blobs/"):
+		r.serveBlob(w, req, image.Digest(strings.TrimPrefix(rest, "blobs/")))
+	case strings.HasPrefix(rest, "manifests/"):
+		reference := strings.TrimPrefix(rest, "manifests/")
+		if req.Method == http.MethodPut {
+			d := image.FromBytes(body)
+			m := fakeManifest{mediaType: req.Header.Get("Content-Type"), content: body}
+			r.manifests[reference], r.manifests[d.String()] = m, m
+			w.Header().Set("Docker-Content-Digest", d.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		m, ok := r.manifests[reference]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", image.FromBytes(m.content).String())
+		_, _ = w.Write(m.content)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+/*
+serveUpload PATCH追加一块，Content-Range的起点必须是已上传的大小，PUT校验摘要后完成上传
+*/
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string, body []byte) {
+	data, ok := r.uploads[id]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case http.MethodPatch:
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != len(data) || end != start+len(body)-1 {
+			http.Error(w, "invalid content range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(data, body...)
+		r.chunks++
+		w.Header().Set("Location", "/v2/"+testRepo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		data = append(data, body...)
+		d := image.Digest(req.URL.Query().Get("digest"))
+		if image.FromBytes(data) != d {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		r.blobs[d] = data
+		delete(r.uploads, id)
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, d image.Digest) {
+	data, ok := r.blobs[d]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		return
+	}
+	if rng := req.Header.Get("Range"); rng != "" {
+		var start int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil || start >= len(data) {
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.ranges++
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[start:])
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if len(data) > 1<<20 && !r.interrupted[d] {
+		// 只返回一半内容，连接在响应结束时断开
+		r.interrupted[d] = true
+		_, _ = w.Write(data[:len(data)/2])
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+/*
+layerTar 生成层的tar包，包含一个比分块大小更大的随机文件，压缩后仍需要分多块上传
+*/
+func layerTar(t *testing.T) []byte {
+	random := make([]byte, chunkSize+chunkSize/2)
+	rand.New(rand.NewSource(1)).Read(random)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"hello", []byte("hello world\n")},
+		{"random", random},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPushPull(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	oldRoot := path.DataRoot()
+	t.Cleanup(func() {
+		path.SetDataRoot(oldRoot)
+	})
+	reg := newFakeRegistry(t)
+	name := reg.host() + "/" + testRepo
+
+	// 推送: 在第一个存储中导入镜像并推送
+	path.SetDataRoot(t.TempDir())
+	lease, err := image.NewLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := image.Import(bytes.NewReader(layerTar(t)), "test", image.Config{Cmd: []string{"/hello"}}, lease)
+	if err != nil {
+		t.Fatalf("image.Import err: %v", err)
+	}
+	ref, err := image.ParseTag(name + ":latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = image.Tag(ref, id); err != nil {
+		t.Fatal(err)
+	}
+	lease.Release()
+	if err = Push(name+":latest", image.CompressionGzip, &Options{}, io.Discard); err != nil {
+		t.Fatalf("Push err: %v", err)
+	}
+	if reg.tokenRequests == 0 {
+		t.Errorf("push did not request a bearer token")
+	}
+	if reg.chunks < 2 {
+		t.Errorf("layer uploaded in %d chunks, want at least 2", reg.chunks)
+	}
+	pushed, ok := reg.manifests["latest"]
+	if !ok {
+		t.Fatalf("manifest not pushed")
+	}
+
+	// 多平台镜像: 其他平台的清单排在前面且不存在，拉取时必须选择当前平台的清单
+	other := "arm64"
+	if runtime.GOARCH == other {
+		other = "amd64"
+	}
+	index := image.Index{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeImageIndex,
+		Manifests: []image.Descriptor{
+			{
+				MediaType: image.MediaTypeImageManifest,
+				Digest:    image.FromBytes([]byte("missing")),
+				Size:      7,
+				Platform:  &image.Platform{Architecture: other, OS: "linux"},
+			},
+			{
+				MediaType: image.MediaTypeImageManifest,
+				Digest:    image.FromBytes(pushed.content),
+				Size:      int64(len(pushed.content)),
+				Platform:  &image.Platform{Architecture: runtime.GOARCH, OS: "linux"},
+			},
+		},
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.manifests["multi"] = fakeManifest{mediaType: image.MediaTypeImageIndex, content: content}
+
+	// 拉取: 在新的存储中拉取，层的第一次下载会中断，需要用Range继续
+	path.SetDataRoot(t.TempDir())
+	pulled, err := Pull(name+":multi", &Options{}, io.Discard)
+	if err != nil {
+		t.Fatalf("Pull err: %v", err)
+	}
+	if pulled != id {
+		t.Errorf("pulled image %s, want %s", pulled, id)
+	}
+	if reg.ranges == 0 {
+		t.Errorf("interrupted download was not resumed with a range request")
+	}
+	img, err := image.Get(pulled)
+	if err != nil {
+		t.Fatalf("image.Get err: %v", err)
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !image.LayerExist(diffID) {
+			t.Errorf("layer %s was not imported", diffID)
+		}
+	}
+	if _, _, err = image.Resolve(name + ":multi"); err != nil {
+		t.Errorf("image.Resolve err: %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry",scope="repository:a/b:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("scheme = %q, want Bearer", scheme)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry",
+		"scope":   "repository:a/b:pull,push",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("params[%s] = %q, want %q", key, params[key], value)
+		}
+	}
+}
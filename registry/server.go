@@ -0,0 +1,622 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"mydocker/image"
+	"mydocker/path"
+)
+
+var (
+	// API路径，仓库名可以包含/
+	manifestRegexp = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	uploadRegexp   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([0-9a-f]*)$`)
+	blobRegexp     = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	tagsRegexp     = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+)
+
+/*
+Serve 把镜像存储作为Docker Registry HTTP API v2服务，可读可写，不做认证
+推送的blob先暂存，上传清单时校验并导入镜像存储，按仓库名和标签记录镜像名称，
+清单和其中压缩的层原样保留，拉取时返回推送的清单，摘要与推送时一致
+没有推送过的镜像，清单由镜像配置生成，层使用存储中未压缩的tar包，摘要即为diff id
+*/
+func Serve(l net.Listener) error {
+	if err := pruneManifests(); err != nil {
+		log.Warnf("registry prune manifests err: %v", err)
+	}
+	return http.Serve(l, &server{})
+}
+
+type server struct{}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Infof("registry %s %s", r.Method, r.URL.Path)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	p := r.URL.Path
+	switch {
+	case p == "/v2/" || p == "/v2":
+		writeJSON(w, http.StatusOK, struct{}{})
+	case p == "/v2/_catalog" && r.Method == http.MethodGet:
+		s.catalog(w)
+	case tagsRegexp.MatchString(p) && r.Method == http.MethodGet:
+		s.tags(w, tagsRegexp.FindStringSubmatch(p)[1])
+	case manifestRegexp.MatchString(p):
+		m := manifestRegexp.FindStringSubmatch(p)
+		s.manifest(w, r, m[1], m[2])
+	case uploadRegexp.MatchString(p):
+		m := uploadRegexp.FindStringSubmatch(p)
+		s.upload(w, r, m[1], m[2])
+	case blobRegexp.MatchString(p):
+		m := blobRegexp.FindStringSubmatch(p)
+		s.blob(w, r, m[1], m[2])
+	default:
+		writeError(w, http.StatusNotFound, "UNSUPPORTED", "the operation is unsupported")
+	}
+}
+
+/*
+catalog 列出所有仓库
+*/
+func (s *server) catalog(w http.ResponseWriter) {
+	references, err := image.References()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	seen := make(map[string]bool)
+	repositories := make([]string, 0)
+	for _, refs := range references {
+		for _, ref := range refs {
+			if !seen[ref.Repository] {
+				seen[ref.Repository] = true
+				repositories = append(repositories, ref.Repository)
+			}
+		}
+	}
+	sort.Strings(repositories)
+	writeJSON(w, http.StatusOK, map[string][]string{"repositories": repositories})
+}
+
+/*
+tags 列出仓库的标签
+*/
+func (s *server) tags(w http.ResponseWriter, name string) {
+	references, err := image.References()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	tags := make([]string, 0)
+	for _, refs := range references {
+		for _, ref := range refs {
+			if ref.Repository == name && ref.Tag != "" {
+				tags = append(tags, ref.Tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+	sort.Strings(tags)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "tags": tags})
+}
+
+func (s *server) manifest(w http.ResponseWriter, r *http.Request, name string, reference string) {
+	if !validName(name) {
+		writeError(w, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		content, err := s.findManifest(name, reference)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", image.MediaTypeImageManifest)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Header().Set("Docker-Content-Digest", image.FromBytes(content).String())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case http.MethodPut:
+		content, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		if len(content) > maxManifestSize {
+			writeError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest is too large")
+			return
+		}
+		d := image.FromBytes(content)
+		if err = s.putManifest(name, reference, content); err != nil {
+			log.Warnf("registry put manifest %s:%s err: %v", name, reference, err)
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, d))
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+	}
+}
+
+/*
+findManifest 按标签或清单摘要查找镜像，返回推送的清单或由镜像配置生成的清单
+*/
+func (s *server) findManifest(name string, reference string) ([]byte, error) {
+	if d, err := image.ParseDigest(reference); err == nil {
+		// 按摘要查找时比较仓库中每个镜像的清单
+		references, err := image.References()
+		if err != nil {
+			return nil, err
+		}
+		for id, refs := range references {
+			for _, ref := range refs {
+				if ref.Repository != name {
+					continue
+				}
+				if content, err := pushedManifest(id); err == nil && image.FromBytes(content) == d {
+					return content, nil
+				}
+				if content, err := imageManifest(id); err == nil && image.FromBytes(content) == d {
+					return content, nil
+				}
+				break
+			}
+		}
+		return nil, fmt.Errorf("manifest %s not found", reference)
+	}
+	ref, err := image.ParseTag(name + ":" + reference)
+	if err != nil {
+		return nil, err
+	}
+	id, err := image.Lookup(ref.String())
+	if err != nil {
+		return nil, err
+	}
+	if content, err := pushedManifest(id); err == nil {
+		return content, nil
+	}
+	return imageManifest(id)
+}
+
+/*
+pushedManifest 读取镜像推送时的清单，清单引用的blob都还在时才可以使用
+*/
+func pushedManifest(id image.Digest) ([]byte, error) {
+	content, err := os.ReadFile(path.RegistryManifestPath(id.Hex()))
+	if err != nil {
+		return nil, err
+	}
+	var manifest image.Manifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if manifest.Config.Digest != id {
+		return nil, fmt.Errorf("manifest config %s mismatch", manifest.Config.Digest)
+	}
+	for _, desc := range manifest.Layers {
+		if _, err = blobFile(desc.Digest); err != nil {
+			return nil, fmt.Errorf("blob %s unknown: %v", desc.Digest, err)
+		}
+	}
+	return content, nil
+}
+
+/*
+pruneManifests 删除镜像已经不存在的清单，以及不再被清单引用的暂存blob
+*/
+func pruneManifests() error {
+	used := make(map[string]bool)
+	entries, err := os.ReadDir(path.RegistryManifestsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.ReadDir err: %v", err)
+	}
+	for _, entry := range entries {
+		file := filepath.Join(path.RegistryManifestsPath(), entry.Name())
+		if _, err = image.Get(image.Digest("sha256:" + entry.Name())); err != nil {
+			_ = os.Remove(file)
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile err: %v", err)
+		}
+		var manifest image.Manifest
+		if err = json.Unmarshal(content, &manifest); err != nil {
+			_ = os.Remove(file)
+			continue
+		}
+		for _, desc := range manifest.Layers {
+			used[desc.Digest.Hex()] = true
+		}
+	}
+	blobs, err := os.ReadDir(filepath.Dir(path.StagedBlobPath("")))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.ReadDir err: %v", err)
+	}
+	for _, blob := range blobs {
+		if !used[blob.Name()] {
+			_ = os.Remove(path.StagedBlobPath(blob.Name()))
+		}
+	}
+	return nil
+}
+
+/*
+imageManifest 生成镜像的清单，层为存储中未压缩的tar包
+*/
+func imageManifest(id image.Digest) ([]byte, error) {
+	img, err := image.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	config, err := os.Stat(path.BlobPath(id.Hex()))
+	if err != nil {
+		return nil, fmt.Errorf("os.Stat err: %v", err)
+	}
+	manifest := &image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeImageManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeImageConfig, Digest: id, Size: config.Size()},
+		Layers:        make([]image.Descriptor, 0, len(img.RootFS.DiffIDs)),
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		fi, err := os.Stat(path.BlobPath(diffID.Hex()))
+		if err != nil {
+			return nil, fmt.Errorf("os.Stat err: %v", err)
+		}
+		manifest.Layers = append(manifest.Layers, image.Descriptor{MediaType: image.MediaTypeLayer, Digest: diffID, Size: fi.Size()})
+	}
+	return json.Marshal(manifest)
+}
+
+/*
+putManifest 导入推送的镜像: 读取镜像配置，导入还没有的层并校验diff id，然后记录标签
+*/
+func (s *server) putManifest(name string, reference string, content []byte) error {
+	var ref *image.Reference
+	if d, err := image.ParseDigest(reference); err == nil {
+		if image.FromBytes(content) != d {
+			return fmt.Errorf("manifest digest mismatch")
+		}
+	} else if ref, err = image.ParseTag(name + ":" + reference); err != nil {
+		return err
+	}
+	var manifest image.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = image.MediaTypeImageManifest
+	}
+	if !image.IsManifest(mediaType) {
+		return fmt.Errorf("unsupported manifest media type: %s", mediaType)
+	}
+	config, err := readStagedBlob(manifest.Config)
+	if err != nil {
+		return fmt.Errorf("read config err: %v", err)
+	}
+	var img image.Image
+	if err = json.Unmarshal(config, &img); err != nil {
+		return fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("config has %d diff ids but manifest has %d layers", len(img.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	// 注册镜像之前层不被任何镜像使用，先加入租约再检查层是否存在
+	lease, err := image.NewLease()
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+	if err = lease.Add(img.RootFS.DiffIDs...); err != nil {
+		return err
+	}
+	for i, desc := range manifest.Layers {
+		if image.LayerExist(img.RootFS.DiffIDs[i]) {
+			continue
+		}
+		if err = importStagedLayer(desc, img.RootFS.DiffIDs[i]); err != nil {
+			return err
+		}
+	}
+	id, err := image.WriteBlob(config)
+	if err != nil {
+		return fmt.Errorf("image.WriteBlob err: %v", err)
+	}
+	_ = os.Remove(path.StagedBlobPath(id.Hex()))
+	if err = image.Register(id); err != nil {
+		return err
+	}
+	// 保存推送的清单，拉取时原样返回
+	if err = os.MkdirAll(path.RegistryManifestsPath(), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll err: %v", err)
+	}
+	if err = os.WriteFile(path.RegistryManifestPath(id.Hex()), content, 0644); err != nil {
+		return fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	if ref != nil {
+		if err = image.Tag(ref, id); err != nil {
+			return fmt.Errorf("image.Tag err: %v", err)
+		}
+	}
+	log.Infof("registry imported image %s as %s:%s", id.Short(), name, reference)
+	return nil
+}
+
+/*
+importStagedLayer 导入暂存的层
+未压缩的层导入后与存储中的tar包相同，删除暂存的blob；压缩的层保留，推送的清单引用它
+*/
+func importStagedLayer(desc image.Descriptor, diffID image.Digest) error {
+	file, err := blobFile(desc.Digest)
+	if err != nil {
+		return fmt.Errorf("blob %s unknown: %v", desc.Digest, err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("os.Open err: %v", err)
+	}
+	err = image.ImportVerifiedLayer(f, desc, diffID)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("import layer %s err: %v", desc.Digest, err)
+	}
+	if desc.Digest == diffID {
+		_ = os.Remove(path.StagedBlobPath(desc.Digest.Hex()))
+	}
+	return nil
+}
+
+func readStagedBlob(desc image.Descriptor) ([]byte, error) {
+	file, err := blobFile(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	if image.FromBytes(content) != desc.Digest || int64(len(content)) != desc.Size {
+		return nil, fmt.Errorf("blob %s digest mismatch", desc.Digest)
+	}
+	return content, nil
+}
+
+/*
+blobFile blob所在的文件，先查找镜像存储，再查找暂存的上传
+*/
+func blobFile(d image.Digest) (string, error) {
+	if err := d.Validate(); err != nil {
+		return "", err
+	}
+	for _, file := range []string{path.BlobPath(d.Hex()), path.StagedBlobPath(d.Hex())} {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func (s *server) blob(w http.ResponseWriter, r *http.Request, name string, digest string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+		return
+	}
+	file, err := blobFile(image.Digest(digest))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Accept-Ranges", "bytes")
+	// ServeContent处理HEAD和Range请求，下载中断的客户端可以继续下载
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+/*
+upload 处理blob上传: POST开始上传(带digest时为单次上传)，PATCH追加数据，PUT完成上传并校验摘要
+*/
+func (s *server) upload(w http.ResponseWriter, r *http.Request, name string, uuid string) {
+	if !validName(name) {
+		writeError(w, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+		return
+	}
+	if r.Method == http.MethodPost && uuid == "" {
+		s.startUpload(w, r, name)
+		return
+	}
+	file := path.UploadPath(uuid)
+	fi, err := os.Stat(file)
+	if uuid == "" || err != nil {
+		writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeUploadStatus(w, http.StatusNoContent, name, uuid, fi.Size())
+	case http.MethodPatch:
+		size, err := appendUpload(file, r)
+		if err != nil {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		writeUploadStatus(w, http.StatusAccepted, name, uuid, size)
+	case http.MethodPut:
+		if _, err = appendUpload(file, r); err != nil {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		s.completeUpload(w, r, name, file)
+	case http.MethodDelete:
+		_ = os.Remove(file)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+	}
+}
+
+func (s *server) startUpload(w http.ResponseWriter, r *http.Request, name string) {
+	// 其他仓库中已经有这个blob时直接挂载
+	if mount := r.URL.Query().Get("mount"); mount != "" {
+		if _, err := blobFile(image.Digest(mount)); err == nil {
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, mount))
+			w.Header().Set("Docker-Content-Digest", mount)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	uuid := hex.EncodeToString(buf)
+	file := path.UploadPath(uuid)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	if r.URL.Query().Get("digest") != "" {
+		if _, err := appendUpload(file, r); err != nil {
+			_ = os.Remove(file)
+			writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		s.completeUpload(w, r, name, file)
+		return
+	}
+	writeUploadStatus(w, http.StatusAccepted, name, uuid, 0)
+}
+
+/*
+appendUpload 把请求的内容追加到上传文件，带Content-Range时起始位置必须与已上传的大小一致
+*/
+func appendUpload(file string, r *http.Request) (int64, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		var start, end int64
+		if _, err = fmt.Sscanf(strings.TrimPrefix(contentRange, "bytes="), "%d-%d", &start, &end); err != nil || start != fi.Size() {
+			return 0, fmt.Errorf("invalid content range %s, uploaded %d bytes", contentRange, fi.Size())
+		}
+	}
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size() + n, nil
+}
+
+/*
+completeUpload 校验上传内容的摘要，通过后移到暂存目录
+*/
+func (s *server) completeUpload(w http.ResponseWriter, r *http.Request, name string, file string) {
+	expected, err := image.ParseDigest(r.URL.Query().Get("digest"))
+	if err != nil {
+		_ = os.Remove(file)
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	d, _, err := image.FromReader(f)
+	_ = f.Close()
+	if err != nil || d != expected {
+		_ = os.Remove(file)
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+	staged := path.StagedBlobPath(d.Hex())
+	if err = os.MkdirAll(filepath.Dir(staged), 0755); err == nil {
+		err = os.Rename(file, staged)
+	}
+	if err != nil {
+		_ = os.Remove(file)
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, d))
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeUploadStatus(w http.ResponseWriter, status int, name string, uuid string, size int64) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uuid))
+	w.Header().Set("Docker-Upload-UUID", uuid)
+	// Range为已上传的字节范围(包含结尾)
+	w.Header().Set("Range", fmt.Sprintf("0-%d", max(size-1, 0)))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+/*
+validName 仓库名必须是不带registry地址的合法名称
+*/
+func validName(name string) bool {
+	ref, err := image.ParseTag(name)
+	return err == nil && ref.Repository == name && ref.Domain() == ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -20,13 +20,14 @@ func removeContainer(f bool, containerName string) error {
 		return fmt.Errorf("getContainerPidByName err: %v", err)
 	}
 
-	// 检查是否是停止容器
+	// 检查是否是停止容器，因oom退出的容器状态为exited
+	stopped := info.Status == container.STOP || info.Status == container.Exit
 	if !f {
-		if info.Status != container.STOP {
+		if !stopped {
 			return fmt.Errorf("not a stop container")
 		}
 	} else {
-		if info.Status != container.STOP {
+		if !stopped {
 			var pid int
 			pid, err = strconv.Atoi(info.Pid)
 			if err != nil {
@@ -35,23 +36,21 @@ func removeContainer(f bool, containerName string) error {
 			_ = syscall.Kill(pid, syscall.SIGKILL)
 		}
 	}
-	// 清理cgroup
-	if err = cgroups.Clear(info.Cgroup2Path); err != nil {
-		return fmt.Errorf("cgroups.clear err: %v", err)
-	}
-	// 删除存储容器信息的路径
-	if err = os.RemoveAll(path.ContainerInfoPath(containerName)); err != nil {
-		// 先执行umount命令
-		cmd := exec.Command("umount", path.MntPath(containerName))
-		if e := cmd.Run(); e != nil { // umount 运行成功
-			return fmt.Errorf("os.RemoveAll err: %v", err)
-		} else {
-			log.Infof("exec umount %s", path.MntPath(containerName))
-			// 再次删除
-			if err = os.RemoveAll(path.ContainerInfoPath(containerName)); err != nil {
-				return fmt.Errorf("os.RemoveAll err: %v", err)
-			}
+	// 清理cgroup(rootless模式下可能没有cgroup)
+	if info.CgroupPath != "" {
+		manager, err := cgroups.NewManager(info.CgroupPath)
+		if err != nil {
+			return fmt.Errorf("cgroups.NewManager err: %v", err)
 		}
+		if err = manager.Destroy(); err != nil {
+			return fmt.Errorf("manager.Destroy err: %v", err)
+		}
+	}
+	// 删除存储容器信息的路径，持有容器信息的锁，避免监控进程同时写入
+	if err = withContainerInfoLock(containerName, func() error {
+		return removeContainerInfo(containerName)
+	}); err != nil {
+		return err
 	}
 	// 删除网络
 	if info.NetworkName != "" {
@@ -63,3 +62,24 @@ func removeContainer(f bool, containerName string) error {
 	container.DeleteRunningSpace(path.ContainerUnionPath(containerName), path.MntPath(containerName), info.VolumePaths)
 	return nil
 }
+
+/*
+removeContainerInfo 删除存储容器信息的路径，删除失败时先umount再删除
+*/
+func removeContainerInfo(containerName string) error {
+	err := os.RemoveAll(path.ContainerInfoPath(containerName))
+	if err == nil {
+		return nil
+	}
+	// 先执行umount命令
+	cmd := exec.Command("umount", path.MntPath(containerName))
+	if e := cmd.Run(); e != nil {
+		return fmt.Errorf("os.RemoveAll err: %v", err)
+	}
+	log.Infof("exec umount %s", path.MntPath(containerName))
+	// 再次删除
+	if err = os.RemoveAll(path.ContainerInfoPath(containerName)); err != nil {
+		return fmt.Errorf("os.RemoveAll err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"mydocker/image"
+)
+
+/*
+removeImages 删除镜像
+参数为镜像名称时删除这个名称，镜像没有其他名称时删除镜像；参数为镜像id时删除镜像，有多个名称时需要-f
+容器使用的镜像只删除名称，不删除镜像(-f时)或者报错
+*/
+func removeImages(force bool, names []string) error {
+	inUse, err := imagesInUse()
+	if err != nil {
+		return fmt.Errorf("imagesInUse err: %v", err)
+	}
+	for _, name := range names {
+		if err = removeImage(force, name, inUse); err != nil {
+			return err
+		}
+	}
+	removed, err := image.GC()
+	if err != nil {
+		return fmt.Errorf("image.GC err: %v", err)
+	}
+	for _, layer := range removed {
+		fmt.Printf("Deleted: %s\n", layer.DiffID)
+	}
+	return nil
+}
+
+func removeImage(force bool, name string, inUse map[image.Digest][]string) error {
+	id, err := image.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("image.Lookup err: %v", err)
+	}
+	references, err := image.References()
+	if err != nil {
+		return fmt.Errorf("image.References err: %v", err)
+	}
+	refs := references[id]
+	var untag []*image.Reference
+	if ref, ok := matchReference(name, refs); ok {
+		// 按名称删除: 只删除这个名称
+		untag = []*image.Reference{ref}
+	} else {
+		// 按id删除: 删除所有名称
+		if len(refs) > 1 && !force {
+			return fmt.Errorf("unable to delete %s (must be forced) - image is referenced in multiple repositories", id.Short())
+		}
+		untag = refs
+	}
+	last := len(untag) == len(refs)
+	if last && len(inUse[id]) > 0 && !force {
+		return fmt.Errorf("unable to remove %s (must force) - image is being used by container %s", name, strings.Join(inUse[id], ", "))
+	}
+	for _, ref := range untag {
+		if _, err = image.Untag(ref); err != nil {
+			return fmt.Errorf("image.Untag err: %v", err)
+		}
+		fmt.Printf("Untagged: %s\n", ref)
+	}
+	// 还有其他名称或者正在被容器使用时保留镜像
+	if !last || len(inUse[id]) > 0 {
+		return nil
+	}
+	if err = image.Delete(id); err != nil {
+		return fmt.Errorf("image.Delete err: %v", err)
+	}
+	fmt.Printf("Deleted: %s\n", id)
+	return nil
+}
+
+/*
+matchReference name是否为镜像的某个名称
+*/
+func matchReference(name string, refs []*image.Reference) (*image.Reference, bool) {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return nil, false
+	}
+	for _, r := range refs {
+		if r.String() == ref.String() {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+/*
+pruneImages 删除没有名称的镜像，all为true时删除所有没有被容器使用的镜像，最后删除不再使用的层
+*/
+func pruneImages(all bool) error {
+	inUse, err := imagesInUse()
+	if err != nil {
+		return fmt.Errorf("imagesInUse err: %v", err)
+	}
+	ids, err := image.ListIDs()
+	if err != nil {
+		return fmt.Errorf("image.ListIDs err: %v", err)
+	}
+	references, err := image.References()
+	if err != nil {
+		return fmt.Errorf("image.References err: %v", err)
+	}
+	for _, id := range ids {
+		if len(inUse[id]) > 0 || (!all && len(references[id]) > 0) {
+			continue
+		}
+		for _, ref := range references[id] {
+			if _, err = image.Untag(ref); err != nil {
+				return fmt.Errorf("image.Untag err: %v", err)
+			}
+			fmt.Printf("Untagged: %s\n", ref)
+		}
+		if err = image.Delete(id); err != nil {
+			return fmt.Errorf("image.Delete err: %v", err)
+		}
+		fmt.Printf("Deleted: %s\n", id)
+	}
+	removed, err := image.GC()
+	if err != nil {
+		return fmt.Errorf("image.GC err: %v", err)
+	}
+	var reclaimed int64
+	for _, layer := range removed {
+		fmt.Printf("Deleted: %s\n", layer.DiffID)
+		reclaimed += layer.Size
+	}
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(reclaimed))
+	return nil
+}
+
+/*
+imagesInUse 容器使用的镜像，镜像id -> 容器名称
+*/
+func imagesInUse() (map[image.Digest][]string, error) {
+	infos, err := listContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[image.Digest][]string)
+	for _, info := range infos {
+		id := image.Digest(info.ImageID)
+		// 镜像存储之前创建的容器只记录了镜像名称
+		if id == "" {
+			if id, err = image.Lookup(info.ImageName); err != nil {
+				continue
+			}
+		}
+		inUse[id] = append(inUse[id], info.Name)
+	}
+	return inUse, nil
+}
@@ -6,123 +6,328 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"mydocker/cgroups"
 	"mydocker/container"
+	"mydocker/image"
 	"mydocker/path"
+	"mydocker/userns"
 )
 
-func Run(it bool, resourceConfig *cgroups.ResourceConfig, volume string, envs []string, networkName string, portMappings []string, containerName string, imageName string, comArray []string) error {
+/*
+runningContainer 已经启动的容器，交互式运行和构建镜像时等待容器退出后清理
+*/
+type runningContainer struct {
+	parent            *exec.Cmd
+	info              *container.Info
+	networkName       string
+	clearRecord       func()
+	clearCgroup       func()
+	clearRunningSpace func()
+}
+
+func Run(it bool, resourceConfig *cgroups.ResourceConfig, cgroupParent string, usernsRemap string, etcConfig *container.EtcConfig, volume string, envs []string, networkName string, portMappings []string, containerName string, imageName string, entrypoint []string, initConfig *container.InitConfig) error {
+	c, err := startContainer(it, resourceConfig, cgroupParent, usernsRemap, etcConfig, volume, envs, networkName, portMappings, containerName, imageName, entrypoint, initConfig)
+	if err != nil {
+		return err
+	}
+	if it { // 交互式创建：父进程等待子进程结束
+		if waitErr := c.wait(); waitErr != nil && !c.info.OOMKilled {
+			return fmt.Errorf("parent.Wait err:%v", waitErr)
+		}
+		if err = c.clear(); err != nil {
+			return err
+		}
+	} else if err = startMonitor(c.info.Name); err != nil {
+		// 后台容器由监控进程记录oom和内存压力事件，启动失败不影响容器运行
+		log.Warnf("startMonitor err: %v", err)
+	}
+	log.Infof("container running")
+	return nil
+}
+
+/*
+startContainer 准备容器的文件系统、cgroup、网络并启动容器进程
+*/
+func startContainer(it bool, resourceConfig *cgroups.ResourceConfig, cgroupParent string, usernsRemap string, etcConfig *container.EtcConfig, volume string, envs []string, networkName string, portMappings []string, containerName string, imageName string, entrypoint []string, initConfig *container.InitConfig) (_ *runningContainer, err error) {
 	var (
 		id          = randStringBytes(10)
 		volumePaths []string
 		pms         [][]string
-		err         error
 	)
 	if containerName == "" { // 用户没有设置名称
 		containerName = id
 	} else {
 		if b, err := isExistContainerName(containerName); err != nil { // 检查容器名称是否重复
-			return fmt.Errorf("isExistContainerName err: %v", err)
+			return nil, fmt.Errorf("isExistContainerName err: %v", err)
 		} else if b {
-			return fmt.Errorf("same container name exists")
+			return nil, fmt.Errorf("same container name exists")
 		}
 	}
 	if volume != "" { // 用户需要挂载卷
 		volumePaths, err = volumeExtract(volume)
 		if err != nil {
-			return fmt.Errorf("volumeExtract err: %v", err)
+			return nil, fmt.Errorf("volumeExtract err: %v", err)
 		}
 	}
+	if path.Rootless() && (networkName != "" || len(portMappings) != 0) {
+		return nil, fmt.Errorf("network and port mappings are not supported in rootless mode")
+	}
 	if len(portMappings) != 0 { // 用户需要端口映射
 		for _, p := range portMappings {
 			pm := strings.Split(p, ":")
 			if len(pm) != 2 {
-				return fmt.Errorf("portmapping:%s err", p)
+				return nil, fmt.Errorf("portmapping:%s err", p)
 			}
 			pms = append(pms, pm)
 		}
 	}
+	// user namespace的uid/gid映射
+	var uidMaps, gidMaps []userns.IDMap
+	if path.Rootless() {
+		if usernsRemap != "" {
+			return nil, fmt.Errorf("userns-remap is not supported in rootless mode")
+		}
+		if uidMaps, gidMaps, err = userns.RootlessMappings(); err != nil {
+			return nil, fmt.Errorf("userns.RootlessMappings err: %v", err)
+		}
+	} else if usernsRemap != "" {
+		if uidMaps, gidMaps, err = userns.RemapMappings(usernsRemap); err != nil {
+			return nil, fmt.Errorf("userns.RemapMappings err: %v", err)
+		}
+	}
+	// 查找镜像，镜像的层作为容器文件系统的只读层，镜像配置作为运行参数的默认值
+	imageID, img, err := image.Resolve(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("image.Resolve err: %v", err)
+	}
+	envs = applyImageConfig(&img.Config, entrypoint, envs, initConfig)
+	if err = initConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("initConfig.Validate err: %v", err)
+	}
 	// parent 父进程启动命令 /proc/self/exe
-	parent, writePipe, err := container.NewParentProcessCmd(it, envs, containerName)
+	parent, writePipe, err := container.NewParentProcessCmd(it, envs, containerName, uidMaps, gidMaps)
 	if err != nil {
-		return fmt.Errorf("container.NewParentProcessCmd err: %v", err)
+		return nil, fmt.Errorf("container.NewParentProcessCmd err: %v", err)
+	}
+	lowerDirs, err := image.LayerDirs(img, uidMaps, gidMaps)
+	if err != nil {
+		return nil, fmt.Errorf("image.LayerDirs err: %v", err)
 	}
 	// 创建容器的运行空间(文件系统)
-	err, clearRunningSpace := container.NewRunningSpace(imageName, containerName, volumePaths)
+	err, clearRunningSpace := container.NewRunningSpace(lowerDirs, containerName, volumePaths, uidMaps, gidMaps)
 	if err != nil {
-		return fmt.Errorf("container.NewRunningSpace err: %v", err)
+		return nil, fmt.Errorf("container.NewRunningSpace err: %v", err)
+	}
+	// 之后的步骤出错时回滚: 杀死等待init配置的容器进程，清理已经创建的记录、cgroup、网络和文件系统
+	started := &runningContainer{
+		parent:            parent,
+		clearRecord:       func() {},
+		clearCgroup:       func() {},
+		clearRunningSpace: clearRunningSpace,
 	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		_ = writePipe.Close()
+		if parent.Process != nil {
+			_ = parent.Process.Kill()
+			_ = parent.Wait()
+		}
+		if clearErr := started.clear(); clearErr != nil {
+			log.Errorf("clear err: %v", clearErr)
+		}
+	}()
 	// 指定运行目录
 	parent.Dir = path.MntPath(containerName)
+	if path.Rootless() {
+		initConfig.Rootfs = &container.RootfsConfig{
+			Dir:         path.ContainerUnionPath(containerName),
+			LowerDir:    container.LowerDir(containerName, lowerDirs),
+			UpperDir:    path.UpperPath(containerName),
+			WorkDir:     path.WorkerPath(containerName),
+			MntPath:     path.MntPath(containerName),
+			VolumePaths: volumePaths,
+		}
+	}
 	// docker init 成为容器运行的第一个进程
 	if err = parent.Start(); err != nil {
-		return fmt.Errorf("parent.Start err: %v", err)
+		return nil, fmt.Errorf("parent.Start err: %v", err)
+	}
+	// rootless: 写入user namespace的uid/gid映射
+	if path.Rootless() {
+		if err = userns.WriteMappings(parent.Process.Pid, uidMaps, gidMaps); err != nil {
+			return nil, fmt.Errorf("userns.WriteMappings err: %v", err)
+		}
+	}
+	// 设备白名单，特权容器不限制；rootless不能加载eBPF程序，设备访问由宿主机的文件权限控制
+	if !path.Rootless() && !initConfig.Security.Privileged {
+		resourceConfig.Devices = container.DeviceRules(initConfig.Devices)
 	}
 	// 设置资源限制
-	cgroup2Path, err, clearCgroup := enableParentResourceConfig(resourceConfig, parent.Process.Pid)
+	cgroupPath, err, clearCgroup := enableParentResourceConfig(resourceConfig, cgroupParent, id, parent.Process.Pid)
 	if err != nil {
-		return fmt.Errorf("enableParentResourceConfig err: %v", err)
+		// rootless模式下没有委派的cgroup时，不设置资源限制也可以运行
+		if !path.Rootless() || !resourceConfig.IsEmpty() {
+			return nil, fmt.Errorf("enableParentResourceConfig err: %v", err)
+		}
+		log.Warnf("run without cgroup in rootless mode: %v", err)
+		clearCgroup = func() {}
 	}
+	started.clearCgroup = clearCgroup
 	// 记录容器信息
-	cInfo, err, clearRecord := recordContainerInfo(id, containerName, parent.Process.Pid, cgroup2Path, volumePaths, networkName, pms, imageName, comArray)
+	cInfo, err, clearRecord := recordContainerInfo(id, containerName, parent.Process.Pid, cgroupPath, volumePaths, networkName, pms, imageName, initConfig.Command)
 	if err != nil {
-		return fmt.Errorf("recordContainerInfo err: %v", err)
+		return nil, fmt.Errorf("recordContainerInfo err: %v", err)
+	}
+	started.info, started.clearRecord = cInfo, clearRecord
+	// exec进入容器时需要加入同样的user namespace、应用同样的安全配置
+	cInfo.UidMappings, cInfo.GidMappings = uidMaps, gidMaps
+	cInfo.ImageID = imageID.String()
+	cInfo.Security = &initConfig.Security
+	if err = dumpContainerInfo(cInfo); err != nil {
+		return nil, fmt.Errorf("dumpContainerInfo err: %v", err)
 	}
 	// 连接网络
 	if networkName != "" {
 		if err = Connect(networkName, cInfo); err != nil {
-			return fmt.Errorf("connect err: %v", err)
+			return nil, fmt.Errorf("connect err: %v", err)
 		}
+		started.networkName = networkName
 	}
-	// 发送用户命令 如 /bin/bash
-	if err = sendUserCommand(comArray, writePipe); err != nil {
-		return fmt.Errorf("sendUserCommand err: %v", err)
+	// 生成容器的hosts、resolv.conf、hostname，默认主机名为容器id
+	if etcConfig.Hostname == "" {
+		etcConfig.Hostname = id
 	}
-	if it { // 交互式创建：父进程等待子进程结束
-		if err = parent.Wait(); err != nil {
-			return fmt.Errorf("parent.Wait err:%v", err)
+	if initConfig.EtcFiles, err = container.WriteEtcFiles(containerName, etcConfig, cInfo.IPAddress, uidMaps, gidMaps); err != nil {
+		return nil, fmt.Errorf("container.WriteEtcFiles err: %v", err)
+	}
+	initConfig.Hostname, initConfig.Domainname = etcConfig.Hostname, etcConfig.Domainname
+	cInfo.Hostname = etcConfig.Hostname
+	if err = dumpContainerInfo(cInfo); err != nil {
+		return nil, fmt.Errorf("dumpContainerInfo err: %v", err)
+	}
+	// 发送init配置，包括用户命令 如 /bin/bash
+	if err = sendInitConfig(initConfig, writePipe); err != nil {
+		return nil, fmt.Errorf("sendInitConfig err: %v", err)
+	}
+	return started, nil
+}
+
+/*
+wait 等待容器进程退出，等待期间监听oom和内存压力事件
+*/
+func (c *runningContainer) wait() error {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	refresh := func() {
+		if _, err := syncStoredContainerInfo(c.info.Name); err != nil {
+			log.Warnf("syncStoredContainerInfo err: %v", err)
 		}
-		clearRecord()
-		clearCgroup()
-		clearRunningSpace()
-		if networkName != "" {
-			// 从网络中移除设备
-			if err = DisConnect(networkName, cInfo); err != nil {
-				return fmt.Errorf("disConnect err: %v", err)
-			}
+	}
+	go func() {
+		watchMemoryEvents(c.info, refresh, done)
+		close(stopped)
+	}()
+	waitErr := c.parent.Wait()
+	close(done)
+	<-stopped
+	info, err := syncStoredContainerInfo(c.info.Name)
+	if err != nil {
+		log.Warnf("syncStoredContainerInfo err: %v", err)
+	} else if info != nil && info.OOMKilled {
+		// 调用者根据OOMKilled判断容器进程的退出是否是错误
+		c.info.OOMKilled = true
+		log.Warnf("container %s was oom killed", c.info.Name)
+	}
+	return waitErr
+}
+
+/*
+clear 删除退出容器的记录、cgroup、文件系统，从网络中移除
+*/
+func (c *runningContainer) clear() error {
+	c.clearRecord()
+	c.clearCgroup()
+	c.clearRunningSpace()
+	if c.networkName != "" {
+		// 从网络中移除设备
+		if err := DisConnect(c.networkName, c.info); err != nil {
+			return fmt.Errorf("disConnect err: %v", err)
 		}
 	}
-	log.Infof("container running")
 	return nil
 }
 
-func enableParentResourceConfig(resourceConfig *cgroups.ResourceConfig, parentPid int) (string, error, func()) {
-	cgroup2Path, err := cgroups.Create(parentPid)
+/*
+applyImageConfig 用镜像配置补全运行参数，返回容器的环境变量
+命令为Entrypoint加上Cmd，用户指定的命令替换Cmd；指定--entrypoint时不再使用镜像的Cmd
+-e指定的环境变量覆盖镜像中的同名变量，工作目录和用户没有指定时使用镜像的配置
+*/
+func applyImageConfig(config *image.Config, entrypoint []string, envs []string, initConfig *container.InitConfig) []string {
+	cmd := initConfig.Command
+	if entrypoint == nil {
+		entrypoint = config.Entrypoint
+		if len(cmd) == 0 {
+			cmd = config.Cmd
+		}
+	}
+	initConfig.Command = append(append([]string{}, entrypoint...), cmd...)
+	if initConfig.WorkingDir == "" {
+		initConfig.WorkingDir = config.WorkingDir
+	}
+	if initConfig.Security.User == "" {
+		initConfig.Security.User = config.User
+	}
+	// 子进程的环境变量中同名变量以最后一个为准
+	return append(append([]string{}, config.Env...), envs...)
+}
+
+func enableParentResourceConfig(resourceConfig *cgroups.ResourceConfig, cgroupParent string, containerId string, parentPid int) (string, error, func()) {
+	if path.Rootless() && cgroupParent == cgroups.DefaultCgroupParent {
+		cgroupParent = cgroups.RootlessCgroupParent()
+		if cgroupParent == "" {
+			return "", fmt.Errorf("no delegated cgroup found for current user"), nil
+		}
+	}
+	cgroupPath, err := cgroups.NewCgroupPath(cgroupParent, containerId)
 	if err != nil {
-		return "", err, nil
+		return "", fmt.Errorf("cgroups.NewCgroupPath err: %v", err), nil
+	}
+	manager, err := cgroups.NewManager(cgroupPath)
+	if err != nil {
+		return "", fmt.Errorf("cgroups.NewManager err: %v", err), nil
+	}
+	if err = manager.Create(); err != nil {
+		return "", fmt.Errorf("manager.Create err: %v", err), nil
 	}
 	clearCgroup := func() {
-		if err := cgroups.Clear(cgroup2Path); err != nil {
-			log.Errorf("cgroups.clear err: %v", err)
+		if err := manager.Destroy(); err != nil {
+			log.Errorf("manager.Destroy err: %v", err)
 		}
 	}
-	if err = cgroups.Set(cgroup2Path, resourceConfig); err != nil {
-		return "", fmt.Errorf("cgroups.set err: %v", err), nil
+	// 设置失败时删除已经创建的cgroup，否则每次运行失败都会残留
+	if err = manager.Set(resourceConfig); err != nil {
+		clearCgroup()
+		return "", fmt.Errorf("manager.Set err: %v", err), nil
 	}
-	if err = cgroups.Apply(cgroup2Path, parentPid); err != nil {
-		return "", fmt.Errorf("cgroups.Apply err: %v", err), nil
+	if err = manager.Apply(parentPid); err != nil {
+		clearCgroup()
+		return "", fmt.Errorf("manager.Apply err: %v", err), nil
 	}
-	return cgroup2Path, nil, clearCgroup
+	return manager.Path(), nil, clearCgroup
 }
 
-func sendUserCommand(comArray []string, writePipe *os.File) error {
-	bytes, err := json.Marshal(&comArray)
+func sendInitConfig(initConfig *container.InitConfig, writePipe *os.File) error {
+	bytes, err := json.Marshal(initConfig)
 	if err != nil {
 		return fmt.Errorf("json.Marshal err: %v", err)
 	}
@@ -136,7 +341,7 @@ func sendUserCommand(comArray []string, writePipe *os.File) error {
 /*
 记录容器信息
 */
-func recordContainerInfo(containerId string, containerName string, containerPID int, cgroup2Path string, volumePaths []string, networkName string, portMappings [][]string, imageName string, commandArray []string) (*container.Info, error, func()) {
+func recordContainerInfo(containerId string, containerName string, containerPID int, cgroupPath string, volumePaths []string, networkName string, portMappings [][]string, imageName string, commandArray []string) (*container.Info, error, func()) {
 	createTime := time.Now().Format("2006-01-02 15:04:05")
 	var command string
 	for _, s := range commandArray {
@@ -152,7 +357,7 @@ func recordContainerInfo(containerId string, containerName string, containerPID
 		Name:         containerName,
 		Command:      command,
 		VolumePaths:  volumePaths,
-		Cgroup2Path:  cgroup2Path,
+		CgroupPath:   cgroupPath,
 		NetworkName:  networkName,
 		PortMappings: portMappings,
 		ImageName:    imageName,
@@ -164,7 +369,7 @@ func recordContainerInfo(containerId string, containerName string, containerPID
 		return nil, fmt.Errorf("json.Marshal err: %v", err), nil
 	}
 	infoDir := path.ContainerInfoPath(containerName)
-	if err = os.MkdirAll(infoDir, 0622); err != nil {
+	if err = os.MkdirAll(infoDir, 0755); err != nil {
 		return nil, fmt.Errorf("os.MkdirAll err: %v", err), nil
 	}
 	clearFunc := func() {
@@ -191,6 +396,77 @@ func recordContainerInfo(containerId string, containerName string, containerPID
 	return &info, err, clearFunc
 }
 
+/*
+保存容器信息
+*/
+func dumpContainerInfo(info *container.Info) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("json.Marshal err: %v", err)
+	}
+	// 先写临时文件再重命名，读取的一方不会看到写了一半的文件
+	infoPath := path.InfoPath(info.Name)
+	tmp, err := os.CreateTemp(filepath.Dir(infoPath), ".info-*.json")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp err: %v", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("tmp.Write err: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close err: %v", err)
+	}
+	if err = os.Chmod(tmp.Name(), 0622); err != nil {
+		return fmt.Errorf("os.Chmod err: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), infoPath); err != nil {
+		return fmt.Errorf("os.Rename err: %v", err)
+	}
+	return nil
+}
+
+/*
+withContainerInfoLock 持有容器信息的文件锁执行fn，监控进程与stop、rm等命令修改info.json时串行化
+容器信息目录已经被删除时返回的错误满足os.IsNotExist
+*/
+func withContainerInfoLock(containerName string, fn func() error) error {
+	f, err := os.OpenFile(path.InfoLockPath(containerName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("syscall.Flock err: %v", err)
+	}
+	defer func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}()
+	return fn()
+}
+
+/*
+updateContainerInfo 持有文件锁读取容器信息，update返回true时保存修改
+*/
+func updateContainerInfo(containerName string, update func(info *container.Info) (bool, error)) error {
+	return withContainerInfoLock(containerName, func() error {
+		info, err := getContainerInfoByName(containerName)
+		if err != nil {
+			return fmt.Errorf("getContainerInfoByName err: %v", err)
+		}
+		changed, err := update(info)
+		if err != nil || !changed {
+			return err
+		}
+		return dumpContainerInfo(info)
+	})
+}
+
 /*
 退出删除容器信息
 */
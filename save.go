@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"mydocker/image"
+)
+
+/*
+saveImages 把镜像导出为OCI image layout格式的tar包，output为空时写到标准输出
+*/
+func saveImages(output string, compression string, imageNames []string) error {
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("os.Create err: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		w = f
+	}
+	if err := image.Save(w, imageNames, compression); err != nil {
+		if output != "" {
+			_ = os.Remove(output)
+		}
+		return fmt.Errorf("image.Save err: %v", err)
+	}
+	return nil
+}
+
+/*
+loadImages 从OCI image layout格式的tar包导入镜像，input为空时从标准输入读取
+*/
+func loadImages(input string) error {
+	r := os.Stdin
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("os.Open err: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		r = f
+	}
+	loaded, err := image.Load(r)
+	if err != nil {
+		return fmt.Errorf("image.Load err: %v", err)
+	}
+	for _, name := range loaded {
+		fmt.Printf("Loaded image: %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// struct seccomp_data 中各字段的偏移
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+	// seccomp返回值
+	retKillThread  = 0x00000000
+	retKillProcess = 0x80000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+	// 默认的errno
+	defaultErrno = uint(unix.EPERM)
+	// 经典bpf的跳转偏移只有8位
+	maxJump = 255
+)
+
+/*
+instruction 待汇编的bpf指令，jtFail、jfFail表示跳转到所在规则的结尾(规则不匹配)
+*/
+type instruction struct {
+	code   uint16
+	jt, jf uint8
+	k      uint32
+	jtFail bool
+	jfFail bool
+}
+
+func stmt(code uint16, k uint32) instruction {
+	return instruction{code: code, k: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) instruction {
+	return instruction{code: code, k: k, jt: jt, jf: jf}
+}
+
+func loadAbs(offset uint32) instruction {
+	return stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset)
+}
+
+func ret(k uint32) instruction {
+	return stmt(unix.BPF_RET|unix.BPF_K, k)
+}
+
+/*
+compatArch 本机内核还能运行的其他ABI(x86_64上的i386、x32，aarch64上的arm)，
+name为profile中的名称，filterArch为规则includes、excludes中的名称
+*/
+type compatArch struct {
+	name       string
+	filterArch string
+	audit      uint32
+	table      map[string]int
+}
+
+/*
+Compile 把profile编译为经典bpf程序，caps为容器的capability，用于判断规则的includes、excludes
+程序结构:
+ 1. 检查架构，本机架构和profile中列出的兼容ABI跳转到各自的规则，其他架构杀死进程
+    profile中列出的其他架构本机内核无法运行，不会出现
+ 2. 每个架构加载系统调用号，按该架构的系统调用表依次匹配每条规则，匹配则返回规则的动作
+ 3. 都不匹配返回默认动作
+*/
+func Compile(profile *Profile, caps []string) ([]unix.SockFilter, error) {
+	if auditArch == 0 {
+		return nil, fmt.Errorf("seccomp is not supported on this architecture")
+	}
+	defaultRet, err := actionToRet(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	capSet := make(map[string]bool)
+	for _, c := range caps {
+		capSet[c] = true
+	}
+	arches, err := profile.arches()
+	if err != nil {
+		return nil, err
+	}
+	native, err := compileSyscalls(profile, syscallTable, runtime.GOARCH, capSet, defaultRet)
+	if err != nil {
+		return nil, err
+	}
+	sections := []archSection{{audit: auditArch, rules: native}}
+	var x32 []instruction
+	for _, compat := range compatArches {
+		if !containsString(arches, compat.name) {
+			continue
+		}
+		rules, err := compileSyscalls(profile, compat.table, compat.filterArch, capSet, defaultRet)
+		if err != nil {
+			return nil, err
+		}
+		if compat.name == archX32 {
+			x32 = rules
+			continue
+		}
+		sections = append(sections, archSection{audit: compat.audit, rules: rules})
+	}
+	program := assemble(sections, x32, defaultRet)
+	if len(program) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp program too long: %d instructions", len(program))
+	}
+	filters := make([]unix.SockFilter, 0, len(program))
+	for _, ins := range program {
+		filters = append(filters, unix.SockFilter{Code: ins.code, Jt: ins.jt, Jf: ins.jf, K: ins.k})
+	}
+	return filters, nil
+}
+
+/*
+compileSyscalls 按一个架构的系统调用表编译所有规则，累加器中为系统调用号
+filterArch用于匹配规则includes、excludes中的架构
+*/
+func compileSyscalls(profile *Profile, table map[string]int, filterArch string, capSet map[string]bool, defaultRet uint32) ([]instruction, error) {
+	var program []instruction
+	for _, rule := range profile.Syscalls {
+		if rule.Includes != nil && !rule.Includes.matchAll(capSet, filterArch) {
+			continue
+		}
+		if rule.Excludes != nil && rule.Excludes.matchAny(capSet, filterArch) {
+			continue
+		}
+		ruleRet, err := actionToRet(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		// 与默认动作相同且没有参数条件的规则不需要生成
+		if ruleRet == defaultRet && len(rule.Args) == 0 {
+			continue
+		}
+		names := rule.Names
+		if rule.Name != "" {
+			names = append([]string{rule.Name}, names...)
+		}
+		for _, name := range names {
+			nr, ok := table[name]
+			if !ok { // 该架构没有这个系统调用
+				continue
+			}
+			block, err := compileRule(uint32(nr), ruleRet, rule.Args)
+			if err != nil {
+				return nil, fmt.Errorf("compile rule %s err: %v", name, err)
+			}
+			program = append(program, block...)
+		}
+	}
+	return program, nil
+}
+
+/*
+archSection 一个架构(AUDIT_ARCH)的规则
+*/
+type archSection struct {
+	audit uint32
+	rules []instruction
+}
+
+/*
+assemble 拼接架构检查和各架构的规则，第一个section为本机架构
+规则可能有上千条指令，超出条件跳转8位偏移的范围，通过BPF_JA(32位偏移)跳转到各架构的规则
+x32与x86_64的AUDIT_ARCH相同，通过系统调用号的x32SyscallBit区分，x32为nil时与libseccomp一样杀死进程
+*/
+func assemble(sections []archSection, x32 []instruction, defaultRet uint32) []instruction {
+	const (
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ja  = unix.BPF_JMP | unix.BPF_JA
+	)
+	// 每个section的指令: 加载系统调用号、规则、默认动作
+	bodies := make([][]instruction, 0, len(sections))
+	for i, section := range sections {
+		body := []instruction{loadAbs(offsetNr)}
+		if i == 0 && x32SyscallBit != 0 {
+			body = append(body, jump(jge, x32SyscallBit, 0, 1))
+			if x32 != nil {
+				// 跳过本机架构的规则和默认动作，x32的规则紧跟在后面
+				body = append(body, stmt(ja, uint32(len(section.rules)+1)))
+			} else {
+				body = append(body, ret(retKillProcess))
+			}
+		}
+		body = append(body, section.rules...)
+		body = append(body, ret(defaultRet))
+		if i == 0 && x32 != nil {
+			body = append(body, x32...)
+			body = append(body, ret(defaultRet))
+		}
+		bodies = append(bodies, body)
+	}
+	program := []instruction{loadAbs(offsetArch)}
+	// 架构检查之后是各个section，start为下一个section的位置
+	start := len(program) + 2*len(sections) + 1
+	for i, section := range sections {
+		program = append(program, jump(jeq, section.audit, 0, 1))
+		program = append(program, stmt(ja, uint32(start-len(program)-1)))
+		start += len(bodies[i])
+	}
+	program = append(program, ret(retKillProcess))
+	for _, body := range bodies {
+		program = append(program, body...)
+	}
+	return program
+}
+
+/*
+compileRule 编译一条规则，累加器中为系统调用号，规则结束时重新加载系统调用号
+*/
+func compileRule(nr uint32, action uint32, args []*Arg) ([]instruction, error) {
+	if len(args) == 0 {
+		return []instruction{
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+			ret(action),
+		}, nil
+	}
+	block := []instruction{{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: nr, jfFail: true}}
+	for _, arg := range args {
+		cmp, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, cmp...)
+	}
+	block = append(block, ret(action))
+	// 规则结尾: 参数比较破坏了累加器，重新加载系统调用号
+	end := len(block)
+	block = append(block, loadAbs(offsetNr))
+	for i := range block {
+		if block[i].jtFail {
+			if end-i-1 > maxJump {
+				return nil, fmt.Errorf("jump too far")
+			}
+			block[i].jt = uint8(end - i - 1)
+		}
+		if block[i].jfFail {
+			if end-i-1 > maxJump {
+				return nil, fmt.Errorf("jump too far")
+			}
+			block[i].jf = uint8(end - i - 1)
+		}
+	}
+	return block, nil
+}
+
+/*
+compileArg 比较64位参数，分别比较高32位和低32位(小端)，比较成功继续执行下一条指令，失败跳到规则结尾
+*/
+func compileArg(arg *Arg) ([]instruction, error) {
+	if arg.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index: %d", arg.Index)
+	}
+	lo := loadAbs(offsetArgs + uint32(arg.Index)*8)
+	hi := loadAbs(offsetArgs + uint32(arg.Index)*8 + 4)
+	vhi, vlo := uint32(arg.Value>>32), uint32(arg.Value)
+	const (
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jgt = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		and = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	)
+	switch arg.Op {
+	case OpEqualTo:
+		return []instruction{
+			hi, {code: jeq, k: vhi, jfFail: true},
+			lo, {code: jeq, k: vlo, jfFail: true},
+		}, nil
+	case OpNotEqual:
+		return []instruction{
+			hi, jump(jeq, vhi, 0, 2),
+			lo, {code: jeq, k: vlo, jtFail: true},
+		}, nil
+	case OpGreaterThan, OpGreaterEqual:
+		last := instruction{code: jgt, k: vlo, jfFail: true}
+		if arg.Op == OpGreaterEqual {
+			last.code = jge
+		}
+		return []instruction{
+			hi, jump(jgt, vhi, 3, 0),
+			{code: jeq, k: vhi, jfFail: true},
+			lo, last,
+		}, nil
+	case OpLessThan, OpLessEqual:
+		last := instruction{code: jge, k: vlo, jtFail: true}
+		if arg.Op == OpLessEqual {
+			last.code = jgt
+		}
+		return []instruction{
+			hi, jump(jge, vhi, 0, 3),
+			{code: jeq, k: vhi, jfFail: true},
+			lo, last,
+		}, nil
+	case OpMaskedEqual:
+		mhi, mlo := vhi, vlo
+		whi, wlo := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+		return []instruction{
+			hi, stmt(and, mhi), {code: jeq, k: whi, jfFail: true},
+			lo, stmt(and, mlo), {code: jeq, k: wlo, jfFail: true},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operator: %s", arg.Op)
+}
+
+/*
+actionToRet 把动作转换为seccomp返回值
+*/
+func actionToRet(action Action, errnoRet *uint) (uint32, error) {
+	switch action {
+	case ActKill, ActKillThread:
+		return retKillThread, nil
+	case ActKillProcess:
+		return retKillProcess, nil
+	case ActTrap:
+		return retTrap, nil
+	case ActErrno:
+		errno := defaultErrno
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return retErrno | uint32(errno&0xffff), nil
+	case ActTrace:
+		errno := defaultErrno
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return retTrace | uint32(errno&0xffff), nil
+	case ActLog:
+		return retLog, nil
+	case ActAllow:
+		return retAllow, nil
+	}
+	return 0, fmt.Errorf("unknown seccomp action: %s", action)
+}
@@ -0,0 +1,184 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+seccompData 对应内核的struct seccomp_data
+*/
+type seccompData struct {
+	nr   uint32
+	arch uint32
+	args [6]uint64
+}
+
+func (d *seccompData) load(offset uint32) uint32 {
+	buf := make([]byte, 64)
+	binary.LittleEndian.PutUint32(buf[offsetNr:], d.nr)
+	binary.LittleEndian.PutUint32(buf[offsetArch:], d.arch)
+	for i, arg := range d.args {
+		binary.LittleEndian.PutUint64(buf[offsetArgs+i*8:], arg)
+	}
+	return binary.LittleEndian.Uint32(buf[offset:])
+}
+
+/*
+run 解释执行编译出的程序，只支持Compile生成的指令
+*/
+func run(t *testing.T, program []unix.SockFilter, data *seccompData) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(program); pc++ {
+		ins := program[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = data.load(ins.K)
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= ins.K
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(ins.K)
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			var match bool
+			switch ins.Code & 0xf0 {
+			case unix.BPF_JEQ:
+				match = acc == ins.K
+			case unix.BPF_JGT:
+				match = acc > ins.K
+			case unix.BPF_JGE:
+				match = acc >= ins.K
+			}
+			if match {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", ins.Code, pc)
+		}
+	}
+	t.Fatalf("program fell off the end")
+	return 0
+}
+
+func compile(t *testing.T, profile *Profile) []unix.SockFilter {
+	if auditArch == 0 {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+	program, err := Compile(profile, nil)
+	if err != nil {
+		t.Fatalf("Compile err: %v", err)
+	}
+	return program
+}
+
+func TestCompileArch(t *testing.T) {
+	profile := &Profile{
+		DefaultAction: ActErrno,
+		Architectures: []string{nativeArch, "SCMP_ARCH_X86", archX32, "SCMP_ARCH_ARM"},
+		Syscalls:      []*Syscall{{Names: []string{"getpid"}, Action: ActAllow}},
+	}
+	program := compile(t, profile)
+	errno := uint32(retErrno | uint32(unix.EPERM))
+	type archTest struct {
+		name string
+		data seccompData
+		want uint32
+	}
+	tests := []archTest{
+		{"native allowed", seccompData{nr: uint32(syscallTable["getpid"]), arch: auditArch}, retAllow},
+		{"native default", seccompData{nr: uint32(syscallTable["mkdirat"]), arch: auditArch}, errno},
+		{"unlisted arch", seccompData{nr: uint32(syscallTable["getpid"]), arch: unix.AUDIT_ARCH_S390X}, retKillProcess},
+	}
+	// 兼容ABI按自己的系统调用表匹配
+	for _, compat := range compatArches {
+		arch := compat.audit
+		tests = append(tests,
+			archTest{compat.name + " allowed", seccompData{nr: uint32(compat.table["getpid"]), arch: arch}, retAllow},
+			archTest{compat.name + " default", seccompData{nr: uint32(compat.table["mkdirat"]), arch: arch}, errno},
+		)
+	}
+	for _, tt := range tests {
+		if got := run(t, program, &tt.data); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+
+	// 没有列出的兼容ABI杀死进程
+	profile.Architectures = []string{nativeArch}
+	program = compile(t, profile)
+	for _, compat := range compatArches {
+		if got := run(t, program, &seccompData{nr: uint32(compat.table["getpid"]), arch: compat.audit}); got != retKillProcess {
+			t.Errorf("unlisted %s: got %#x, want %#x", compat.name, got, uint32(retKillProcess))
+		}
+	}
+}
+
+func TestCompileArgs(t *testing.T) {
+	const big = uint64(1) << 40
+	tests := []struct {
+		arg   Arg
+		value uint64
+		match bool
+	}{
+		{Arg{Op: OpEqualTo, Value: big + 1}, big + 1, true},
+		{Arg{Op: OpEqualTo, Value: big + 1}, 1, false},
+		{Arg{Op: OpNotEqual, Value: big}, big, false},
+		{Arg{Op: OpNotEqual, Value: big}, big + 1, true},
+		{Arg{Op: OpGreaterThan, Value: big}, big, false},
+		{Arg{Op: OpGreaterThan, Value: big}, big + 1, true},
+		{Arg{Op: OpGreaterThan, Value: 5}, big, true},
+		{Arg{Op: OpGreaterEqual, Value: big}, big, true},
+		{Arg{Op: OpGreaterEqual, Value: big}, big - 1, false},
+		{Arg{Op: OpLessThan, Value: big}, big - 1, true},
+		{Arg{Op: OpLessThan, Value: big}, big, false},
+		{Arg{Op: OpLessEqual, Value: big}, big, true},
+		{Arg{Op: OpLessEqual, Value: big}, big + 1, false},
+		{Arg{Op: OpMaskedEqual, Value: 0xff00, ValueTwo: 0x1200}, 0x1234, true},
+		{Arg{Op: OpMaskedEqual, Value: 0xff00, ValueTwo: 0x1200}, 0x2234, false},
+	}
+	nr := uint32(syscallTable["getpid"])
+	for _, tt := range tests {
+		arg := tt.arg
+		arg.Index = 1
+		profile := &Profile{
+			DefaultAction: ActErrno,
+			Syscalls:      []*Syscall{{Names: []string{"getpid"}, Action: ActAllow, Args: []*Arg{&arg}}},
+		}
+		program := compile(t, profile)
+		data := &seccompData{nr: nr, arch: auditArch}
+		data.args[1] = tt.value
+		if got := run(t, program, data) == retAllow; got != tt.match {
+			t.Errorf("%s %#x against %#x: match = %v, want %v", tt.arg.Op, tt.arg.Value, tt.value, got, tt.match)
+		}
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	profile, err := DefaultProfile()
+	if err != nil {
+		t.Fatalf("DefaultProfile err: %v", err)
+	}
+	program := compile(t, profile)
+	if got := run(t, program, &seccompData{nr: uint32(syscallTable["getpid"]), arch: auditArch}); got != retAllow {
+		t.Errorf("getpid: got %#x, want allow", got)
+	}
+	if nr, ok := syscallTable["kexec_load"]; ok {
+		if got := run(t, program, &seccompData{nr: uint32(nr), arch: auditArch}); got == retAllow {
+			t.Errorf("kexec_load is allowed by the default profile")
+		}
+	}
+}
+
+func TestParseProfileArches(t *testing.T) {
+	if _, err := parseProfile([]byte(`{"defaultAction":"SCMP_ACT_ALLOW","architectures":["SCMP_ARCH_FOO"]}`)); err == nil {
+		t.Errorf("unknown architecture accepted")
+	}
+	if _, err := parseProfile([]byte(`{"defaultAction":"SCMP_ACT_ALLOW","architectures":["SCMP_ARCH_X86"],"archMap":[{"architecture":"SCMP_ARCH_X86_64"}]}`)); err == nil {
+		t.Errorf("both architectures and archMap accepted")
+	}
+}
@@ -0,0 +1,264 @@
+package seccomp
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Unconfined 不使用seccomp
+	Unconfined = "unconfined"
+)
+
+//go:embed default.json
+var defaultProfile []byte
+
+/*
+Action 系统调用匹配规则后的动作
+*/
+type Action string
+
+const (
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActLog         Action = "SCMP_ACT_LOG"
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+)
+
+/*
+Operator 系统调用参数的比较方式
+*/
+type Operator string
+
+const (
+	OpNotEqual     Operator = "SCMP_CMP_NE"
+	OpLessThan     Operator = "SCMP_CMP_LT"
+	OpLessEqual    Operator = "SCMP_CMP_LE"
+	OpEqualTo      Operator = "SCMP_CMP_EQ"
+	OpGreaterEqual Operator = "SCMP_CMP_GE"
+	OpGreaterThan  Operator = "SCMP_CMP_GT"
+	OpMaskedEqual  Operator = "SCMP_CMP_MASKED_EQ"
+)
+
+/*
+Profile 与docker兼容的seccomp json配置
+*/
+type Profile struct {
+	DefaultAction   Action     `json:"defaultAction"`
+	DefaultErrnoRet *uint      `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string   `json:"architectures,omitempty"`
+	ArchMap         []ArchMap  `json:"archMap,omitempty"`
+	Syscalls        []*Syscall `json:"syscalls"`
+}
+
+/*
+ArchMap 主架构及其子架构
+*/
+type ArchMap struct {
+	Arch      string   `json:"architecture"`
+	SubArches []string `json:"subArchitectures"`
+}
+
+/*
+Syscall 一条系统调用规则，Args之间是与的关系
+*/
+type Syscall struct {
+	Name     string   `json:"name,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Action   Action   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []*Arg   `json:"args,omitempty"`
+	Includes *Filter  `json:"includes,omitempty"`
+	Excludes *Filter  `json:"excludes,omitempty"`
+}
+
+/*
+Arg 系统调用参数条件，SCMP_CMP_MASKED_EQ时Value为掩码，ValueTwo为期望值
+*/
+type Arg struct {
+	Index    uint     `json:"index"`
+	Value    uint64   `json:"value"`
+	ValueTwo uint64   `json:"valueTwo"`
+	Op       Operator `json:"op"`
+}
+
+/*
+Filter 规则生效的条件，capability、架构和最低内核版本
+*/
+type Filter struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// archX32 x32 ABI与x86_64的AUDIT_ARCH相同，通过系统调用号区分
+const archX32 = "SCMP_ARCH_X32"
+
+// auditArches profile中的架构名称对应的AUDIT_ARCH
+var auditArches = map[string]uint32{
+	"SCMP_ARCH_X86":         unix.AUDIT_ARCH_I386,
+	"SCMP_ARCH_X86_64":      unix.AUDIT_ARCH_X86_64,
+	archX32:                 unix.AUDIT_ARCH_X86_64,
+	"SCMP_ARCH_ARM":         unix.AUDIT_ARCH_ARM,
+	"SCMP_ARCH_AARCH64":     unix.AUDIT_ARCH_AARCH64,
+	"SCMP_ARCH_MIPS":        unix.AUDIT_ARCH_MIPS,
+	"SCMP_ARCH_MIPS64":      unix.AUDIT_ARCH_MIPS64,
+	"SCMP_ARCH_MIPS64N32":   unix.AUDIT_ARCH_MIPS64N32,
+	"SCMP_ARCH_MIPSEL":      unix.AUDIT_ARCH_MIPSEL,
+	"SCMP_ARCH_MIPSEL64":    unix.AUDIT_ARCH_MIPSEL64,
+	"SCMP_ARCH_MIPSEL64N32": unix.AUDIT_ARCH_MIPSEL64N32,
+	"SCMP_ARCH_PPC":         unix.AUDIT_ARCH_PPC,
+	"SCMP_ARCH_PPC64":       unix.AUDIT_ARCH_PPC64,
+	"SCMP_ARCH_PPC64LE":     unix.AUDIT_ARCH_PPC64LE,
+	"SCMP_ARCH_S390":        unix.AUDIT_ARCH_S390,
+	"SCMP_ARCH_S390X":       unix.AUDIT_ARCH_S390X,
+	"SCMP_ARCH_RISCV64":     unix.AUDIT_ARCH_RISCV64,
+}
+
+/*
+DefaultProfile 内置的默认配置，与docker的默认配置一致
+*/
+func DefaultProfile() (*Profile, error) {
+	return parseProfile(defaultProfile)
+}
+
+/*
+LoadProfile 加载json配置文件
+*/
+func LoadProfile(file string) (*Profile, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile err: %v", err)
+	}
+	return parseProfile(content)
+}
+
+func parseProfile(content []byte) (*Profile, error) {
+	var profile Profile
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal err: %v", err)
+	}
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("missing defaultAction in seccomp profile")
+	}
+	if _, err := profile.arches(); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+/*
+arches 允许的架构，与docker一致: architectures和archMap不能同时指定，
+archMap只取主架构为本机架构的一项及其子架构，本机架构总是允许
+*/
+func (p *Profile) arches() ([]string, error) {
+	if len(p.Architectures) > 0 && len(p.ArchMap) > 0 {
+		return nil, fmt.Errorf("both architectures and archMap are specified in seccomp profile")
+	}
+	arches := []string{nativeArch}
+	arches = append(arches, p.Architectures...)
+	for _, a := range p.ArchMap {
+		if a.Arch == nativeArch {
+			arches = append(arches, a.SubArches...)
+		}
+	}
+	for _, a := range arches {
+		if _, ok := auditArches[a]; !ok && a != "" {
+			return nil, fmt.Errorf("unknown architecture in seccomp profile: %s", a)
+		}
+	}
+	return arches, nil
+}
+
+/*
+匹配includes条件，所有条件都满足时规则生效，arch为规则所属架构在includes、excludes中的名称
+*/
+func (f *Filter) matchAll(caps map[string]bool, arch string) bool {
+	for _, c := range f.Caps {
+		if !caps[c] {
+			return false
+		}
+	}
+	if len(f.Arches) > 0 && !containsString(f.Arches, arch) {
+		return false
+	}
+	if f.MinKernel != "" && !kernelAtLeast(f.MinKernel) {
+		return false
+	}
+	return true
+}
+
+/*
+匹配excludes条件，任意一个条件满足时规则不生效
+*/
+func (f *Filter) matchAny(caps map[string]bool, arch string) bool {
+	for _, c := range f.Caps {
+		if caps[c] {
+			return true
+		}
+	}
+	if containsString(f.Arches, arch) {
+		return true
+	}
+	if f.MinKernel != "" && kernelAtLeast(f.MinKernel) {
+		return true
+	}
+	return false
+}
+
+/*
+当前内核版本是否不低于minKernel(major.minor)
+*/
+func kernelAtLeast(minKernel string) bool {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	current, want := parseKernelVersion(string(release)), parseKernelVersion(minKernel)
+	if current[0] != want[0] {
+		return current[0] > want[0]
+	}
+	return current[1] >= want[1]
+}
+
+func parseKernelVersion(version string) [2]int {
+	var res [2]int
+	for i, part := range strings.SplitN(version, ".", 3) {
+		if i > 1 {
+			break
+		}
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		res[i], _ = strconv.Atoi(part[:end])
+	}
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package seccomp
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+Install 编译profile并为当前线程安装seccomp过滤器，调用者需要锁定线程，安装后应尽快execve
+内核要求调用者已经设置no_new_privs或者拥有CAP_SYS_ADMIN
+*/
+func Install(profile *Profile, caps []string) error {
+	filters, err := Compile(profile, caps)
+	if err != nil {
+		return fmt.Errorf("compile seccomp profile err: %v", err)
+	}
+	prog := unix.SockFprog{Len: uint16(len(filters)), Filter: &filters[0]}
+	// 不使用SECCOMP_FILTER_FLAG_TSYNC，只作用于当前线程，随后在该线程上execve
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, 0, uintptr(unsafe.Pointer(&prog)))
+	if errno == unix.ENOSYS {
+		// 内核不支持seccomp系统调用时使用prctl
+		err = unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+	} else if errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		return fmt.Errorf("install seccomp filter err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux || (!amd64 && !arm64)
+
+package seccomp
+
+// 其他架构暂不支持seccomp
+
+const (
+	nativeArch    = ""
+	auditArch     = 0
+	x32SyscallBit = 0
+)
+
+var syscallTable = map[string]int{}
+
+var compatArches []compatArch
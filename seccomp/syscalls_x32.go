@@ -0,0 +1,76 @@
+//go:build linux && amd64
+
+package seccomp
+
+// x32 ABI的系统调用号，与arch/x86/entry/syscalls/syscall_64.tbl一致:
+// common的系统调用与x86_64相同，64位专用的系统调用在x32上不存在，
+// 参数中含有指针数组、结构体布局不同的系统调用使用512开始的x32专用系统调用号，
+// 所有系统调用号都带有x32SyscallBit
+
+// x32没有的x86_64系统调用(syscall_64.tbl中abi为64)
+var x32Excluded = []string{
+	"rt_sigaction", "rt_sigreturn", "ioctl", "readv", "writev", "recvfrom", "sendmsg", "recvmsg",
+	"execve", "ptrace", "rt_sigpending", "rt_sigtimedwait", "rt_sigqueueinfo", "sigaltstack",
+	"uselib", "_sysctl", "create_module", "get_kernel_syms", "query_module", "nfsservctl",
+	"set_thread_area", "get_thread_area", "io_setup", "io_submit", "epoll_ctl_old", "epoll_wait_old",
+	"vserver", "timer_create", "mq_notify", "kexec_load", "waitid", "set_robust_list",
+	"get_robust_list", "vmsplice", "move_pages", "preadv", "pwritev", "rt_tgsigqueueinfo",
+	"recvmmsg", "sendmmsg", "process_vm_readv", "process_vm_writev", "setsockopt", "getsockopt",
+	"execveat", "preadv2", "pwritev2",
+}
+
+// x32专用的系统调用号
+var x32Specific = map[string]int{
+	"rt_sigaction":      512,
+	"rt_sigreturn":      513,
+	"ioctl":             514,
+	"readv":             515,
+	"writev":            516,
+	"recvfrom":          517,
+	"sendmsg":           518,
+	"recvmsg":           519,
+	"execve":            520,
+	"ptrace":            521,
+	"rt_sigpending":     522,
+	"rt_sigtimedwait":   523,
+	"rt_sigqueueinfo":   524,
+	"sigaltstack":       525,
+	"timer_create":      526,
+	"mq_notify":         527,
+	"kexec_load":        528,
+	"waitid":            529,
+	"set_robust_list":   530,
+	"get_robust_list":   531,
+	"vmsplice":          532,
+	"move_pages":        533,
+	"preadv":            534,
+	"pwritev":           535,
+	"rt_tgsigqueueinfo": 536,
+	"recvmmsg":          537,
+	"sendmmsg":          538,
+	"process_vm_readv":  539,
+	"process_vm_writev": 540,
+	"setsockopt":        541,
+	"getsockopt":        542,
+	"io_setup":          543,
+	"io_submit":         544,
+	"execveat":          545,
+	"preadv2":           546,
+	"pwritev2":          547,
+}
+
+var x32SyscallTable = buildX32SyscallTable()
+
+func buildX32SyscallTable() map[string]int {
+	table := make(map[string]int, len(syscallTable))
+	for name, nr := range syscallTable {
+		table[name] = nr | x32SyscallBit
+	}
+	for _, name := range x32Excluded {
+		delete(table, name)
+	}
+	for name, nr := range x32Specific {
+		table[name] = nr | x32SyscallBit
+	}
+	return table
+}
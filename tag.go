@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"mydocker/image"
+)
+
+/*
+tagImage 给源镜像设置新的名称，没有标签时为latest
+*/
+func tagImage(source string, target string) error {
+	ref, err := image.ParseTag(target)
+	if err != nil {
+		return err
+	}
+	id, _, err := image.Resolve(source)
+	if err != nil {
+		return fmt.Errorf("image.Resolve err: %v", err)
+	}
+	if err = image.Tag(ref, id); err != nil {
+		return fmt.Errorf("image.Tag err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package userns
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+ChownTree 按照映射把目录树中每个文件的属主从容器内的id平移到宿主机上的id，
+使容器root在user namespace中看到的文件属主与镜像中一致
+chown会清除setuid/setgid位，平移之后恢复原来的权限
+硬链接指向同一个inode，只能平移一次，否则第二次会在已经平移过的id上再平移
+*/
+func ChownTree(root string, uidMaps []IDMap, gidMaps []IDMap) error {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	visited := make(map[inode]bool)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unsupported stat of %s", p)
+		}
+		if !d.IsDir() && stat.Nlink > 1 {
+			key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if visited[key] {
+				return nil
+			}
+			visited[key] = true
+		}
+		uid, ok := ToHost(int(stat.Uid), uidMaps)
+		if !ok {
+			return fmt.Errorf("uid %d of %s is out of mapping range", stat.Uid, p)
+		}
+		gid, ok := ToHost(int(stat.Gid), gidMaps)
+		if !ok {
+			return fmt.Errorf("gid %d of %s is out of mapping range", stat.Gid, p)
+		}
+		if err = os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 && info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			return os.Chmod(p, info.Mode())
+		}
+		return nil
+	})
+}
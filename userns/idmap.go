@@ -0,0 +1,216 @@
+package userns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// 用户的从属uid、gid范围
+	subUidFile = "/etc/subuid"
+	subGidFile = "/etc/subgid"
+)
+
+/*
+IDMap user namespace的uid/gid映射，容器内[ContainerID, ContainerID+Size)映射到宿主机[HostID, HostID+Size)
+*/
+type IDMap struct {
+	ContainerID int `json:"containerId"`
+	HostID      int `json:"hostId"`
+	Size        int `json:"size"`
+}
+
+/*
+RootlessMappings 非root用户的映射: 容器root映射到当前用户，容器内其余id映射到/etc/subuid、/etc/subgid中分配给该用户的范围
+没有分配从属id时只映射容器root
+*/
+func RootlessMappings() ([]IDMap, []IDMap, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, nil, fmt.Errorf("user.Current err: %v", err)
+	}
+	uid, gid := os.Geteuid(), os.Getegid()
+	uidMaps := []IDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	gidMaps := []IDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	subUids, err := parseSubIDFile(subUidFile, u.Username, uid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parseSubIDFile err: %v", err)
+	}
+	subGids, err := parseSubIDFile(subGidFile, u.Username, uid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parseSubIDFile err: %v", err)
+	}
+	if len(subUids) > 0 && len(subGids) > 0 {
+		uidMaps = append(uidMaps, IDMap{ContainerID: 1, HostID: subUids[0].HostID, Size: subUids[0].Size})
+		gidMaps = append(gidMaps, IDMap{ContainerID: 1, HostID: subGids[0].HostID, Size: subGids[0].Size})
+	}
+	return uidMaps, gidMaps, nil
+}
+
+/*
+parseSubIDFile 解析/etc/subuid、/etc/subgid，格式: name或uid:start:count
+返回的IDMap只有HostID和Size有意义
+*/
+func parseSubIDFile(file string, name string, id int) ([]IDMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	ranges := make([]IDMap, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry: %s", file, scanner.Text())
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry: %s", file, scanner.Text())
+		}
+		ranges = append(ranges, IDMap{HostID: start, Size: count})
+	}
+	return ranges, scanner.Err()
+}
+
+/*
+WriteMappings 为进程pid所在的user namespace写入uid/gid映射
+映射多个范围需要setuid的newuidmap/newgidmap，只映射当前用户自己时直接写/proc/pid/{uid,gid}_map
+*/
+func WriteMappings(pid int, uidMaps []IDMap, gidMaps []IDMap) error {
+	if len(uidMaps) == 1 && len(gidMaps) == 1 {
+		return writeSelfMappings(pid, uidMaps[0], gidMaps[0])
+	}
+	if err := runIDMapHelper("newuidmap", pid, uidMaps); err != nil {
+		return err
+	}
+	if err := runIDMapHelper("newgidmap", pid, gidMaps); err != nil {
+		return err
+	}
+	return nil
+}
+
+func runIDMapHelper(helper string, pid int, maps []IDMap) error {
+	helperPath, err := exec.LookPath(helper)
+	if err != nil {
+		return fmt.Errorf("%s not found, please install the uidmap package: %v", helper, err)
+	}
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	if output, err := exec.Command(helperPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s err: %v, output: %s", helper, err, string(output))
+	}
+	return nil
+}
+
+/*
+非特权进程只能把自己的uid/gid映射进去，并且写gid_map之前必须禁用setgroups
+*/
+func writeSelfMappings(pid int, uidMap IDMap, gidMap IDMap) error {
+	procPath := fmt.Sprintf("/proc/%d", pid)
+	if err := os.WriteFile(procPath+"/uid_map", []byte(formatIDMap(uidMap)), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		if err := os.WriteFile(procPath+"/setgroups", []byte("deny"), 0644); err != nil {
+			return fmt.Errorf("os.WriteFile err: %v", err)
+		}
+	}
+	if err := os.WriteFile(procPath+"/gid_map", []byte(formatIDMap(gidMap)), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile err: %v", err)
+	}
+	return nil
+}
+
+func formatIDMap(m IDMap) string {
+	return fmt.Sprintf("%d %d %d\n", m.ContainerID, m.HostID, m.Size)
+}
+
+/*
+RemapMappings --userns-remap user[:group]，容器内[0, size)映射到该用户在/etc/subuid、/etc/subgid中分配的范围
+*/
+func RemapMappings(remap string) ([]IDMap, []IDMap, error) {
+	userName, groupName, found := strings.Cut(remap, ":")
+	if !found {
+		groupName = userName
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user.Lookup err: %v", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	subUids, err := parseSubIDFile(subUidFile, u.Username, uid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parseSubIDFile err: %v", err)
+	}
+	if len(subUids) == 0 {
+		return nil, nil, fmt.Errorf("no subordinate uid range for user %s in %s", userName, subUidFile)
+	}
+	g, err := user.LookupGroup(groupName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user.LookupGroup err: %v", err)
+	}
+	gid, _ := strconv.Atoi(g.Gid)
+	subGids, err := parseSubIDFile(subGidFile, g.Name, gid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parseSubIDFile err: %v", err)
+	}
+	if len(subGids) == 0 {
+		return nil, nil, fmt.Errorf("no subordinate gid range for group %s in %s", groupName, subGidFile)
+	}
+	uidMaps := []IDMap{{ContainerID: 0, HostID: subUids[0].HostID, Size: subUids[0].Size}}
+	gidMaps := []IDMap{{ContainerID: 0, HostID: subGids[0].HostID, Size: subGids[0].Size}}
+	return uidMaps, gidMaps, nil
+}
+
+/*
+ToHost 将容器内的id转换为宿主机上的id，不在映射范围内返回false
+*/
+func ToHost(id int, maps []IDMap) (int, bool) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ToContainer 将宿主机上的id转换为容器内的id，不在映射范围内返回false
+*/
+func ToContainer(id int, maps []IDMap) (int, bool) {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ToSysProcIDMap 转换为syscall.SysProcAttr中使用的映射
+*/
+func ToSysProcIDMap(maps []IDMap) []syscall.SysProcIDMap {
+	res := make([]syscall.SysProcIDMap, 0, len(maps))
+	for _, m := range maps {
+		res = append(res, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return res
+}